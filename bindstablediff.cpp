@@ -1,4 +1,5 @@
 #include "bindstablediff.h"
+#include "ggml.h"
 
 #if defined (__unix__) || (defined (__APPLE__) && defined (__MACH__))
 #include <signal.h>
@@ -36,92 +37,331 @@ int printsysteminfo(){
     return 0;
 }
 
-int loadStableDiffusion(char *sdfilename,int n_threads,int enumSchedule, StableDiffusionModel *model){
-    printf("going to init stable diffusion from file %s (enumSchedule=%d)\n",sdfilename,enumSchedule);
+int loadStableDiffusion(char *sdfilename,int n_threads,int enumSchedule,bool useMmap,bool lowMemory, StableDiffusionModel *model){
+    printf("going to init stable diffusion from file %s (enumSchedule=%d useMmap=%d lowMemory=%d)\n",sdfilename,enumSchedule,useMmap,lowMemory);
     bool vae_decode_only = false; // IMG2IMG tää on false :( meneepä mutkikkaaksi!  EI kun true aina!
-    bool free_params_immediately = false;
+    bool free_params_immediately = lowMemory;
     model->modelfilename=sdfilename;
     model->sd = new StableDiffusion(n_threads, vae_decode_only, free_params_immediately,STD_DEFAULT_RNG);
     
     std::string sFname(sdfilename);
     StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
-    s->load_from_file(sFname, (Schedule)enumSchedule);
-    return 0;
-}
-
-//Simple and dummy way to use model with no real control to output
-uint8_t *txt2img(StableDiffusionModel *model,
-    char *prompt,
-    char *negativePrompt,
-    float cfg_scale,
-    int width,int height, 
-    int sampleMethod,
-    int sampleSteps,
-    int64_t seed){
-
-   std::string sPrompt(prompt);
-   std::string sNegativePrompt(negativePrompt);
- 
-   StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
-
-   std::vector<uint8_t> resultVec= theModel->txt2img(
-        sPrompt,
-        sNegativePrompt,
-        cfg_scale,
-        width, height,
-        (SampleMethod)sampleMethod,
-        sampleSteps,
-        seed);
+    if (!s->load_from_file(sFname, (Schedule)enumSchedule, useMmap)){
+        return -1;
+    }
+    return 0;
+}
 
-    uint8_t *resultData=(uint8_t *)calloc(resultVec.size(),1);
-    std::memcpy(resultData,&resultVec[0],resultVec.size());
-    //printf("copied vector size of %d\n",resultVec.size());
-    return resultData;
+int beginLoadStableDiffusion(char *sdfilename,int n_threads,int modelType,int ftype, StableDiffusionModel *model){
+    model->modelfilename=sdfilename;
+    model->sd = new StableDiffusion(n_threads, false, false,STD_DEFAULT_RNG);
+    StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
+    if (!s->load_begin(std::string(sdfilename), modelType, ftype)){
+        return -1;
+    }
+    return 0;
+}
+
+int addVocab(StableDiffusionModel *model, char *tokens, int *lengths, int n){
+    StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
+    for (int i=0;i<n;i++){
+        s->add_vocab_token(std::string(tokens,lengths[i]), i);
+        tokens+=lengths[i];
+    }
+    return 0;
+}
+
+int loadTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data){
+    StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
+    std::vector<int64_t> neVec(ne, ne+nDims);
+    if (!s->load_tensor(std::string(name), neVec, data)){
+        return -1;
+    }
+    return 0;
+}
+
+int finishLoadStableDiffusion(StableDiffusionModel *model, float *alphasCumprod, int enumSchedule){
+    StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
+    if (!s->load_end(alphasCumprod, (Schedule)enumSchedule)){
+        return -1;
+    }
+    return 0;
+}
+
+int modelType(StableDiffusionModel *model){
+    StableDiffusion * s= static_cast<StableDiffusion *>(model->sd);
+    if (s==NULL){
+        return -1;
+    }
+    return s->model_type();
+}
+
+size_t ggmlRowSize(int ggmlType, int n){
+    int blck=ggml_blck_size((ggml_type)ggmlType);
+    if (n%blck!=0){
+        return 0;
+    }
+    return ggml_type_size((ggml_type)ggmlType)*(n/blck);
+}
+
+size_t convertFloats(int ggmlType, float *src, void *dst, int n){
+    switch (ggmlType){
+        case GGML_TYPE_F32:
+            std::memcpy(dst,src,n*sizeof(float));
+            return n*sizeof(float);
+        case GGML_TYPE_F16:
+            ggml_fp32_to_fp16_row(src,(ggml_fp16_t *)dst,n);
+            return n*sizeof(ggml_fp16_t);
+    }
+    int64_t hist[16]={0};
+    return ggml_quantize_chunk((ggml_type)ggmlType,src,dst,0,n,hist);
 }
 
-//TBD  img2img have its issues
-uint8_t *img2img(StableDiffusionModel *model,
-    uint8_t *initialImage,
-    char *prompt,
-    char *negativePrompt,
-    float cfg_scale,
-    int width,int height, 
-    int sampleMethod,
-    int sampleSteps,
-    float strength,
-    int64_t seed){
-
-    printf("\n\nPROMPT %s\n",prompt);
-    printf("NEGATIVE PROMPT %s\n",negativePrompt);
-    printf("cfg_scale=%f\n",cfg_scale);
-    printf("sample_method=%d\n",sampleMethod);
-    printf("sample_steps=%d\n",sampleSteps);
-    printf("strength=%f\n",strength);
-    printf("seed=%ld\n\n",seed);
-
-    std::vector<uint8_t> initImgVec(initialImage, initialImage + (width*height*3));
-
-   std::string sPrompt(prompt);
-   std::string sNegativePrompt(negativePrompt);
- 
-   StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
-
-   std::vector<uint8_t> resultVec= theModel->img2img(
-    initImgVec,
-        sPrompt,
-        sNegativePrompt,
-        cfg_scale,
-        width, height,
-        (SampleMethod)sampleMethod,
-        sampleSteps,
-        strength,
-        seed);
+int decodeFloats(int ggmlType, void *src, float *dst, int n){
+    //ggml_init fills f16 lookup tables used on decoding
+    static bool tablesReady=[]{
+        struct ggml_init_params params={0, NULL, true};
+        ggml_free(ggml_init(params));
+        return true;
+    }();
+    (void)tablesReady;
+    if (ggmlType==GGML_TYPE_F32){
+        std::memcpy(dst,src,n*sizeof(float));
+        return 0;
+    }
+    ggml_type_traits_t traits=ggml_internal_get_type_traits((ggml_type)ggmlType);
+    if (traits.to_float==NULL){
+        return -1;
+    }
+    traits.to_float(src,dst,n);
+    return 0;
+}
+
+//Exported from Go, fills noise from NoiseSource behind handle
+extern "C" void goNoiseFill(uintptr_t handle, int64_t seed, uint64_t offset, float *out, uint32_t n);
 
+static SDParams toSDParams(GenerationParams *pars){
+    SDParams result;
+    result.prompt=std::string(pars->prompt);
+    result.negative_prompt=std::string(pars->negativePrompt);
+    result.cfg_scale=pars->cfg_scale;
+    result.width=pars->width;
+    result.height=pars->height;
+    result.sample_method=(SampleMethod)pars->sampleMethod;
+    result.sample_steps=pars->sampleSteps;
+    result.strength=pars->strength;
+    result.latent_fill=pars->latentFill;
+    result.content_x=pars->contentX;
+    result.content_y=pars->contentY;
+    result.content_width=pars->contentWidth;
+    result.content_height=pars->contentHeight;
+    result.seed=pars->seed;
+    result.variation_seed=pars->variationSeed;
+    result.variation_strength=pars->variationStrength;
+    result.seed_resize_width=pars->seedResizeWidth;
+    result.seed_resize_height=pars->seedResizeHeight;
+    result.vae_tiling=pars->vaeTiling;
+    result.taesd=pars->taesd;
+    result.clip_skip=pars->clipSkip;
+    result.original_width=pars->originalWidth;
+    result.original_height=pars->originalHeight;
+    result.crop_top=pars->cropTop;
+    result.crop_left=pars->cropLeft;
+    result.target_width=pars->targetWidth;
+    result.target_height=pars->targetHeight;
+    result.hires_width=pars->hiresWidth;
+    result.hires_height=pars->hiresHeight;
+    result.hires_steps=pars->hiresSteps;
+    result.hires_denoise=pars->hiresDenoise;
+    result.hires_latent=pars->hiresLatent;
+    result.cfg_rescale=pars->cfgRescale;
+    result.dynthres_mimic_scale=pars->dynThresMimicScale;
+    result.dynthres_percentile=pars->dynThresPercentile;
+    result.cfg_schedule=(CFGSchedule)pars->cfgSchedule;
+    result.cfg_scale_end=pars->cfgScaleEnd;
+    if (pars->cfgScales!=NULL){
+        result.cfg_scales.assign(pars->cfgScales, pars->cfgScales+pars->nCfgScales);
+    }
+    result.cfg_stop_at=pars->cfgStopAt;
+    if (pars->noiseSource!=0){
+        result.noise_callback=goNoiseFill;
+        result.noise_user_data=pars->noiseSource;
+    }
+    return result;
+}
+
+//Result is allocated with calloc, caller frees. NULL if generation failed
+static uint8_t *toResultData(std::vector<uint8_t> &resultVec){
+    if (resultVec.size()==0){
+        return NULL;
+    }
     uint8_t *resultData=(uint8_t *)calloc(resultVec.size(),1);
     std::memcpy(resultData,&resultVec[0],resultVec.size());
     return resultData;
 }
 
+uint8_t *txt2img(StableDiffusionModel *model, GenerationParams *pars){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    std::vector<uint8_t> resultVec= theModel->txt2img(toSDParams(pars));
+    return toResultData(resultVec);
+}
+
+static void printImg2imgPars(GenerationParams *pars){
+    printf("\n\nPROMPT %s\n",pars->prompt);
+    printf("NEGATIVE PROMPT %s\n",pars->negativePrompt);
+    printf("cfg_scale=%f\n",pars->cfg_scale);
+    printf("sample_method=%d\n",pars->sampleMethod);
+    printf("sample_steps=%d\n",pars->sampleSteps);
+    printf("strength=%f\n",pars->strength);
+    printf("seed=%ld\n\n",pars->seed);
+}
+
+uint8_t *img2img(StableDiffusionModel *model, uint8_t *initialImage, GenerationParams *pars){
+    printImg2imgPars(pars);
+    std::vector<uint8_t> initImgVec(initialImage, initialImage + (pars->width*pars->height*3));
+
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    std::vector<uint8_t> resultVec= theModel->img2img(initImgVec, toSDParams(pars));
+    return toResultData(resultVec);
+}
+
+int newSession(StableDiffusionModel *model, int n_threads, GenerationSession *session){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    session->n_threads=n_threads;
+    session->session=new StableDiffusionSession(*theModel, n_threads);
+    return 0;
+}
+
+int freeSession(GenerationSession *session){
+    StableDiffusionSession * s= static_cast<StableDiffusionSession *>(session->session);
+    delete(s);
+    session->session=NULL;
+    return 0;
+}
+
+uint8_t *sessionTxt2img(GenerationSession *session, GenerationParams *pars){
+    StableDiffusionSession * s= static_cast<StableDiffusionSession *>(session->session);
+    std::vector<uint8_t> resultVec= s->txt2img(toSDParams(pars));
+    return toResultData(resultVec);
+}
+
+uint8_t *sessionImg2img(GenerationSession *session, uint8_t *initialImage, GenerationParams *pars){
+    printImg2imgPars(pars);
+    std::vector<uint8_t> initImgVec(initialImage, initialImage + (pars->width*pars->height*3));
+
+    StableDiffusionSession * s= static_cast<StableDiffusionSession *>(session->session);
+    std::vector<uint8_t> resultVec= s->img2img(initImgVec, toSDParams(pars));
+    return toResultData(resultVec);
+}
+
+
+static char *toCString(const std::string &s){
+    char *result=(char *)calloc(s.size()+1,1);
+    std::memcpy(result,s.c_str(),s.size());
+    return result;
+}
+
+char *modelTensorNames(StableDiffusionModel *model){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    std::string result;
+    for (const std::string &name : theModel->tensor_names()){
+        result+=name+"\n";
+    }
+    return toCString(result);
+}
+
+int addWeightDelta(StableDiffusionModel *model, char *name, float *up, float *down, int out, int rank, int inner, float scale){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->add_weight_delta(std::string(name), up, down, out, rank, inner, scale)){
+        return -1;
+    }
+    return 0;
+}
+
+int restoreWeights(StableDiffusionModel *model){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    theModel->restore_weights();
+    return 0;
+}
+
+int vaeTensorShape(StableDiffusionModel *model, char *name, int64_t *ne){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->vae_tensor_shape(std::string(name), ne)){
+        return -1;
+    }
+    return 0;
+}
+
+int setVaeTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->set_vae_tensor(std::string(name), std::vector<int64_t>(ne, ne+nDims), data)){
+        return -1;
+    }
+    return 0;
+}
+
+int beginTaesd(StableDiffusionModel *model){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->begin_taesd()){
+        return -1;
+    }
+    return 0;
+}
+
+int setTaesdTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->set_taesd_tensor(std::string(name), std::vector<int64_t>(ne, ne+nDims), data)){
+        return -1;
+    }
+    return 0;
+}
+
+int endTaesd(StableDiffusionModel *model){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->end_taesd()){
+        return -1;
+    }
+    return 0;
+}
+
+int extractLoraTags(char *prompt, char **cleanedPrompt, char **tags){
+    std::vector<std::pair<std::string, float>> loras;
+    std::string cleaned=extract_lora_tags(std::string(prompt), loras);
+    std::string tagLines;
+    for (auto &lora : loras){
+        tagLines+=lora.first+":"+std::to_string(lora.second)+"\n";
+    }
+    *cleanedPrompt=toCString(cleaned);
+    *tags=toCString(tagLines);
+    return (int)loras.size();
+}
+
+int tokenizePrompt(StableDiffusionModel *model, char *prompt, int **ids, float **weights, char **pieces){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    std::vector<int> tokens;
+    std::vector<float> tokenWeights;
+    std::vector<std::string> tokenPieces;
+    theModel->tokenize(std::string(prompt), tokens, tokenWeights, tokenPieces);
+
+    *ids=(int *)calloc(tokens.size()+1,sizeof(int));
+    *weights=(float *)calloc(tokens.size()+1,sizeof(float));
+    std::memcpy(*ids,tokens.data(),tokens.size()*sizeof(int));
+    std::memcpy(*weights,tokenWeights.data(),tokens.size()*sizeof(float));
+    std::string pieceLines;
+    for (auto &piece : tokenPieces){
+        pieceLines+=piece+"\n";
+    }
+    *pieces=toCString(pieceLines);
+    return (int)tokens.size();
+}
+
+int addEmbedding(StableDiffusionModel *model, char *name, float *vectors, int nVectors, int dim){
+    StableDiffusion * theModel= static_cast<StableDiffusion *>(model->sd);
+    if (!theModel->add_embedding(std::string(name), vectors, nVectors, dim)){
+        return -1;
+    }
+    return 0;
+}
 
 int freeStableDiffusionModel(StableDiffusionModel *model){
     //TODO IMPLEMENT
@@ -9,6 +9,7 @@ extern "C" {
 
 #include <stdbool.h>
 #include <stdint.h>
+#include <stddef.h>
 
 int printsysteminfo();
 
@@ -18,28 +19,102 @@ typedef struct{
     void *sd; //Actual pointer to class
 }StableDiffusionModel;
 
-int loadStableDiffusion(char *sdfilename,int n_threads,int enumSchedule, StableDiffusionModel *model);
+//lowMemory reads weights of each phase from file when needed and releases them after use
+int loadStableDiffusion(char *sdfilename,int n_threads,int enumSchedule,bool useMmap,bool lowMemory, StableDiffusionModel *model);
 int freeStableDiffusionModel(StableDiffusionModel *model);
 
-uint8_t *txt2img(StableDiffusionModel *model,
-    char *prompt,
-    char *negativePrompt,
-    float cfg_scale,
-    int width,int height, 
-    int sampleMethod,
-    int sampleSteps,
-    int64_t seed);
-
-uint8_t *img2img(StableDiffusionModel *model,
-    uint8_t *initialImage,
-    char *prompt,
-    char *negativePrompt,
-    float cfg_scale,
-    int width,int height, 
-    int sampleMethod,
-    int sampleSteps,
-    float strength,
-    int64_t seed);
+//Loading tensors given by caller, like from safetensors checkpoint. modelType and ftype as in ggml file header
+int beginLoadStableDiffusion(char *sdfilename,int n_threads,int modelType,int ftype, StableDiffusionModel *model);
+int addVocab(StableDiffusionModel *model, char *tokens, int *lengths, int n); //tokens concatenated, id is index
+int loadTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data); //ne in ggml order
+int finishLoadStableDiffusion(StableDiffusionModel *model, float *alphasCumprod, int enumSchedule);
+int modelType(StableDiffusionModel *model); //0=SD1, 1=SD2, 2=SDXL, -1=freed model
+
+//Tensor data conversion with ggml routines. ggmlType is GGML_TYPE_F32, F16 or quantized type
+size_t ggmlRowSize(int ggmlType, int n); //bytes of n values, 0 if n is not multiple of block size
+size_t convertFloats(int ggmlType, float *src, void *dst, int n); //returns bytes written to dst
+int decodeFloats(int ggmlType, void *src, float *dst, int n); //-1 if type can not be decoded
+
+//Parameters for generating picture. Strings are owned by caller
+typedef struct{
+    char *prompt;
+    char *negativePrompt;
+    float cfg_scale;
+    int width;
+    int height;
+    int sampleMethod;
+    int sampleSteps;
+    float strength; //img2img only
+    bool latentFill; //img2img, latent outside content area is replaced with noise
+    int contentX; //content area in pixels
+    int contentY;
+    int contentWidth;
+    int contentHeight;
+    int64_t seed;
+    int64_t variationSeed;
+    float variationStrength; //0=disabled
+    int seedResizeWidth; //txt2img, 0=disabled
+    int seedResizeHeight;
+    bool vaeTiling;
+    bool taesd; //decode (and encode) with TAESD, loaded with loadTaesd
+    int clipSkip; //0=model default
+    int originalWidth; //SDXL size and crop conditioning, size 0=generated size
+    int originalHeight;
+    int cropTop;
+    int cropLeft;
+    int targetWidth;
+    int targetHeight;
+    int hiresWidth; //txt2img hires fix, 0=disabled
+    int hiresHeight;
+    int hiresSteps;
+    float hiresDenoise;
+    bool hiresLatent;
+    float cfgRescale; //0=disabled
+    float dynThresMimicScale; //dynamic thresholding, 0=disabled
+    float dynThresPercentile;
+    int cfgSchedule; //CFG_CONSTANT, CFG_LINEAR, CFG_COSINE
+    float cfgScaleEnd;
+    float *cfgScales; //explicit scale of each step, NULL=use cfgSchedule
+    int nCfgScales;
+    float cfgStopAt; //fraction of steps, guidance disabled after
+    uintptr_t noiseSource; //cgo handle of Go NoiseSource, 0=rng of model
+}GenerationParams;
+
+uint8_t *txt2img(StableDiffusionModel *model, GenerationParams *pars);
+uint8_t *img2img(StableDiffusionModel *model, uint8_t *initialImage, GenerationParams *pars);
+
+//Lora support. Weights are modified in place, restoreWeights puts originals back
+char *modelTensorNames(StableDiffusionModel *model); //newline separated, caller frees
+int addWeightDelta(StableDiffusionModel *model, char *name, float *up, float *down, int out, int rank, int inner, float scale);
+int restoreWeights(StableDiffusionModel *model);
+
+//External vae, replaces first_stage_model weights. Not allowed while generating
+int vaeTensorShape(StableDiffusionModel *model, char *name, int64_t *ne); //ne has 4 dims, -1 if not vae weight
+int setVaeTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data); //ne in ggml order
+
+//TAESD tiny autoencoder. Tensors named like "decoder.1.weight", ne in ggml order. Not allowed while generating
+int beginTaesd(StableDiffusionModel *model);
+int setTaesdTensor(StableDiffusionModel *model, char *name, int nDims, int64_t *ne, float *data);
+int endTaesd(StableDiffusionModel *model);
+//Removes <lora:name:weight> tags from prompt. cleanedPrompt and tags ("name:weight" lines) are allocated, caller frees
+int extractLoraTags(char *prompt, char **cleanedPrompt, char **tags);
+
+//Prompt tokens without BOS and EOS. ids, weights and pieces (newline separated) are allocated, caller frees. Returns count
+int tokenizePrompt(StableDiffusionModel *model, char *prompt, int **ids, float **weights, char **pieces);
+
+//Textual inversion, vectors is nVectors x dim floats. SDXL vectors are CLIP-L and bigG parts concatenated
+int addEmbedding(StableDiffusionModel *model, char *name, float *vectors, int nVectors, int dim);
+
+//Generation context sharing weights of model. Sessions can run in parallel
+typedef struct{
+    int n_threads;
+    void *session; //Actual pointer to class
+}GenerationSession;
+
+int newSession(StableDiffusionModel *model, int n_threads, GenerationSession *session);
+int freeSession(GenerationSession *session);
+uint8_t *sessionTxt2img(GenerationSession *session, GenerationParams *pars);
+uint8_t *sessionImg2img(GenerationSession *session, uint8_t *initialImage, GenerationParams *pars);
 
 
 #ifdef __cplusplus
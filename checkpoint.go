@@ -0,0 +1,388 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+/*
+Loading of original .safetensors checkpoints without convert/convert.py. Tensor names are mapped like preprocess()
+in convert.py does and weights are cast or quantized to requested ftype when copied to model
+*/
+
+//go:embed convert/vocab.json
+var clipVocabJSON []byte
+
+const (
+	modelTypeSD1  = 0
+	modelTypeSD2  = 1
+	modelTypeSDXL = 2
+
+	checkpointTimesteps = 1000
+)
+
+// Prefixes of tensors not used by model
+var checkpointUnusedTensors = []string{
+	"betas",
+	"alphas_cumprod_prev",
+	"sqrt_alphas_cumprod",
+	"sqrt_one_minus_alphas_cumprod",
+	"log_one_minus_alphas_cumprod",
+	"sqrt_recip_alphas_cumprod",
+	"sqrt_recipm1_alphas_cumprod",
+	"posterior_variance",
+	"posterior_log_variance_clipped",
+	"posterior_mean_coef1",
+	"posterior_mean_coef2",
+	"cond_stage_model.transformer.text_model.embeddings.position_ids",
+	"cond_stage_model.model.logit_scale",
+	"cond_stage_model.model.text_projection",
+	"conditioner.embedders.0.transformer.text_model.embeddings.position_ids",
+	"conditioner.embedders.1.model.logit_scale",
+	"denoiser.",
+	"model_ema.decay",
+	"model_ema.num_updates",
+	"control_model",
+	"lora_te_text_model",
+	"embedding_manager",
+}
+
+// SDXL checkpoint prefixes to names of model, first text encoder is hf CLIPTextModel as on SD1
+var sdxlPrefixes = map[string]string{
+	"conditioner.embedders.0.transformer.": "cond_stage_model.transformer.",
+}
+
+// open_clip text encoders to hf CLIPTextModel, SD2 text encoder and SDXL second text encoder (bigG)
+var openClipPrefixes = map[string]string{
+	"cond_stage_model.model.":        "cond_stage_model.transformer.text_model.",
+	"conditioner.embedders.1.model.": "cond_stage_model.1.transformer.text_model.",
+}
+
+var openClipToHfClipModel = map[string]string{
+	"ln_final.bias":          "final_layer_norm.bias",
+	"ln_final.weight":        "final_layer_norm.weight",
+	"positional_embedding":   "embeddings.position_embedding.weight",
+	"token_embedding.weight": "embeddings.token_embedding.weight",
+	"text_projection":        "text_projection", //SDXL only, SD2 does not use it
+}
+
+// vae attention of diffusers style checkpoints
+var vaeAttnRenames = map[string]string{
+	"first_stage_model.decoder.mid.attn_1.to_k.bias":       "first_stage_model.decoder.mid.attn_1.k.bias",
+	"first_stage_model.decoder.mid.attn_1.to_k.weight":     "first_stage_model.decoder.mid.attn_1.k.weight",
+	"first_stage_model.decoder.mid.attn_1.to_out.0.bias":   "first_stage_model.decoder.mid.attn_1.proj_out.bias",
+	"first_stage_model.decoder.mid.attn_1.to_out.0.weight": "first_stage_model.decoder.mid.attn_1.proj_out.weight",
+	"first_stage_model.decoder.mid.attn_1.to_q.bias":       "first_stage_model.decoder.mid.attn_1.q.bias",
+	"first_stage_model.decoder.mid.attn_1.to_q.weight":     "first_stage_model.decoder.mid.attn_1.q.weight",
+	"first_stage_model.decoder.mid.attn_1.to_v.bias":       "first_stage_model.decoder.mid.attn_1.v.bias",
+	"first_stage_model.decoder.mid.attn_1.to_v.weight":     "first_stage_model.decoder.mid.attn_1.v.weight",
+}
+
+var openClipToHfClipResblock = map[string]string{
+	"attn.out_proj.bias":   "self_attn.out_proj.bias",
+	"attn.out_proj.weight": "self_attn.out_proj.weight",
+	"ln_1.bias":            "layer_norm1.bias",
+	"ln_1.weight":          "layer_norm1.weight",
+	"ln_2.bias":            "layer_norm2.bias",
+	"ln_2.weight":          "layer_norm2.weight",
+	"mlp.c_fc.bias":        "mlp.fc1.bias",
+	"mlp.c_fc.weight":      "mlp.fc1.weight",
+	"mlp.c_proj.bias":      "mlp.fc2.bias",
+	"mlp.c_proj.weight":    "mlp.fc2.weight",
+}
+
+const (
+	openClipResblockPrefix = "transformer.resblocks."
+	hfClipResblockPrefix   = "encoder.layers."
+)
+
+// checkpointTensor is tensor after renaming. Shape is in torch order
+type checkpointTensor struct {
+	name  string
+	shape []int
+	data  []float32
+}
+
+func isUnusedCheckpointTensor(name string) bool {
+	for _, prefix := range checkpointUnusedTensors {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpointModelType detects SD2 and SDXL by open_clip text encoders
+func checkpointModelType(st *safetensorsFile) int {
+	if _, haz := st.entries["conditioner.embedders.1.model.token_embedding.weight"]; haz {
+		return modelTypeSDXL
+	}
+	if _, haz := st.entries["cond_stage_model.model.token_embedding.weight"]; haz {
+		return modelTypeSD2
+	}
+	return modelTypeSD1
+}
+
+// checkpointFType picks ftype by type of unet input weight, like convert.py without --out_type
+func checkpointFType(st *safetensorsFile) (EnumFType, error) {
+	entry, haz := st.entries["model.diffusion_model.input_blocks.0.0.weight"]
+	if !haz {
+		return FTYPE_AUTO, fmt.Errorf("no unet weights in checkpoint")
+	}
+	switch entry.DType {
+	case "F16", "BF16":
+		return FTYPE_F16, nil
+	case "F32", "F64":
+		return FTYPE_F32, nil
+	}
+	return FTYPE_AUTO, fmt.Errorf("unsupported weight type %s", entry.DType)
+}
+
+// preprocessCheckpointTensor renames tensor and splits or reshapes it like preprocess() in convert.py
+func preprocessCheckpointTensor(name string, shape []int, data []float32) []checkpointTensor {
+	if newName, haz := vaeAttnRenames[name]; haz {
+		name = newName
+	}
+	for prefix, newPrefix := range sdxlPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			name = newPrefix + strings.TrimPrefix(name, prefix)
+		}
+	}
+	for prefix, hfPrefix := range openClipPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return preprocessOpenClipTensor(hfPrefix, strings.TrimPrefix(name, prefix), shape, data)
+		}
+	}
+
+	//unet transformer and vae attention linear as conv2d 1x1
+	if len(shape) == 2 &&
+		(strings.HasPrefix(name, "model.diffusion_model.") && (strings.HasSuffix(name, "proj_in.weight") || strings.HasSuffix(name, "proj_out.weight")) ||
+			strings.HasPrefix(name, "first_stage_model.") && strings.Contains(name, "attn_1")) {
+		shape = []int{shape[0], shape[1], 1, 1}
+	}
+	return []checkpointTensor{{name: name, shape: shape, data: data}}
+}
+
+// preprocessOpenClipTensor renames open_clip tensor to hf name under hfPrefix and splits attention in_proj to q, k, v
+func preprocessOpenClipTensor(hfPrefix string, name string, shape []int, data []float32) []checkpointTensor {
+	if newName, haz := openClipToHfClipModel[name]; haz {
+		return []checkpointTensor{{name: hfPrefix + newName, shape: shape, data: data}}
+	}
+	if strings.HasPrefix(name, openClipResblockPrefix) {
+		remain := strings.TrimPrefix(name, openClipResblockPrefix)
+		idx, suffix, _ := strings.Cut(remain, ".")
+		prefix := hfPrefix + hfClipResblockPrefix + idx + "."
+		switch suffix {
+		case "attn.in_proj_weight", "attn.in_proj_bias":
+			kind := "weight"
+			if suffix == "attn.in_proj_bias" {
+				kind = "bias"
+			}
+			chunkShape := append([]int{shape[0] / 3}, shape[1:]...)
+			chunkLen := len(data) / 3
+			result := []checkpointTensor{}
+			for i, proj := range []string{"q_proj", "k_proj", "v_proj"} {
+				result = append(result, checkpointTensor{
+					name:  prefix + "self_attn." + proj + "." + kind,
+					shape: chunkShape,
+					data:  data[i*chunkLen : (i+1)*chunkLen],
+				})
+			}
+			return result
+		default:
+			newSuffix, haz := openClipToHfClipResblock[suffix]
+			if !haz {
+				newSuffix = suffix
+			}
+			return []checkpointTensor{{name: prefix + newSuffix, shape: shape, data: data}}
+		}
+	}
+	return []checkpointTensor{{name: hfPrefix + name, shape: shape, data: data}}
+}
+
+// defaultAlphasCumprod is get_alpha_comprod of convert.py, for checkpoints without alphas_cumprod
+func defaultAlphasCumprod() []float32 {
+	const linearStart = 0.00085
+	const linearEnd = 0.0120
+	start := float32(math.Sqrt(linearStart))
+	end := float32(math.Sqrt(linearEnd))
+	result := make([]float32, checkpointTimesteps)
+	cumprod := float32(1)
+	for i := range result {
+		beta := start + (end-start)*float32(i)/float32(checkpointTimesteps-1)
+		cumprod *= 1 - beta*beta
+		result[i] = cumprod
+	}
+	return result
+}
+
+// bytesToUnicode is byte to printable rune table of CLIP bpe, vocab.json keys use it
+func bytesToUnicode() map[rune]byte {
+	result := make(map[rune]byte)
+	printable := func(b int) bool {
+		return ('!' <= b && b <= '~') || (0xA1 <= b && b <= 0xAC) || (0xAE <= b && b <= 0xFF)
+	}
+	n := 0
+	for b := 0; b < 256; b++ {
+		if printable(b) {
+			result[rune(b)] = byte(b)
+		} else {
+			result[rune(256+n)] = byte(b)
+			n++
+		}
+	}
+	return result
+}
+
+// clipVocab returns tokens of embedded vocab as raw bytes, indexed by token id
+func clipVocab() ([]string, error) {
+	var vocab map[string]int
+	if err := json.Unmarshal(clipVocabJSON, &vocab); err != nil {
+		return nil, fmt.Errorf("invalid embedded vocab err=%v", err)
+	}
+	decoder := bytesToUnicode()
+	result := make([]string, len(vocab))
+	for key, id := range vocab {
+		if id < 0 || len(result) <= id {
+			return nil, fmt.Errorf("invalid token id %v in embedded vocab", id)
+		}
+		token := []byte{}
+		for _, r := range key {
+			b, haz := decoder[r]
+			if !haz {
+				return nil, fmt.Errorf("invalid character in vocab token %s", key)
+			}
+			token = append(token, b)
+		}
+		result[id] = string(token)
+	}
+	return result, nil
+}
+
+func isFloatDType(dtype string) bool {
+	switch dtype {
+	case "F64", "F32", "F16", "BF16":
+		return true
+	}
+	return false
+}
+
+// checkpointOutFType resolves FTYPE_AUTO and checks that ftype is supported
+func checkpointOutFType(st *safetensorsFile, ftype EnumFType) (EnumFType, error) {
+	if ftype == FTYPE_AUTO {
+		return checkpointFType(st)
+	}
+	switch ftype {
+	case FTYPE_F32, FTYPE_F16, FTYPE_Q4_0, FTYPE_Q4_1, FTYPE_Q5_0, FTYPE_Q5_1, FTYPE_Q8_0:
+		return ftype, nil
+	}
+	return ftype, fmt.Errorf("unsupported ftype %v", ftype)
+}
+
+/*
+readCheckpoint calls fn with each used tensor of checkpoint after preprocessing and returns alphas_cumprod.
+Default schedule is generated if checkpoint does not have one
+*/
+func readCheckpoint(st *safetensorsFile, fn func(t checkpointTensor) error) ([]float32, error) {
+	var alphasCumprod []float32
+	for _, name := range st.Names() {
+		if isUnusedCheckpointTensor(name) || !isFloatDType(st.entries[name].DType) {
+			continue
+		}
+		data, shape, errRead := st.ReadFloat32(name)
+		if errRead != nil {
+			return nil, errRead
+		}
+		if name == "alphas_cumprod" {
+			alphasCumprod = data
+			continue
+		}
+		for _, t := range preprocessCheckpointTensor(name, shape, data) {
+			if err := fn(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(alphasCumprod) == 0 {
+		alphasCumprod = defaultAlphasCumprod()
+	}
+	if len(alphasCumprod) != checkpointTimesteps {
+		return nil, fmt.Errorf("invalid alphas_cumprod length %v", len(alphasCumprod))
+	}
+	return alphasCumprod, nil
+}
+
+// loadCheckpoint creates model from .safetensors checkpoint into sdModel
+func loadCheckpoint(sdModel *C.StableDiffusionModel, fname string, nThreads int, schedule EnumSchedule, ftype EnumFType) error {
+	st, errOpen := openSafetensors(fname)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer st.Close()
+
+	modelType := checkpointModelType(st)
+	ftype, errFType := checkpointOutFType(st, ftype)
+	if errFType != nil {
+		return fmt.Errorf("checkpoint %s: %s", fname, errFType.Error())
+	}
+
+	vocab, errVocab := clipVocab()
+	if errVocab != nil {
+		return errVocab
+	}
+
+	var model C.StableDiffusionModel //cgo does not allow pointer into struct holding Go pointers
+	defer func() { *sdModel = model }()
+
+	if C.beginLoadStableDiffusion(C.CString(fname), C.int(nThreads), C.int(modelType), C.int(ftype), &model) != 0 {
+		return fmt.Errorf("init of model type %v ftype %v failed", modelType, ftype)
+	}
+
+	lengths := make([]C.int, len(vocab))
+	for i, token := range vocab {
+		lengths[i] = C.int(len(token))
+	}
+	cTokens := C.CString(strings.Join(vocab, ""))
+	defer C.free(unsafe.Pointer(cTokens))
+	C.addVocab(&model, cTokens, &lengths[0], C.int(len(vocab)))
+
+	alphasCumprod, errRead := readCheckpoint(st, func(t checkpointTensor) error {
+		return loadCheckpointTensor(&model, t)
+	})
+	if errRead != nil {
+		return fmt.Errorf("checkpoint %s: %s", fname, errRead.Error())
+	}
+	if C.finishLoadStableDiffusion(&model, (*C.float)(unsafe.Pointer(&alphasCumprod[0])), C.int(schedule)) != 0 {
+		return fmt.Errorf("checkpoint %s does not match model", fname)
+	}
+	return nil
+}
+
+func loadCheckpointTensor(sdModel *C.StableDiffusionModel, t checkpointTensor) error {
+	if len(t.data) == 0 {
+		return nil
+	}
+	ne := make([]C.int64_t, len(t.shape))
+	for i, n := range t.shape { //ggml order is reversed
+		ne[len(t.shape)-1-i] = C.int64_t(n)
+	}
+	if len(ne) == 0 { //scalar
+		ne = []C.int64_t{1}
+	}
+	cName := C.CString(t.name)
+	defer C.free(unsafe.Pointer(cName))
+	if C.loadTensor(sdModel, cName, C.int(len(ne)), &ne[0], (*C.float)(unsafe.Pointer(&t.data[0]))) != 0 {
+		return fmt.Errorf("loading tensor %s %v failed", t.name, t.shape)
+	}
+	return nil
+}
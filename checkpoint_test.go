@@ -0,0 +1,122 @@
+package bindstablediff
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Expected names and shapes are what preprocess() of convert/convert.py gives for same keys
+func TestReadCheckpoint(t *testing.T) {
+	fname := writeTestSafetensors(t, "model.safetensors", map[string]testTensor{
+		"model.diffusion_model.input_blocks.1.1.proj_in.weight":                  {"F16", []int{4, 2}, u16Bytes(0x3c00, 0x4000, 0x4200, 0x4400, 0x4500, 0x4600, 0x4700, 0x4800)},
+		"model.diffusion_model.input_blocks.1.1.proj_in.bias":                    {"BF16", []int{4}, u16Bytes(0x3f80, 0x4000, 0x4040, 0x4080)},
+		"first_stage_model.decoder.mid.attn_1.to_q.weight":                       {"F32", []int{2, 2}, f32Bytes(1, 2, 3, 4)},
+		"cond_stage_model.model.transformer.resblocks.0.attn.in_proj_weight":     {"F32", []int{6, 2}, f32Bytes(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12)},
+		"cond_stage_model.model.transformer.resblocks.0.attn.in_proj_bias":       {"F32", []int{6}, f32Bytes(1, 2, 3, 4, 5, 6)},
+		"cond_stage_model.model.transformer.resblocks.0.mlp.c_fc.weight":         {"F32", []int{4, 2}, f32Bytes(0, 0, 0, 0, 0, 0, 0, 0)},
+		"cond_stage_model.model.positional_embedding":                            {"F32", []int{3, 2}, f32Bytes(0, 0, 0, 0, 0, 0)},
+		"conditioner.embedders.0.transformer.text_model.final_layer_norm.weight": {"F32", []int{2}, f32Bytes(1, 1)},
+		"conditioner.embedders.1.model.ln_final.bias":                            {"F32", []int{2}, f32Bytes(0, 0)},
+		"betas":                              {"F32", []int{2}, f32Bytes(0, 0)},
+		"cond_stage_model.model.logit_scale": {"F32", []int{}, f32Bytes(1)},
+		"model_ema.decay":                    {"F32", []int{}, f32Bytes(1)},
+		"model.diffusion_model.step":         {"I64", []int{}, make([]byte, 8)},
+	})
+	st, err := openSafetensors(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	got := map[string]checkpointTensor{}
+	alphasCumprod, err := readCheckpoint(st, func(tensor checkpointTensor) error {
+		got[tensor.name] = tensor
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]int{
+		"model.diffusion_model.input_blocks.1.1.proj_in.weight":                            {4, 2, 1, 1},
+		"model.diffusion_model.input_blocks.1.1.proj_in.bias":                              {4},
+		"first_stage_model.decoder.mid.attn_1.q.weight":                                    {2, 2, 1, 1},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.q_proj.weight": {2, 2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.k_proj.weight": {2, 2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.v_proj.weight": {2, 2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.q_proj.bias":   {2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.k_proj.bias":   {2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.v_proj.bias":   {2},
+		"cond_stage_model.transformer.text_model.encoder.layers.0.mlp.fc1.weight":          {4, 2},
+		"cond_stage_model.transformer.text_model.embeddings.position_embedding.weight":     {3, 2},
+		"cond_stage_model.transformer.text_model.final_layer_norm.weight":                  {2},
+		"cond_stage_model.1.transformer.text_model.final_layer_norm.bias":                  {2},
+	}
+	if len(got) != len(want) {
+		names := []string{}
+		for name := range got {
+			names = append(names, name)
+		}
+		t.Errorf("got %v tensors %v, want %v", len(got), names, len(want))
+	}
+	for name, shape := range want {
+		tensor, haz := got[name]
+		if !haz {
+			t.Errorf("tensor %s missing", name)
+			continue
+		}
+		if !reflect.DeepEqual(tensor.shape, shape) {
+			t.Errorf("tensor %s shape %v, want %v", name, tensor.shape, shape)
+		}
+	}
+
+	prefix := "cond_stage_model.transformer.text_model.encoder.layers.0.self_attn."
+	data := map[string][]float32{
+		"model.diffusion_model.input_blocks.1.1.proj_in.weight": {1, 2, 3, 4, 5, 6, 7, 8},
+		"model.diffusion_model.input_blocks.1.1.proj_in.bias":   {1, 2, 3, 4},
+		prefix + "q_proj.weight":                                {1, 2, 3, 4},
+		prefix + "k_proj.weight":                                {5, 6, 7, 8},
+		prefix + "v_proj.weight":                                {9, 10, 11, 12},
+		prefix + "v_proj.bias":                                  {5, 6},
+	}
+	for name, values := range data {
+		if !reflect.DeepEqual(got[name].data, values) {
+			t.Errorf("tensor %s data %v, want %v", name, got[name].data, values)
+		}
+	}
+
+	//No alphas_cumprod in file, default schedule of convert.py is used
+	if len(alphasCumprod) != checkpointTimesteps || alphasCumprod[0] != float32(1-0.00085) {
+		t.Errorf("alphas_cumprod has %v values, first %v", len(alphasCumprod), alphasCumprod[0])
+	}
+}
+
+func TestCheckpointModelType(t *testing.T) {
+	cases := []struct {
+		name  string
+		want  int
+		ftype EnumFType
+		dtype string
+	}{
+		{"cond_stage_model.transformer.text_model.embeddings.token_embedding.weight", modelTypeSD1, FTYPE_F16, "F16"},
+		{"cond_stage_model.model.token_embedding.weight", modelTypeSD2, FTYPE_F16, "BF16"},
+		{"conditioner.embedders.1.model.token_embedding.weight", modelTypeSDXL, FTYPE_F32, "F32"},
+	}
+	for _, c := range cases {
+		fname := writeTestSafetensors(t, "model.safetensors", map[string]testTensor{
+			c.name: {"F32", []int{1}, f32Bytes(0)},
+			"model.diffusion_model.input_blocks.0.0.weight": {c.dtype, []int{1}, make([]byte, 4)},
+		})
+		st, err := openSafetensors(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkpointModelType(st); got != c.want {
+			t.Errorf("%s: model type %v, want %v", c.name, got, c.want)
+		}
+		if ftype, err := checkpointFType(st); ftype != c.ftype || err != nil {
+			t.Errorf("%s weights: ftype %v err=%v, want %v", c.dtype, ftype, err, c.ftype)
+		}
+		st.Close()
+	}
+}
@@ -0,0 +1,7 @@
+module sdconvert
+
+go 1.21.2
+
+replace github.com/hjkoskel/bindstablediff => ../../
+
+require github.com/hjkoskel/bindstablediff v0.0.0-00010101000000-000000000000
@@ -0,0 +1,96 @@
+/*
+Converts stable diffusion .safetensors checkpoint to ggml model file. Go port of convert/convert.py, no Python needed
+
+Subcommand quantize converts existing ggml model file to other weight type
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hjkoskel/bindstablediff"
+)
+
+func quantize(args []string) {
+	flags := flag.NewFlagSet("quantize", flag.ExitOnError)
+	pOutType := flags.String("type", "Q8_0", "output weight type F32,F16,Q4_0,Q4_1,Q5_0,Q5_1,Q8_0")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s quantize [flags] in.bin out.bin\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	outType, errType := bindstablediff.ParseFType(*pOutType)
+	if errType != nil {
+		fmt.Printf("%s\n", errType.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Printf("quantizing %s to %s as %s\n", flags.Arg(0), flags.Arg(1), *pOutType)
+	info, errQuantize := bindstablediff.Quantize(flags.Arg(0), flags.Arg(1), outType)
+	if errQuantize != nil {
+		fmt.Printf("%s\n", errQuantize.Error())
+		os.Exit(-1)
+	}
+	fmt.Printf("%s\n", info)
+}
+
+func main() {
+	if 1 < len(os.Args) && os.Args[1] == "quantize" {
+		quantize(os.Args[2:])
+		return
+	}
+
+	pOutType := flag.String("type", "AUTO", "output weight type AUTO,F32,F16,Q4_0,Q4_1,Q5_0,Q5_1,Q8_0. AUTO=based on input")
+	pOutFile := flag.String("o", "", "output file, default is based on input name and current working directory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] model.safetensors\n       %s quantize [flags] in.bin out.bin\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	modelPath := flag.Arg(0)
+
+	outType, errType := bindstablediff.ParseFType(*pOutType)
+	if errType != nil {
+		fmt.Printf("%s\n", errType.Error())
+		os.Exit(-1)
+	}
+
+	outFile := *pOutFile
+	if len(outFile) == 0 {
+		base := strings.TrimSuffix(filepath.Base(modelPath), filepath.Ext(modelPath))
+		outFile = base + "-ggml-model-" + strings.ToLower(*pOutType) + ".bin"
+		if outType == bindstablediff.FTYPE_AUTO {
+			outFile = base + "-ggml-model.bin"
+		}
+	}
+
+	fmt.Printf("converting %s to %s\n", modelPath, outFile)
+	tStart := time.Now()
+	errConvert := bindstablediff.ConvertCheckpoint(modelPath, outFile, outType)
+	if errConvert != nil {
+		fmt.Printf("%s\n", errConvert.Error())
+		os.Exit(-1)
+	}
+
+	stat, errStat := os.Stat(outFile)
+	if errStat != nil {
+		fmt.Printf("%s\n", errStat.Error())
+		os.Exit(-1)
+	}
+	fmt.Printf("saved %s, %.1fMB in %s\n", outFile, float64(stat.Size())/1024/1024, time.Since(tStart).Round(time.Second))
+}
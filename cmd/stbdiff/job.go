@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sort"
 
 	"github.com/hjkoskel/bindstablediff"
 )
@@ -25,6 +26,50 @@ type JobEntry struct {
 	Strength float64 `json:"strength,omitempty"`
 	Seed     int64   `json:"seed,omitempty"`
 
+	VariationSeed     int64   `json:"variationSeed,omitempty"`     //-1=random on each repeat
+	VariationStrength float64 `json:"variationStrength,omitempty"` //0=disabled, small values give slightly different picture
+	SeedResizeWidth   int     `json:"seedResizeWidth,omitempty"`   //Size that seed was found with, keeps composition on other size
+	SeedResizeHeight  int     `json:"seedResizeHeight,omitempty"`
+
+	Noise string `json:"noise,omitempty"` //MODEL or PORTABLE, portable noise gives same picture on every machine
+
+	ResizeMode  string `json:"resizeMode,omitempty"`  //How inputImage is fitted to width x height
+	RestoreSize bool   `json:"restoreSize,omitempty"` //Scale img2img result back to inputImage size
+
+	VAETiling bool `json:"vaeTiling,omitempty"` //Encode and decode in tiles, needed for large pictures
+	TAESD     bool `json:"taesd,omitempty"`     //Decode with TAESD tiny autoencoder, fast drafts. Needs -taesd files
+
+	ClipSkip int `json:"clipSkip,omitempty"` //2 = penultimate CLIP layer, 0 = model default
+
+	//SDXL size and crop conditioning, 0 = picture size
+	OriginalWidth  int `json:"originalWidth,omitempty"`
+	OriginalHeight int `json:"originalHeight,omitempty"`
+	CropTop        int `json:"cropTop,omitempty"`
+	CropLeft       int `json:"cropLeft,omitempty"`
+	TargetWidth    int `json:"targetWidth,omitempty"`
+	TargetHeight   int `json:"targetHeight,omitempty"`
+
+	HiresScale   float64 `json:"hiresScale,omitempty"`   //Hires fix for txt2img, 0 or 1 = disabled
+	HiresSteps   int     `json:"hiresSteps,omitempty"`   //0 = same as sampleSteps
+	HiresDenoise float64 `json:"hiresDenoise,omitempty"` //Strength of hires pass
+	HiresMode    string  `json:"hiresMode,omitempty"`    //HIRES_LATENT or HIRES_PIXEL
+
+	CfgRescale         float64 `json:"cfgRescale,omitempty"`         //0=disabled, 0.7 typical
+	DynThresMimicScale float64 `json:"dynThresMimicScale,omitempty"` //Dynamic thresholding, 0=disabled
+	DynThresPercentile float64 `json:"dynThresPercentile,omitempty"` //0=1.0
+
+	CfgSchedule string    `json:"cfgSchedule,omitempty"` //CFG_CONSTANT, CFG_LINEAR or CFG_COSINE from cfgScale to cfgScaleEnd
+	CfgScaleEnd float64   `json:"cfgScaleEnd,omitempty"` //Scale of last step
+	CfgScales   []float64 `json:"cfgScales,omitempty"`   //Explicit scale of each step, overrides cfgSchedule
+	CfgStopAt   float64   `json:"cfgStopAt,omitempty"`   //Fraction of steps after which guidance is disabled, 0=never
+
+	Upscale         float64 `json:"upscale,omitempty"`         //Tiled upscale factor for result, 0 or 1 = no upscale
+	UpscaleStrength float64 `json:"upscaleStrength,omitempty"` //img2img strength on upscale tiles
+
+	Prompts []bindstablediff.WeightedPrompt `json:"prompts,omitempty"` //Sub-prompts combined with AND
+
+	LoRAs map[string]float64 `json:"loras,omitempty"` //LoRA name and weight, loaded with -lora. Prompt can have <lora:name:weight> too
+
 	Repeats int `json:"repeats,omitempty"` //How many repeats
 }
 
@@ -42,11 +87,62 @@ func (p *JobEntry) ToTextGenPars() (bindstablediff.TextGenPars, error) {
 		seed = rand.Int63()
 	}
 
+	variationSeed := p.VariationSeed
+	if variationSeed < 0 {
+		variationSeed = rand.Int63()
+	}
+
 	sampleMethod, sampleMethodErr := bindstablediff.ParseSampleMethod(p.SampleMethod)
 	if sampleMethodErr != nil {
 		return bindstablediff.TextGenPars{}, fmt.Errorf("invalid sample method %s", sampleMethodErr.Error())
 	}
 
+	resizeMode := bindstablediff.JUST_RESIZE
+	if len(p.ResizeMode) != 0 {
+		var resizeModeErr error
+		resizeMode, resizeModeErr = bindstablediff.ParseResizeMode(p.ResizeMode)
+		if resizeModeErr != nil {
+			return bindstablediff.TextGenPars{}, fmt.Errorf("invalid resize mode %s", resizeModeErr.Error())
+		}
+	}
+
+	hiresMode := bindstablediff.HIRES_LATENT
+	if len(p.HiresMode) != 0 {
+		var hiresModeErr error
+		hiresMode, hiresModeErr = bindstablediff.ParseHiresMode(p.HiresMode)
+		if hiresModeErr != nil {
+			return bindstablediff.TextGenPars{}, fmt.Errorf("invalid hires mode %s", hiresModeErr.Error())
+		}
+	}
+
+	var noise bindstablediff.NoiseSource
+	if len(p.Noise) != 0 {
+		var noiseErr error
+		noise, noiseErr = bindstablediff.ParseNoiseSource(p.Noise)
+		if noiseErr != nil {
+			return bindstablediff.TextGenPars{}, fmt.Errorf("invalid noise %s", noiseErr.Error())
+		}
+	}
+
+	cfgSchedule := bindstablediff.CFG_CONSTANT
+	if len(p.CfgSchedule) != 0 {
+		var cfgScheduleErr error
+		cfgSchedule, cfgScheduleErr = bindstablediff.ParseCfgSchedule(p.CfgSchedule)
+		if cfgScheduleErr != nil {
+			return bindstablediff.TextGenPars{}, fmt.Errorf("invalid cfg schedule %s", cfgScheduleErr.Error())
+		}
+	}
+	var cfgScales []float32
+	for _, scale := range p.CfgScales {
+		cfgScales = append(cfgScales, float32(scale))
+	}
+
+	loras := []bindstablediff.LoRAWeight{}
+	for name, weight := range p.LoRAs {
+		loras = append(loras, bindstablediff.LoRAWeight{Name: name, Weight: float32(weight)})
+	}
+	sort.Slice(loras, func(i, j int) bool { return loras[i].Name < loras[j].Name })
+
 	return bindstablediff.TextGenPars{
 		Prompt:         p.Prompt,
 		NegativePrompt: p.NegPrompt,
@@ -56,7 +152,40 @@ func (p *JobEntry) ToTextGenPars() (bindstablediff.TextGenPars, error) {
 		SampleMethod:   sampleMethod,
 		SampleSteps:    p.SampleSteps,       //TODO sample size? vs number of steps?
 		Strength:       float32(p.Strength), //needed for img2img
-		Seed:           seed}, nil
+		Seed:           seed,
+		ResizeMode:     resizeMode,
+		RestoreSize:    p.RestoreSize,
+		VAETiling:      p.VAETiling,
+		TAESD:          p.TAESD,
+		ClipSkip:       p.ClipSkip,
+		OriginalWidth:  p.OriginalWidth,
+		OriginalHeight: p.OriginalHeight,
+		CropTop:        p.CropTop,
+		CropLeft:       p.CropLeft,
+		TargetWidth:    p.TargetWidth,
+		TargetHeight:   p.TargetHeight,
+		HiresScale:     float32(p.HiresScale),
+		HiresSteps:     p.HiresSteps,
+		HiresDenoise:   float32(p.HiresDenoise),
+		HiresMode:      hiresMode,
+		LoRAs:          loras,
+		Prompts:        p.Prompts,
+
+		VariationSeed:     variationSeed,
+		VariationStrength: float32(p.VariationStrength),
+		SeedResizeWidth:   p.SeedResizeWidth,
+		SeedResizeHeight:  p.SeedResizeHeight,
+
+		Noise: noise,
+
+		CfgRescale:         float32(p.CfgRescale),
+		DynThresMimicScale: float32(p.DynThresMimicScale),
+		DynThresPercentile: float32(p.DynThresPercentile),
+
+		CfgSchedule: cfgSchedule,
+		CfgScaleEnd: float32(p.CfgScaleEnd),
+		CfgScales:   cfgScales,
+		CfgStopAt:   float32(p.CfgStopAt)}, nil
 }
 
 func (p *JobEntry) SanityCheck() error {
@@ -67,8 +196,44 @@ func (p *JobEntry) SanityCheck() error {
 	if sampleMethodErr != nil {
 		return fmt.Errorf("invalid sample method %s", sampleMethodErr.Error())
 	}
+	if len(p.ResizeMode) != 0 {
+		_, resizeModeErr := bindstablediff.ParseResizeMode(p.ResizeMode)
+		if resizeModeErr != nil {
+			return fmt.Errorf("invalid resize mode %s", resizeModeErr.Error())
+		}
+	}
+	if len(p.HiresMode) != 0 {
+		_, hiresModeErr := bindstablediff.ParseHiresMode(p.HiresMode)
+		if hiresModeErr != nil {
+			return fmt.Errorf("invalid hires mode %s", hiresModeErr.Error())
+		}
+	}
+	if len(p.CfgSchedule) != 0 {
+		_, cfgScheduleErr := bindstablediff.ParseCfgSchedule(p.CfgSchedule)
+		if cfgScheduleErr != nil {
+			return fmt.Errorf("invalid cfg schedule %s", cfgScheduleErr.Error())
+		}
+	}
+	if len(p.Noise) != 0 {
+		_, noiseErr := bindstablediff.ParseNoiseSource(p.Noise)
+		if noiseErr != nil {
+			return fmt.Errorf("invalid noise %s", noiseErr.Error())
+		}
+	}
+	if p.VariationStrength < 0 || 1 < p.VariationStrength {
+		return fmt.Errorf("variationStrength %v not in range 0..1", p.VariationStrength)
+	}
+	if p.ClipSkip < 0 {
+		return fmt.Errorf("invalid clipSkip %v", p.ClipSkip)
+	}
+	if p.OriginalWidth < 0 || p.OriginalHeight < 0 || p.CropTop < 0 || p.CropLeft < 0 || p.TargetWidth < 0 || p.TargetHeight < 0 {
+		return fmt.Errorf("negative SDXL size conditioning")
+	}
+	if p.DynThresPercentile < 0 || 1 < p.DynThresPercentile {
+		return fmt.Errorf("dynThresPercentile %v not in range 0..1", p.DynThresPercentile)
+	}
 	//TODO range checks etc... TODO POWER OF TWO PICTURE DIMENSIONS!
-	if len(p.Prompt) == 0 && len(p.NegPrompt) == 0 && len(p.InputImage) == 0 {
+	if len(p.Prompt) == 0 && len(p.Prompts) == 0 && len(p.NegPrompt) == 0 && len(p.InputImage) == 0 {
 		return fmt.Errorf("prompt or some input data required")
 	}
 	return nil
@@ -145,6 +310,118 @@ func ParseJobs(raw []byte, defaultValues JobEntry, overridedValues map[string]bo
 		if is {
 			result[i].Seed = defaultValues.Seed
 		}
+		is = overridedValues["ResizeMode"]
+		if is || len(result[i].ResizeMode) == 0 {
+			result[i].ResizeMode = defaultValues.ResizeMode
+		}
+		is = overridedValues["RestoreSize"]
+		if is {
+			result[i].RestoreSize = defaultValues.RestoreSize
+		}
+		is = overridedValues["VAETiling"]
+		if is {
+			result[i].VAETiling = defaultValues.VAETiling
+		}
+		is = overridedValues["TAESD"]
+		if is {
+			result[i].TAESD = defaultValues.TAESD
+		}
+		is = overridedValues["VariationSeed"]
+		if is {
+			result[i].VariationSeed = defaultValues.VariationSeed
+		}
+		is = overridedValues["VariationStrength"]
+		if is {
+			result[i].VariationStrength = defaultValues.VariationStrength
+		}
+		is = overridedValues["SeedResizeWidth"]
+		if is {
+			result[i].SeedResizeWidth = defaultValues.SeedResizeWidth
+		}
+		is = overridedValues["SeedResizeHeight"]
+		if is {
+			result[i].SeedResizeHeight = defaultValues.SeedResizeHeight
+		}
+		is = overridedValues["Noise"]
+		if is || len(result[i].Noise) == 0 {
+			result[i].Noise = defaultValues.Noise
+		}
+		is = overridedValues["ClipSkip"]
+		if is {
+			result[i].ClipSkip = defaultValues.ClipSkip
+		}
+		is = overridedValues["OriginalWidth"]
+		if is {
+			result[i].OriginalWidth = defaultValues.OriginalWidth
+		}
+		is = overridedValues["OriginalHeight"]
+		if is {
+			result[i].OriginalHeight = defaultValues.OriginalHeight
+		}
+		is = overridedValues["CropTop"]
+		if is {
+			result[i].CropTop = defaultValues.CropTop
+		}
+		is = overridedValues["CropLeft"]
+		if is {
+			result[i].CropLeft = defaultValues.CropLeft
+		}
+		is = overridedValues["TargetWidth"]
+		if is {
+			result[i].TargetWidth = defaultValues.TargetWidth
+		}
+		is = overridedValues["TargetHeight"]
+		if is {
+			result[i].TargetHeight = defaultValues.TargetHeight
+		}
+		is = overridedValues["HiresScale"]
+		if is {
+			result[i].HiresScale = defaultValues.HiresScale
+		}
+		is = overridedValues["HiresSteps"]
+		if is {
+			result[i].HiresSteps = defaultValues.HiresSteps
+		}
+		is = overridedValues["HiresDenoise"]
+		if is || result[i].HiresDenoise == 0 {
+			result[i].HiresDenoise = defaultValues.HiresDenoise
+		}
+		is = overridedValues["HiresMode"]
+		if is || len(result[i].HiresMode) == 0 {
+			result[i].HiresMode = defaultValues.HiresMode
+		}
+		is = overridedValues["CfgRescale"]
+		if is {
+			result[i].CfgRescale = defaultValues.CfgRescale
+		}
+		is = overridedValues["DynThresMimicScale"]
+		if is {
+			result[i].DynThresMimicScale = defaultValues.DynThresMimicScale
+		}
+		is = overridedValues["DynThresPercentile"]
+		if is || result[i].DynThresPercentile == 0 {
+			result[i].DynThresPercentile = defaultValues.DynThresPercentile
+		}
+		is = overridedValues["CfgSchedule"]
+		if is || len(result[i].CfgSchedule) == 0 {
+			result[i].CfgSchedule = defaultValues.CfgSchedule
+		}
+		is = overridedValues["CfgScaleEnd"]
+		if is {
+			result[i].CfgScaleEnd = defaultValues.CfgScaleEnd
+		}
+		is = overridedValues["CfgStopAt"]
+		if is {
+			result[i].CfgStopAt = defaultValues.CfgStopAt
+		}
+		is = overridedValues["Upscale"]
+		if is {
+			result[i].Upscale = defaultValues.Upscale
+		}
+		is = overridedValues["UpscaleStrength"]
+		if is || result[i].UpscaleStrength == 0 {
+			result[i].UpscaleStrength = defaultValues.UpscaleStrength
+		}
 	}
 
 	return result, nil
@@ -76,7 +76,12 @@ func CreateOutputFileName(dirname string, seedNumber int64, prefix string) (stri
 }
 
 func main() {
-	pModelFile := flag.String("m", "", "model file in ggml format")
+	pModelFile := flag.String("m", "", "model file in ggml format or .safetensors checkpoint")
+	pMmap := flag.Bool("mmap", false, "use ggml model weights in place from page cache, faster start and shared memory between processes")
+	pLowMem := flag.Bool("lowmem", false, "read weights of each phase from ggml model file when needed, peak memory is largest component")
+	pVAE := flag.String("vae", "", "replace vae of model with vae from ggml or .safetensors file")
+	pTAESDFiles := flag.String("taesd", "", "comma separated TAESD tiny autoencoder .safetensors files, decoder and optional encoder")
+	pFType := flag.String("ftype", "AUTO", "AUTO,F32,F16,Q4_0,Q4_1,Q5_0,Q5_1,Q8_0 weight type when loading .safetensors checkpoint")
 	pNumberOfThreads := flag.Int("th", -1, "number of threads  -1=automatic")
 	pRepeat := flag.Int("r", 1, "how many repeats of command or ")
 	pScheduleString := flag.String("schedule", "DEFAULT", "DEFAULT, DISCRETE, KARRAS,N_SCHEDULES")
@@ -92,12 +97,42 @@ func main() {
 
 	//parameters directly for render, overrides what job say
 	pCfgScale := flag.Float64("cfgscale", 7.0, "CfgScale")
-	pWidth := flag.Int("w", 512, "prefered value depends on model, use power of two")
-	pHeight := flag.Int("h", 512, "prefered value depends on model, use power of two")
+	pWidth := flag.Int("w", 0, "picture width, 0=native size of model (512 SD1/SD2, 1024 SDXL)")
+	pHeight := flag.Int("h", 0, "picture height, 0=native size of model")
 	pSampleMethodString := flag.String("sm", "EULER", "EULER_A,EULER,HEUN,DPM2,DPMPP2S_A,DPMPP2M,DPMPP2Mv2,N_SAMPLE_METHODS")
 	pSampleSteps := flag.Int("n", 10, "number of steps") //TODO sample size? vs number of steps?
 	pStrength := flag.Float64("st", 0.75, "strength for noising/unnoising img2img. 1=full image desctruction")
 	pSeed := flag.Int64("seed", -1, "rng seed") // non -1,
+	pVariationSeed := flag.Int64("vseed", -1, "variation seed, -1=random")
+	pVariationStrength := flag.Float64("vst", 0, "variation strength 0..1, 0=no variation")
+	pSeedResizeWidth := flag.Int("seedw", 0, "width that seed was found with, keeps composition on other size. 0=disabled")
+	pSeedResizeHeight := flag.Int("seedh", 0, "height that seed was found with")
+	pNoise := flag.String("noise", "MODEL", "MODEL,PORTABLE noise. PORTABLE gives same picture from seed on every machine")
+	pResizeMode := flag.String("resize", "JUST_RESIZE", "img2img input image fit: JUST_RESIZE,CROP_AND_RESIZE,RESIZE_AND_FILL,LATENT_FILL")
+	pRestoreSize := flag.Bool("restore", false, "scale img2img result back to input image size")
+	pVAETiling := flag.Bool("vaetile", false, "encode and decode image in tiles, reduces memory usage on large pictures")
+	pDraft := flag.Bool("draft", false, "decode with TAESD tiny autoencoder given by -taesd, fast but lower quality")
+	pClipSkip := flag.Int("clipskip", 0, "1=last CLIP layer, 2=penultimate, 0=model default")
+	pOriginalWidth := flag.Int("origw", 0, "SDXL size conditioning, original width of training picture. 0=picture width")
+	pOriginalHeight := flag.Int("origh", 0, "SDXL size conditioning, original height of training picture. 0=picture height")
+	pCropTop := flag.Int("croptop", 0, "SDXL crop conditioning, top coordinate. 0=centered")
+	pCropLeft := flag.Int("cropleft", 0, "SDXL crop conditioning, left coordinate")
+	pTargetWidth := flag.Int("targetw", 0, "SDXL target width conditioning. 0=picture width")
+	pTargetHeight := flag.Int("targeth", 0, "SDXL target height conditioning. 0=picture height")
+	pHiresScale := flag.Float64("hires", 0, "hires fix scale for txt2img, 0=disabled")
+	pHiresSteps := flag.Int("hiresn", 0, "hires fix steps, 0=same as -n")
+	pHiresDenoise := flag.Float64("hiresst", 0.5, "hires fix denoising strength")
+	pHiresMode := flag.String("hiresmode", "HIRES_LATENT", "HIRES_LATENT,HIRES_PIXEL")
+	pCfgRescale := flag.Float64("cfgrescale", 0, "CFG rescale phi against burned colours, 0=disabled, 0.7 typical")
+	pDynThresMimic := flag.Float64("dtmimic", 0, "dynamic thresholding mimic cfg scale, 0=disabled")
+	pDynThresPercentile := flag.Float64("dtpct", 1, "dynamic thresholding percentile 0..1")
+	pCfgSchedule := flag.String("cfgsched", "CFG_CONSTANT", "CFG_CONSTANT,CFG_LINEAR,CFG_COSINE cfg scale from -cfgscale to -cfgend")
+	pCfgScaleEnd := flag.Float64("cfgend", 1, "cfg scale on last step of CFG_LINEAR and CFG_COSINE")
+	pCfgStopAt := flag.Float64("cfgstop", 0, "fraction of steps after which guidance is disabled, 0=never")
+	pUpscale := flag.Float64("up", 0, "tiled upscale factor for result, 0=no upscale")
+	pUpscaleStrength := flag.Float64("upst", 0.3, "img2img strength on upscale tiles")
+	pEmbeddingFiles := flag.String("emb", "", "comma separated list of textual inversion .safetensors or .pt files. Use by file name in prompt")
+	pLoRAFiles := flag.String("lora", "", "comma separated list of LoRA .safetensors files. Use by name in prompt <lora:name:weight> or in job loras")
 	flag.Parse()
 
 	flagAvailMap := make(map[string]bool)
@@ -128,8 +163,64 @@ func main() {
 			flagAvailMap["Strength"] = true
 		case "seed":
 			flagAvailMap["Seed"] = true
+		case "vseed":
+			flagAvailMap["VariationSeed"] = true
+		case "vst":
+			flagAvailMap["VariationStrength"] = true
+		case "seedw":
+			flagAvailMap["SeedResizeWidth"] = true
+		case "seedh":
+			flagAvailMap["SeedResizeHeight"] = true
+		case "noise":
+			flagAvailMap["Noise"] = true
 		case "o":
 			flagAvailMap["OutputPrefix"] = true
+		case "resize":
+			flagAvailMap["ResizeMode"] = true
+		case "restore":
+			flagAvailMap["RestoreSize"] = true
+		case "vaetile":
+			flagAvailMap["VAETiling"] = true
+		case "draft":
+			flagAvailMap["TAESD"] = true
+		case "clipskip":
+			flagAvailMap["ClipSkip"] = true
+		case "origw":
+			flagAvailMap["OriginalWidth"] = true
+		case "origh":
+			flagAvailMap["OriginalHeight"] = true
+		case "croptop":
+			flagAvailMap["CropTop"] = true
+		case "cropleft":
+			flagAvailMap["CropLeft"] = true
+		case "targetw":
+			flagAvailMap["TargetWidth"] = true
+		case "targeth":
+			flagAvailMap["TargetHeight"] = true
+		case "hires":
+			flagAvailMap["HiresScale"] = true
+		case "hiresn":
+			flagAvailMap["HiresSteps"] = true
+		case "hiresst":
+			flagAvailMap["HiresDenoise"] = true
+		case "hiresmode":
+			flagAvailMap["HiresMode"] = true
+		case "cfgrescale":
+			flagAvailMap["CfgRescale"] = true
+		case "dtmimic":
+			flagAvailMap["DynThresMimicScale"] = true
+		case "dtpct":
+			flagAvailMap["DynThresPercentile"] = true
+		case "cfgsched":
+			flagAvailMap["CfgSchedule"] = true
+		case "cfgend":
+			flagAvailMap["CfgScaleEnd"] = true
+		case "cfgstop":
+			flagAvailMap["CfgStopAt"] = true
+		case "up":
+			flagAvailMap["Upscale"] = true
+		case "upst":
+			flagAvailMap["UpscaleStrength"] = true
 		}
 	})
 
@@ -162,6 +253,43 @@ func main() {
 
 		Strength: *pStrength,
 		Seed:     *pSeed,
+
+		VariationSeed:     *pVariationSeed,
+		VariationStrength: *pVariationStrength,
+		SeedResizeWidth:   *pSeedResizeWidth,
+		SeedResizeHeight:  *pSeedResizeHeight,
+
+		Noise: *pNoise,
+
+		ResizeMode:  *pResizeMode,
+		RestoreSize: *pRestoreSize,
+
+		VAETiling: *pVAETiling,
+		TAESD:     *pDraft,
+		ClipSkip:  *pClipSkip,
+
+		OriginalWidth:  *pOriginalWidth,
+		OriginalHeight: *pOriginalHeight,
+		CropTop:        *pCropTop,
+		CropLeft:       *pCropLeft,
+		TargetWidth:    *pTargetWidth,
+		TargetHeight:   *pTargetHeight,
+
+		HiresScale:   *pHiresScale,
+		HiresSteps:   *pHiresSteps,
+		HiresDenoise: *pHiresDenoise,
+		HiresMode:    *pHiresMode,
+
+		CfgRescale:         *pCfgRescale,
+		DynThresMimicScale: *pDynThresMimic,
+		DynThresPercentile: *pDynThresPercentile,
+
+		CfgSchedule: *pCfgSchedule,
+		CfgScaleEnd: *pCfgScaleEnd,
+		CfgStopAt:   *pCfgStopAt,
+
+		Upscale:         *pUpscale,
+		UpscaleStrength: *pUpscaleStrength,
 	}, flagAvailMap)
 
 	if parseErr != nil {
@@ -187,21 +315,76 @@ func main() {
 		os.Exit(-1)
 	}
 
-	engine, errInit := bindstablediff.InitStableDiffusion(*pModelFile, *pNumberOfThreads, chosenSchedule)
+	chosenFType, ftypeErr := bindstablediff.ParseFType(*pFType)
+	if ftypeErr != nil {
+		fmt.Printf("invalid ftype %s\n", ftypeErr.Error())
+		os.Exit(-1)
+	}
+
+	engine, errInit := bindstablediff.InitStableDiffusion(*pModelFile, *pNumberOfThreads, chosenSchedule, bindstablediff.WithFType(chosenFType), bindstablediff.WithMmap(*pMmap), bindstablediff.WithLowMemory(*pLowMem), bindstablediff.WithVAE(*pVAE))
 	if errInit != nil {
 		fmt.Printf("error initializing stable diffusion %s\n", errInit.Error())
 		os.Exit(-1)
 	}
 
+	nativeSize := engine.ModelType().NativeSize()
+	for i := range jobArray { //Size not given by flag or job, use what model is trained on
+		if jobArray[i].Width == 0 {
+			jobArray[i].Width = nativeSize
+		}
+		if jobArray[i].Height == 0 {
+			jobArray[i].Height = nativeSize
+		}
+	}
+
+	if 0 < len(*pEmbeddingFiles) {
+		for _, embeddingFile := range strings.Split(*pEmbeddingFiles, ",") {
+			errEmbedding := engine.LoadEmbedding(strings.TrimSpace(embeddingFile), "")
+			if errEmbedding != nil {
+				fmt.Printf("error loading embedding %s\n", errEmbedding.Error())
+				os.Exit(-1)
+			}
+		}
+	}
+
+	if 0 < len(*pLoRAFiles) {
+		for _, loraFile := range strings.Split(*pLoRAFiles, ",") {
+			lora, errLoRA := engine.LoadLoRA(strings.TrimSpace(loraFile))
+			if errLoRA != nil {
+				fmt.Printf("error loading LoRA %s\n", errLoRA.Error())
+				os.Exit(-1)
+			}
+			fmt.Printf("loaded LoRA %s\n", lora.Name)
+		}
+	}
+
+	if 0 < len(*pTAESDFiles) {
+		taesdFiles := strings.Split(*pTAESDFiles, ",")
+		for i := range taesdFiles {
+			taesdFiles[i] = strings.TrimSpace(taesdFiles[i])
+		}
+		errTAESD := engine.LoadTAESD(taesdFiles...)
+		if errTAESD != nil {
+			fmt.Printf("error loading TAESD %s\n", errTAESD.Error())
+			os.Exit(-1)
+		}
+	}
+
 	for repeatCount := 0; repeatCount < *pRepeat || *pRepeat < 0; repeatCount++ {
 		for jobIndex, job := range jobArray {
 			//fmt.Printf("job have %v repeats\n", job.Repeats)
 			for jobRepeatCounter := 0; jobRepeatCounter < job.Repeats; jobRepeatCounter++ {
 				parameters, errParameters := job.ToTextGenPars()
 				if errParameters != nil {
-					fmt.Printf("job%,  %#v have invalid parameters %s\n", jobIndex, job, errParameters.Error())
+					fmt.Printf("job%v,  %#v have invalid parameters %s\n", jobIndex, job, errParameters.Error())
 					os.Exit(-1)
 				}
+				for _, prompt := range []string{parameters.Prompt, parameters.NegativePrompt} {
+					nTokens, errCount := engine.CountTokens(prompt)
+					if errCount == nil && bindstablediff.PromptTokenLimit < nTokens {
+						fmt.Printf("job%v prompt %#v has %v tokens, encoded in chunks of %v\n", jobIndex, prompt, nTokens, bindstablediff.PromptTokenLimit)
+					}
+				}
 				var genError error
 				var generatedPic image.Image
 
@@ -210,7 +393,7 @@ func main() {
 					generatedPic, genError = engine.Txt2Img(parameters)
 				} else {
 					if parameters.Strength <= 0 {
-						fmt.Printf("ERR: strength is %s\n", &parameters.Strength)
+						fmt.Printf("ERR: strength is %v\n", parameters.Strength)
 					}
 
 					startImage, errLoadImage := LoadPng(job.InputImage)
@@ -226,6 +409,18 @@ func main() {
 					os.Exit(-1)
 				}
 
+				if 1 < job.Upscale {
+					upscalePars := parameters
+					upscalePars.Strength = float32(job.UpscaleStrength)
+					generatedPic, genError = engine.UpscaleWithProgress(generatedPic, job.Upscale, upscalePars, func(done int, total int) {
+						fmt.Printf("job%v upscale tile %v/%v done\n", jobIndex, done, total)
+					})
+					if genError != nil {
+						fmt.Printf("Job%v %#v failed upscale error=%s\n", jobIndex, job, genError.Error())
+						os.Exit(-1)
+					}
+				}
+
 				tGenEnd := time.Now()
 				fmt.Printf("\n-------job%v generated, saving... ----\n", jobIndex)
 				outputFileName, nameErr := CreateOutputFileName(*pOutputDir, parameters.Seed, job.OutputPrefix)
@@ -245,6 +440,7 @@ func main() {
 					Job:         job,
 				}
 				completedInfo.Job.Seed = parameters.Seed
+				completedInfo.Job.VariationSeed = parameters.VariationSeed
 				infoBytes, _ := json.MarshalIndent(completedInfo, "", " ")
 				infoWriteErr := os.WriteFile(strings.Replace(outputFileName, ".png", ".json", 1), infoBytes, 0666)
 				if infoWriteErr != nil {
@@ -0,0 +1,82 @@
+package bindstablediff
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+convertTensorType picks ggml type like convert.py: 4-D conv weights f16, 2-D weights by ftype, rest f32. ne is in ggml
+order. 2-D weights with rows that do not fill quantization blocks are f16
+*/
+func convertTensorType(name string, ne []int, weightType int) int {
+	switch {
+	case len(ne) == 4:
+		return ggmlTypeF16
+	case len(ne) == 2 && strings.HasSuffix(name, ".weight"):
+		if _, errRow := ggmlRowSize(weightType, ne[0]); errRow != nil {
+			return ggmlTypeF16
+		}
+		return weightType
+	}
+	return ggmlTypeF32
+}
+
+/*
+ConvertCheckpoint writes .safetensors checkpoint as ggml model file, same as convert/convert.py does. SD1.x, SD2.x
+and SDXL are detected from tensors. FTYPE_AUTO keeps type of checkpoint weights. Quantization is done with ggml routines
+*/
+func ConvertCheckpoint(inPath string, outPath string, ftype EnumFType) error {
+	st, errOpen := openSafetensors(inPath)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer st.Close()
+
+	modelType := checkpointModelType(st)
+	ftype, errFType := checkpointOutFType(st, ftype)
+	if errFType != nil {
+		return fmt.Errorf("checkpoint %s: %s", inPath, errFType.Error())
+	}
+	weightType, errType := ftype.ggmlType()
+	if errType != nil {
+		return errType
+	}
+
+	vocab, errVocab := clipVocab()
+	if errVocab != nil {
+		return errVocab
+	}
+
+	out, errCreate := createGGMLFile(outPath, modelType, ftype, vocab)
+	if errCreate != nil {
+		return errCreate
+	}
+
+	writeTensor := func(name string, shape []int, data []float32) error {
+		ne := make([]int, len(shape))
+		for i, n := range shape {
+			ne[len(shape)-1-i] = n
+		}
+		ggmlType := convertTensorType(name, ne, weightType)
+		encoded, errEncode := encodeGGML(ggmlType, data)
+		if errEncode != nil {
+			return fmt.Errorf("tensor %s %v: %s", name, shape, errEncode.Error())
+		}
+		return out.WriteTensor(name, ne, ggmlType, encoded)
+	}
+
+	alphasCumprod, errRead := readCheckpoint(st, func(t checkpointTensor) error {
+		return writeTensor(t.name, t.shape, t.data)
+	})
+	if errRead == nil {
+		errRead = writeTensor("alphas_cumprod", []int{len(alphasCumprod)}, alphasCumprod)
+	}
+	if errRead != nil {
+		out.Close()
+		os.Remove(outPath)
+		return fmt.Errorf("converting %s failed err=%v", inPath, errRead)
+	}
+	return out.Close()
+}
@@ -11,6 +11,7 @@ vocab_dir = this_file_dir
 
 SD1 = 0
 SD2 = 1
+SDXL = 2
 
 ggml_ftype_str_to_int = {
     "f32": 0,
@@ -160,6 +161,9 @@ unused_tensors = [
     "cond_stage_model.transformer.text_model.embeddings.position_ids",
     "cond_stage_model.model.logit_scale",
     "cond_stage_model.model.text_projection",
+    "conditioner.embedders.0.transformer.text_model.embeddings.position_ids",
+    "conditioner.embedders.1.model.logit_scale",
+    "denoiser.",
     "model_ema.decay",
     "model_ema.num_updates",
     "control_model",
@@ -195,12 +199,38 @@ def preprocess(state_dict):
         if w.dtype == torch.bfloat16:
             w = w.to(torch.float16)
 
-        # convert open_clip to hf CLIPTextModel (for SD2.x)
+        # SDXL first text encoder is hf CLIPTextModel as on SD1.x
+        sdxl_prefix = "conditioner.embedders.0.transformer."
+        if name.startswith(sdxl_prefix):
+            name = "cond_stage_model.transformer." + name[len(sdxl_prefix):]
+
+        # convert open_clip to hf CLIPTextModel (for SD2.x and SDXL second text encoder)
+        open_clip_prefixes = {
+            "cond_stage_model.model.": "cond_stage_model.transformer.text_model.",
+            "conditioner.embedders.1.model.": "cond_stage_model.1.transformer.text_model.",
+        }
         open_clip_to_hf_clip_model = {
-            "cond_stage_model.model.ln_final.bias": "cond_stage_model.transformer.text_model.final_layer_norm.bias",
-            "cond_stage_model.model.ln_final.weight": "cond_stage_model.transformer.text_model.final_layer_norm.weight",
-            "cond_stage_model.model.positional_embedding": "cond_stage_model.transformer.text_model.embeddings.position_embedding.weight",
-            "cond_stage_model.model.token_embedding.weight": "cond_stage_model.transformer.text_model.embeddings.token_embedding.weight",
+            "ln_final.bias": "final_layer_norm.bias",
+            "ln_final.weight": "final_layer_norm.weight",
+            "positional_embedding": "embeddings.position_embedding.weight",
+            "token_embedding.weight": "embeddings.token_embedding.weight",
+            "text_projection": "text_projection",
+        }
+        for open_clip_prefix, hf_clip_prefix in open_clip_prefixes.items():
+            if name.startswith(open_clip_prefix):
+                remain = name[len(open_clip_prefix):]
+                if remain in open_clip_to_hf_clip_model:
+                    new_name = hf_clip_prefix + open_clip_to_hf_clip_model[remain]
+                    print(f"preprocess {name} => {new_name}")
+                    name = new_name
+                open_clip_resblock_prefix = open_clip_prefix + "transformer.resblocks."
+                hf_clip_resblock_prefix = hf_clip_prefix + "encoder.layers."
+                break
+        else:
+            open_clip_resblock_prefix = None
+            hf_clip_resblock_prefix = None
+
+        vae_attn_renames = {
             "first_stage_model.decoder.mid.attn_1.to_k.bias": "first_stage_model.decoder.mid.attn_1.k.bias",
             "first_stage_model.decoder.mid.attn_1.to_k.weight": "first_stage_model.decoder.mid.attn_1.k.weight",
             "first_stage_model.decoder.mid.attn_1.to_out.0.bias": "first_stage_model.decoder.mid.attn_1.proj_out.bias",
@@ -222,13 +252,11 @@ def preprocess(state_dict):
             "mlp.c_proj.bias": "mlp.fc2.bias",
             "mlp.c_proj.weight": "mlp.fc2.weight",
         }
-        open_clip_resblock_prefix = "cond_stage_model.model.transformer.resblocks."
-        hf_clip_resblock_prefix = "cond_stage_model.transformer.text_model.encoder.layers."
-        if name in open_clip_to_hf_clip_model:
-            new_name = open_clip_to_hf_clip_model[name]
+        if name in vae_attn_renames:
+            new_name = vae_attn_renames[name]
             print(f"preprocess {name} => {new_name}")
             name = new_name
-        if name.startswith(open_clip_resblock_prefix):
+        if open_clip_resblock_prefix != None and name.startswith(open_clip_resblock_prefix):
             remain = name[len(open_clip_resblock_prefix):]
             idx = remain.split(".")[0]
             suffix = remain[len(idx)+1:]
@@ -277,7 +305,10 @@ def convert(model_path, out_type = None, out_file=None):
     
     state_dict = load_model_from_file(model_path)
     model_type = SD1
-    if "cond_stage_model.model.token_embedding.weight" in state_dict.keys():
+    if "conditioner.embedders.1.model.token_embedding.weight" in state_dict.keys():
+        model_type = SDXL
+        print("Stable diffuison XL")
+    elif "cond_stage_model.model.token_embedding.weight" in state_dict.keys():
         model_type = SD2
         print("Stable diffuison 2.x")
     else:
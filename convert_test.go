@@ -0,0 +1,27 @@
+package bindstablediff
+
+import "testing"
+
+func TestConvertTensorType(t *testing.T) {
+	cases := []struct {
+		name       string
+		ne         []int
+		weightType int
+		want       int
+	}{
+		{"model.diffusion_model.input_blocks.0.0.weight", []int{3, 3, 4, 320}, ggmlTypeQ8_0, ggmlTypeF16},
+		{"model.diffusion_model.input_blocks.0.0.weight", []int{3, 3, 4, 320}, ggmlTypeF32, ggmlTypeF16},
+		{"model.diffusion_model.time_embed.0.weight", []int{320, 1280}, ggmlTypeQ4_0, ggmlTypeQ4_0},
+		{"model.diffusion_model.time_embed.0.weight", []int{320, 1280}, ggmlTypeF32, ggmlTypeF32},
+		{"odd.weight", []int{100, 64}, ggmlTypeQ5_1, ggmlTypeF16}, //100 does not fill blocks of 32
+		{"odd.weight", []int{100, 64}, ggmlTypeF16, ggmlTypeF16},
+		{"model.diffusion_model.time_embed.0.bias", []int{1280}, ggmlTypeQ8_0, ggmlTypeF32},
+		{"model.diffusion_model.out.0.weight", []int{320}, ggmlTypeQ8_0, ggmlTypeF32}, //norm
+	}
+	for _, c := range cases {
+		got := convertTensorType(c.name, c.ne, c.weightType)
+		if got != c.want {
+			t.Errorf("%s %v as %s is %s, want %s", c.name, c.ne, ggmlTypeNames[c.weightType], ggmlTypeNames[got], ggmlTypeNames[c.want])
+		}
+	}
+}
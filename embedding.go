@@ -0,0 +1,188 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// embeddingTensors are tensors of embedding file by name, read when needed
+type embeddingTensors map[string]func() ([]float32, []int, error)
+
+/*
+LoadEmbedding registers textual inversion embedding from .safetensors or torch .pt/.bin file. Prompts that mention
+name (like "easynegative" in negative prompt) get learned vectors in place of tokens. Empty name uses file name
+without extension. A1111 (string_to_param or emb_params) and diffusers (one tensor) formats are supported.
+SDXL embeddings have clip_l and clip_g tensors, SD1 models use only clip_l
+*/
+func (p *StableDiffusionModel) LoadEmbedding(fname string, name string) error {
+	modelType := p.ModelType()
+	if modelType == MODEL_UNKNOWN {
+		return errClosed
+	}
+	if len(name) == 0 {
+		name = strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+	}
+	var tensors embeddingTensors
+	switch strings.ToLower(filepath.Ext(fname)) {
+	case ".safetensors":
+		st, errOpen := openSafetensors(fname)
+		if errOpen != nil {
+			return errOpen
+		}
+		defer st.Close()
+		tensors = safetensorsEmbedding(st)
+	case ".pt", ".bin":
+		tf, errOpen := openTorchFile(fname)
+		if errOpen != nil {
+			return errOpen
+		}
+		defer tf.Close()
+		tensors = torchEmbedding(tf)
+	default:
+		return fmt.Errorf("embedding %s is not .safetensors, .pt or .bin file", fname)
+	}
+
+	if modelType == MODEL_SDXL {
+		return p.loadSDXLEmbedding(tensors, fname, name)
+	}
+
+	tensorName := ""
+	for _, candidate := range []string{"emb_params", "clip_l"} {
+		if _, haz := tensors[candidate]; haz {
+			tensorName = candidate
+			break
+		}
+	}
+	if len(tensorName) == 0 {
+		if len(tensors) != 1 {
+			return fmt.Errorf("embedding %s have %v tensors, can not choose", fname, len(tensors))
+		}
+		for candidate := range tensors {
+			tensorName = candidate
+		}
+	}
+
+	vectors, errRead := readEmbeddingVectors(tensors, fname, tensorName)
+	if errRead != nil {
+		return errRead
+	}
+	return p.AddEmbedding(name, vectors)
+}
+
+func safetensorsEmbedding(st *safetensorsFile) embeddingTensors {
+	result := embeddingTensors{}
+	for _, tensorName := range st.Names() {
+		tensorName := tensorName
+		result[tensorName] = func() ([]float32, []int, error) { return st.ReadFloat32(tensorName) }
+	}
+	return result
+}
+
+// torchEmbedding picks tensors of pickled dict. Only tensor of A1111 string_to_param is named emb_params
+func torchEmbedding(tf *torchFile) embeddingTensors {
+	result := embeddingTensors{}
+	root, _ := tf.root.(map[any]any)
+	add := func(tensorName string, v any) {
+		if t, isTensor := v.(torchTensor); isTensor {
+			result[tensorName] = func() ([]float32, []int, error) {
+				data, err := tf.ReadFloat32(t)
+				return data, t.shape, err
+			}
+		}
+	}
+	if params, haz := root["string_to_param"].(map[any]any); haz && len(params) == 1 {
+		for _, v := range params {
+			add("emb_params", v)
+		}
+		return result
+	}
+	for k, v := range root {
+		if tensorName, ok := k.(string); ok {
+			add(tensorName, v)
+		}
+	}
+	return result
+}
+
+// loadSDXLEmbedding concatenates vectors of clip_l and clip_g, as SDXL text model expects them
+func (p *StableDiffusionModel) loadSDXLEmbedding(tensors embeddingTensors, fname string, name string) error {
+	for _, tensorName := range []string{"clip_l", "clip_g"} {
+		if _, haz := tensors[tensorName]; !haz {
+			return fmt.Errorf("embedding %s has no %s tensor, it is not for SDXL", fname, tensorName)
+		}
+	}
+	vectorsL, errL := readEmbeddingVectors(tensors, fname, "clip_l")
+	if errL != nil {
+		return errL
+	}
+	vectorsG, errG := readEmbeddingVectors(tensors, fname, "clip_g")
+	if errG != nil {
+		return errG
+	}
+	if len(vectorsL) != len(vectorsG) {
+		return fmt.Errorf("embedding %s has %v clip_l and %v clip_g vectors", fname, len(vectorsL), len(vectorsG))
+	}
+	vectors := make([][]float32, len(vectorsL))
+	for i := range vectors {
+		vectors[i] = append(append([]float32{}, vectorsL[i]...), vectorsG[i]...)
+	}
+	return p.AddEmbedding(name, vectors)
+}
+
+// readEmbeddingVectors splits embedding tensor to vectors of its last dimension
+func readEmbeddingVectors(tensors embeddingTensors, fname string, tensorName string) ([][]float32, error) {
+	data, shape, errRead := tensors[tensorName]()
+	if errRead != nil {
+		return nil, fmt.Errorf("reading embedding %s failed err=%s", fname, errRead.Error())
+	}
+	if len(shape) == 0 || len(data) == 0 {
+		return nil, fmt.Errorf("embedding %s is empty", fname)
+	}
+	dim := shape[len(shape)-1]
+	vectors := make([][]float32, len(data)/dim)
+	for i := range vectors {
+		vectors[i] = data[i*dim : (i+1)*dim]
+	}
+	return vectors, nil
+}
+
+// AddEmbedding registers vectors as textual inversion embedding. Each vector must have length of text model hidden size,
+// on SDXL 768 + 1280 values of both text models
+func (p *StableDiffusionModel) AddEmbedding(name string, vectors [][]float32) error {
+	if len(name) == 0 || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid embedding name %#v", name)
+	}
+	if len(vectors) == 0 || len(vectors[0]) == 0 {
+		return fmt.Errorf("embedding %s has no vectors", name)
+	}
+	dim := len(vectors[0])
+	flat := make([]float32, 0, len(vectors)*dim)
+	for _, v := range vectors {
+		if len(v) != dim {
+			return fmt.Errorf("embedding %s vectors have different lengths", name)
+		}
+		flat = append(flat, v...)
+	}
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed() {
+		return errClosed
+	}
+	//Sessions use same text model
+	p.weights.Lock()
+	ret := C.addEmbedding(&p.sdModel, cName, (*C.float)(unsafe.Pointer(&flat[0])), C.int(len(vectors)), C.int(dim))
+	p.weights.Unlock()
+	if ret != 0 {
+		return fmt.Errorf("embedding %s with %v x %v vectors does not fit model", name, len(vectors), dim)
+	}
+	return nil
+}
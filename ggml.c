@@ -223,20 +223,42 @@ inline static void * ggml_aligned_malloc(size_t size) {
 #endif
 
 
-size_t dynamic_mem_size = 0;
-size_t max_dynamic_mem_size = 0;
+// bindstablediff: counters were plain size_t. They are shared by all contexts, atomic so that sessions can compute
+// graphs in parallel
+#if defined(_MSC_VER)
+typedef volatile LONG64 dynamic_size_t;
+#define dynamic_size_load(ptr)         ((size_t)InterlockedCompareExchange64((ptr), 0, 0))
+#define dynamic_size_store(ptr, v)     InterlockedExchange64((ptr), (LONG64)(v))
+#define dynamic_size_add(ptr, v)       ((size_t)InterlockedExchangeAdd64((ptr), (LONG64)(v)) + (v))
+#define dynamic_size_cas(ptr, old, v)  (InterlockedCompareExchange64((ptr), (LONG64)(v), (LONG64)(old)) == (LONG64)(old))
+#else
+typedef size_t dynamic_size_t;
+#define dynamic_size_load(ptr)         __atomic_load_n((ptr), __ATOMIC_RELAXED)
+#define dynamic_size_store(ptr, v)     __atomic_store_n((ptr), (v), __ATOMIC_RELAXED)
+#define dynamic_size_add(ptr, v)       __atomic_add_fetch((ptr), (v), __ATOMIC_RELAXED)
+#define dynamic_size_cas(ptr, old, v)  __atomic_compare_exchange_n((ptr), &(old), (v), false, __ATOMIC_RELAXED, __ATOMIC_RELAXED)
+#endif
+
+dynamic_size_t dynamic_mem_size = 0;
+dynamic_size_t max_dynamic_mem_size = 0;
 
-size_t curr_max_dynamic_mem_size = 0;
+dynamic_size_t curr_max_dynamic_mem_size = 0;
+
+inline static void dynamic_size_update_max(dynamic_size_t * max, size_t value) {
+    size_t curr = dynamic_size_load(max);
+    while (value > curr) {
+        if (dynamic_size_cas(max, curr, value)) {
+            break;
+        }
+        curr = dynamic_size_load(max);
+    }
+}
 
 inline static void* ggml_dynamic_malloc(size_t size) {
     void *ptr = GGML_ALIGNED_MALLOC(GGML_MEM_ALIGN + size);
-    dynamic_mem_size += size;
-    if (dynamic_mem_size > max_dynamic_mem_size) {
-        max_dynamic_mem_size = dynamic_mem_size;
-    }
-    if (dynamic_mem_size > curr_max_dynamic_mem_size) {
-        curr_max_dynamic_mem_size = dynamic_mem_size;
-    }
+    size_t curr = dynamic_size_add(&dynamic_mem_size, size);
+    dynamic_size_update_max(&max_dynamic_mem_size, curr);
+    dynamic_size_update_max(&curr_max_dynamic_mem_size, curr);
     *((size_t*)ptr) = size;
     return (char*)ptr + GGML_MEM_ALIGN;
 }
@@ -244,24 +266,24 @@ inline static void* ggml_dynamic_malloc(size_t size) {
 inline static void ggml_dynamic_free(void * ptr) {
     void* realptr = (char*)ptr-GGML_MEM_ALIGN;
     size_t size = *((size_t*)realptr);
-    dynamic_mem_size -= size;
+    dynamic_size_add(&dynamic_mem_size, -size);
     GGML_ALIGNED_FREE(realptr);
 }
 
 size_t  ggml_dynamic_size(void) {
-    return dynamic_mem_size;
+    return dynamic_size_load(&dynamic_mem_size);
 }
 
 size_t  ggml_max_dynamic_size(void) {
-    return max_dynamic_mem_size;
+    return dynamic_size_load(&max_dynamic_mem_size);
 }
 
 size_t  ggml_curr_max_dynamic_size(void) {
-    return curr_max_dynamic_mem_size;
+    return dynamic_size_load(&curr_max_dynamic_mem_size);
 }
 
 void  ggml_reset_curr_max_dynamic_size(void) {
-    curr_max_dynamic_mem_size = dynamic_mem_size;
+    dynamic_size_store(&curr_max_dynamic_mem_size, dynamic_size_load(&dynamic_mem_size));
 }
 
 #define GGML_DYNAMIC_MALLOC(size)  ggml_dynamic_malloc(size)
@@ -17230,6 +17252,13 @@ static bool hash_insert(void * hash_table[], void * p) {
     return false;
 }
 
+// bindstablediff: upstream counts n_dst of every tensor. Consumers are counted only for tensors that can be freed
+// during compute. Static tensors (weights) are shared by sessions and writing their n_dst and n_dst_curr from
+// parallel graph builds would race, and they are never freed anyway. Keep every n_dst access behind this check
+inline static bool ggml_dst_counted(const struct ggml_tensor * tensor) {
+    return tensor->dynamic || tensor->not_own_data;
+}
+
 static void ggml_visit_parents(struct ggml_cgraph * cgraph, struct ggml_tensor * node) {
     if (node->grad == NULL) {
         // this usually happens when we generate intermediate nodes from constants in the backward pass
@@ -17244,12 +17273,16 @@ static void ggml_visit_parents(struct ggml_cgraph * cgraph, struct ggml_tensor *
         return;
     }
 
-    node->n_dst = 0;
+    if (ggml_dst_counted(node)) {
+        node->n_dst = 0;
+    }
 
     for (int i = 0; i < GGML_MAX_SRC; ++i) {
         if (node->src[i]) {
             ggml_visit_parents(cgraph, node->src[i]);
-            node->src[i]->n_dst++;
+            if (ggml_dst_counted(node->src[i])) {
+                node->src[i]->n_dst++;
+            }
         }
     }
 
@@ -17569,7 +17602,7 @@ static void on_node_all_dst_compute_done(struct ggml_tensor* node) {
     if (node->not_own_data) {
         for (int i = 0; i < GGML_MAX_SRC; i++) {
             struct ggml_tensor* curr = node->src[i];
-            if (curr) {
+            if (curr && ggml_dst_counted(curr)) {
                 GGML_ASSERT(curr->n_dst_curr > 0);
                 curr->n_dst_curr--;
                 if (curr->n_dst_curr == 0) {
@@ -17594,7 +17627,7 @@ static void on_node_compute_done(struct ggml_tensor* node) {
     }
     for (int i = 0; i < GGML_MAX_SRC; i++) {
         struct ggml_tensor* curr = node->src[i];
-        if (curr) {
+        if (curr && ggml_dst_counted(curr)) {
             GGML_ASSERT(curr->n_dst_curr > 0);
             curr->n_dst_curr--;
             if (curr->n_dst_curr == 0) {
@@ -18158,7 +18191,9 @@ int ggml_graph_compute(struct ggml_cgraph * cgraph, struct ggml_cplan * cplan) {
         }
 
         for (int i = 0; i < cgraph->n_leafs; ++i) {
-            cgraph->leafs[i]->n_dst_curr = cgraph->leafs[i]->n_dst;
+            if (ggml_dst_counted(cgraph->leafs[i])) {
+                cgraph->leafs[i]->n_dst_curr = cgraph->leafs[i]->n_dst;
+            }
         }
     }
 
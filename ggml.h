@@ -206,7 +206,9 @@
 #define GGML_QNT_VERSION_FACTOR 1000 // do not change this
 
 #define GGML_MAX_DIMS          4
-#define GGML_MAX_NODES         4096
+// bindstablediff: raised from 4096, SDXL UNet graph has over 4096 nodes and this ggml has no graphs of custom size.
+// struct ggml_cgraph grows to about 650KB, build graphs in context (ggml_build_forward_ctx), never on stack
+#define GGML_MAX_NODES         16384
 #define GGML_MAX_PARAMS        256
 #define GGML_MAX_CONTEXTS      64
 #define GGML_MAX_SRC           6
@@ -508,8 +510,8 @@ extern "C" {
 
     // next prime after GGML_MAX_NODES
     // #define GGML_GRAPH_HASHTABLE_SIZE 4099
-    // next prime after GGML_MAX_NODES * 2 (nodes + leafs)
-    #define GGML_GRAPH_HASHTABLE_SIZE 8273
+    // next prime after GGML_MAX_NODES * 2 (nodes + leafs), 8273 before bindstablediff raised GGML_MAX_NODES
+    #define GGML_GRAPH_HASHTABLE_SIZE 32771
 
     // computation graph
     struct ggml_cgraph {
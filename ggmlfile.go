@@ -0,0 +1,272 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+*/
+import "C"
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+/*
+Reader and writer of ggml model files as stable-diffusion.cpp loads them. File has magic, model type and ftype, vocab and
+tensors with header (dims, name length, ggml type, ne, name) followed by raw data
+*/
+
+const ggmlFileMagic = 0x67676D6C
+
+// ggml tensor types, values differ from ftype values
+const (
+	ggmlTypeF32  = 0
+	ggmlTypeF16  = 1
+	ggmlTypeQ4_0 = 2
+	ggmlTypeQ4_1 = 3
+	ggmlTypeQ5_0 = 6
+	ggmlTypeQ5_1 = 7
+	ggmlTypeQ8_0 = 8
+)
+
+var ggmlTypeNames = map[int]string{
+	ggmlTypeF32:  "f32",
+	ggmlTypeF16:  "f16",
+	ggmlTypeQ4_0: "q4_0",
+	ggmlTypeQ4_1: "q4_1",
+	ggmlTypeQ5_0: "q5_0",
+	ggmlTypeQ5_1: "q5_1",
+	ggmlTypeQ8_0: "q8_0",
+}
+
+// ggmlType is tensor type of weights on ftype
+func (p EnumFType) ggmlType() (int, error) {
+	m := map[EnumFType]int{
+		FTYPE_F32:  ggmlTypeF32,
+		FTYPE_F16:  ggmlTypeF16,
+		FTYPE_Q4_0: ggmlTypeQ4_0,
+		FTYPE_Q4_1: ggmlTypeQ4_1,
+		FTYPE_Q5_0: ggmlTypeQ5_0,
+		FTYPE_Q5_1: ggmlTypeQ5_1,
+		FTYPE_Q8_0: ggmlTypeQ8_0,
+	}
+	result, haz := m[p]
+	if !haz {
+		return ggmlTypeF32, fmt.Errorf("unsupported ftype %v", p)
+	}
+	return result, nil
+}
+
+// ggmlRowSize is size in bytes of n values of ggml type, error if n is not multiple of block size
+func ggmlRowSize(ggmlType int, n int) (int, error) {
+	result := int(C.ggmlRowSize(C.int(ggmlType), C.int(n)))
+	if result == 0 && n != 0 {
+		return 0, fmt.Errorf("%v values do not fill %s blocks", n, ggmlTypeNames[ggmlType])
+	}
+	return result, nil
+}
+
+// encodeGGML converts data to ggml type with ggml routines, so quantized data is what runtime expects
+func encodeGGML(ggmlType int, data []float32) ([]byte, error) {
+	size, errSize := ggmlRowSize(ggmlType, len(data))
+	if errSize != nil {
+		return nil, errSize
+	}
+	result := make([]byte, size)
+	if len(data) == 0 {
+		return result, nil
+	}
+	n := C.convertFloats(C.int(ggmlType), (*C.float)(unsafe.Pointer(&data[0])), unsafe.Pointer(&result[0]), C.int(len(data)))
+	return result[:int(n)], nil
+}
+
+// decodeGGML converts ggml type data to float32
+func decodeGGML(ggmlType int, data []byte, n int) ([]float32, error) {
+	if _, haz := ggmlTypeNames[ggmlType]; !haz {
+		return nil, fmt.Errorf("unsupported ggml type %v", ggmlType)
+	}
+	size, errSize := ggmlRowSize(ggmlType, n)
+	if errSize != nil {
+		return nil, errSize
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("%v bytes of %s data, expected %v", len(data), ggmlTypeNames[ggmlType], size)
+	}
+	result := make([]float32, n)
+	if n == 0 {
+		return result, nil
+	}
+	if C.decodeFloats(C.int(ggmlType), unsafe.Pointer(&data[0]), (*C.float)(unsafe.Pointer(&result[0])), C.int(n)) != 0 {
+		return nil, fmt.Errorf("can not decode %s data", ggmlTypeNames[ggmlType])
+	}
+	return result, nil
+}
+
+// ggmlTensor is tensor as stored in ggml file. ne is in ggml order
+type ggmlTensor struct {
+	name     string
+	ne       []int
+	ggmlType int
+	data     []byte
+}
+
+func (p *ggmlTensor) nElements() int {
+	result := 1
+	for _, n := range p.ne {
+		result *= n
+	}
+	return result
+}
+
+type ggmlReader struct {
+	f         *os.File
+	r         *bufio.Reader
+	modelType int
+	ftype     EnumFType
+	vocab     []string
+}
+
+// openGGMLFile reads header and vocab, tensors are read one by one with Next
+func openGGMLFile(fname string) (*ggmlReader, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	result := ggmlReader{f: f, r: bufio.NewReaderSize(f, 1024*1024)}
+	var header [3]int32
+	if err := binary.Read(result.r, binary.LittleEndian, &header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading header of %s failed err=%v", fname, err)
+	}
+	if header[0] != ggmlFileMagic {
+		f.Close()
+		return nil, fmt.Errorf("invalid model file %s (bad magic)", fname)
+	}
+	result.modelType = int(header[1]>>16) & 0xFFFF
+	result.ftype = EnumFType(header[1] & 0xFFFF)
+	if header[2] < 0 {
+		f.Close()
+		return nil, fmt.Errorf("invalid vocab size %v in %s", header[2], fname)
+	}
+	result.vocab = make([]string, header[2])
+	for i := range result.vocab {
+		var n int32
+		if err := binary.Read(result.r, binary.LittleEndian, &n); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading vocab of %s failed err=%v", fname, err)
+		}
+		if n < 0 {
+			f.Close()
+			return nil, fmt.Errorf("invalid vocab token length %v in %s", n, fname)
+		}
+		token := make([]byte, n)
+		if _, err := io.ReadFull(result.r, token); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading vocab of %s failed err=%v", fname, err)
+		}
+		result.vocab[i] = string(token)
+	}
+	return &result, nil
+}
+
+// Next returns next tensor, io.EOF after last one
+func (p *ggmlReader) Next() (ggmlTensor, error) {
+	var header [3]int32
+	if err := binary.Read(p.r, binary.LittleEndian, &header); err != nil {
+		if err == io.EOF {
+			return ggmlTensor{}, io.EOF
+		}
+		return ggmlTensor{}, fmt.Errorf("reading tensor header failed err=%v", err)
+	}
+	if header[0] < 0 || 4 < header[0] || header[1] < 0 {
+		return ggmlTensor{}, fmt.Errorf("invalid tensor header %v", header)
+	}
+	result := ggmlTensor{ne: make([]int, header[0]), ggmlType: int(header[2])}
+	ne := make([]int32, header[0])
+	if err := binary.Read(p.r, binary.LittleEndian, ne); err != nil {
+		return result, fmt.Errorf("reading tensor header failed err=%v", err)
+	}
+	for i, n := range ne {
+		result.ne[i] = int(n)
+	}
+	name := make([]byte, header[1])
+	if _, err := io.ReadFull(p.r, name); err != nil {
+		return result, fmt.Errorf("reading tensor name failed err=%v", err)
+	}
+	result.name = string(name)
+	if _, haz := ggmlTypeNames[result.ggmlType]; !haz {
+		return result, fmt.Errorf("tensor %s has unsupported type %v", result.name, result.ggmlType)
+	}
+	size, errSize := ggmlRowSize(result.ggmlType, result.nElements())
+	if errSize != nil {
+		return result, fmt.Errorf("tensor %s: %s", result.name, errSize.Error())
+	}
+	result.data = make([]byte, size)
+	if _, err := io.ReadFull(p.r, result.data); err != nil {
+		return result, fmt.Errorf("reading tensor %s failed err=%v", result.name, err)
+	}
+	return result, nil
+}
+
+func (p *ggmlReader) Close() error {
+	return p.f.Close()
+}
+
+type ggmlWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+// createGGMLFile writes header and vocab. Vocab tokens are raw bytes, id is index
+func createGGMLFile(fname string, modelType int, ftype EnumFType, vocab []string) (*ggmlWriter, error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	result := ggmlWriter{f: f, w: bufio.NewWriterSize(f, 1024*1024)}
+	header := []int32{ggmlFileMagic, int32(modelType<<16) | int32(ftype), int32(len(vocab))}
+	if err := binary.Write(result.w, binary.LittleEndian, header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, token := range vocab {
+		if err := binary.Write(result.w, binary.LittleEndian, int32(len(token))); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := result.w.WriteString(token); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// WriteTensor writes tensor already encoded to ggmlType. ne is in ggml order
+func (p *ggmlWriter) WriteTensor(name string, ne []int, ggmlType int, data []byte) error {
+	header := []int32{int32(len(ne)), int32(len(name)), int32(ggmlType)}
+	for _, n := range ne {
+		header = append(header, int32(n))
+	}
+	if err := binary.Write(p.w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := p.w.WriteString(name); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(data); err != nil {
+		return fmt.Errorf("writing tensor %s failed err=%v", name, err)
+	}
+	return nil
+}
+
+func (p *ggmlWriter) Close() error {
+	errFlush := p.w.Flush()
+	errClose := p.f.Close()
+	if errFlush != nil {
+		return errFlush
+	}
+	return errClose
+}
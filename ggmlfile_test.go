@@ -0,0 +1,120 @@
+package bindstablediff
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGGMLFileRoundTrip(t *testing.T) {
+	vocab := []string{"a", "bc</w>", "", "\xff\x00"}
+	q8 := make([]float32, 64)
+	for i := range q8 {
+		q8[i] = float32(i-32) / 8
+	}
+	f16, errF16 := encodeGGML(ggmlTypeF16, []float32{1, -2, 0.5, 3, 0, 65504})
+	encodedQ8, errQ8 := encodeGGML(ggmlTypeQ8_0, q8)
+	if errF16 != nil || errQ8 != nil {
+		t.Fatalf("encoding failed %v %v", errF16, errQ8)
+	}
+	tensors := []ggmlTensor{
+		{name: "model.diffusion_model.out.2.bias", ne: []int{3}, ggmlType: ggmlTypeF32, data: f32Bytes(0.25, -1, 7)},
+		{name: "first_stage_model.decoder.conv_in.weight", ne: []int{1, 2, 3, 1}, ggmlType: ggmlTypeF16, data: f16},
+		{name: "model.diffusion_model.time_embed.0.weight", ne: []int{32, 2}, ggmlType: ggmlTypeQ8_0, data: encodedQ8},
+	}
+
+	fname := filepath.Join(t.TempDir(), "model.bin")
+	out, err := createGGMLFile(fname, modelTypeSDXL, FTYPE_Q8_0, vocab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tensor := range tensors {
+		if err := out.WriteTensor(tensor.name, tensor.ne, tensor.ggmlType, tensor.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := openGGMLFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	if in.modelType != modelTypeSDXL || in.ftype != FTYPE_Q8_0 {
+		t.Errorf("header model type %v ftype %v", in.modelType, in.ftype)
+	}
+	if !reflect.DeepEqual(in.vocab, vocab) {
+		t.Errorf("vocab %#v, want %#v", in.vocab, vocab)
+	}
+	for _, want := range tensors {
+		got, err := in.Next()
+		if err != nil {
+			t.Fatalf("reading %s failed err=%v", want.name, err)
+		}
+		if got.name != want.name || !reflect.DeepEqual(got.ne, want.ne) || got.ggmlType != want.ggmlType || !bytes.Equal(got.data, want.data) {
+			t.Errorf("tensor %s %v type %v, want %s %v type %v", got.name, got.ne, got.ggmlType, want.name, want.ne, want.ggmlType)
+		}
+	}
+	if _, err := in.Next(); err != io.EOF {
+		t.Errorf("after last tensor err=%v, want EOF", err)
+	}
+
+	//Quantized data decodes back near original
+	decoded, err := decodeGGML(ggmlTypeQ8_0, encodedQ8, len(q8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range decoded {
+		if 0.02 < math.Abs(float64(v-q8[i])) {
+			t.Errorf("q8_0 value %v decoded to %v, was %v", i, v, q8[i])
+		}
+	}
+}
+
+func TestGGMLFileTruncated(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "model.bin")
+	out, err := createGGMLFile(fname, modelTypeSD1, FTYPE_F32, []string{"abc", "def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.WriteTensor("alphas_cumprod", []int{4}, ggmlTypeF32, f32Bytes(1, 2, 3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const vocabEnd = 12 + 2*(4+3)
+	for _, size := range []int{8, 14, 12 + 4 + 3 + 2, vocabEnd + 6, len(content) - 1} {
+		truncated := filepath.Join(dir, "truncated.bin")
+		if err := os.WriteFile(truncated, content[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		in, err := openGGMLFile(truncated)
+		if size < vocabEnd {
+			if err == nil {
+				in.Close()
+				t.Errorf("file truncated to %v bytes opened", size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("file truncated to %v bytes: %v", size, err)
+		}
+		if _, err := in.Next(); err == nil || err == io.EOF {
+			t.Errorf("tensor of file truncated to %v bytes err=%v", size, err)
+		}
+		in.Close()
+	}
+}
@@ -0,0 +1,373 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+/*
+LoRA adapter loaded from safetensors file. Kohya (lora_unet_..., lora_te_...) and diffusers/peft (unet..., text_encoder...
+with lora_A/lora_B) key formats are supported. Deltas are added to weights for duration of one generation call
+*/
+type LoRA struct {
+	Name    string //File name without extension, used in <lora:name:weight> prompt tags
+	modules []loraModule
+}
+
+// LoRAWeight picks loaded LoRA by name for TextGenPars
+type LoRAWeight struct {
+	Name   string
+	Weight float32
+}
+
+type loraModule struct {
+	key   string //Kohya style name like lora_unet_input_blocks_1_1_proj_in
+	up    []float32
+	down  []float32
+	out   int
+	rank  int
+	inner int
+	alpha float32
+}
+
+// loraRegistry is LoRAs loaded on model by name, shared with sessions of model
+type loraRegistry struct {
+	lock   sync.Mutex
+	loaded map[string]*LoRA
+}
+
+func newLoRARegistry() *loraRegistry {
+	return &loraRegistry{loaded: make(map[string]*LoRA)}
+}
+
+/*
+LoadLoRA reads LoRA from safetensors file and registers it on model by file name without extension, so it can be
+used from TextGenPars.LoRAs and prompt tags on model and its sessions. Loading again with same name replaces earlier one
+*/
+func (p *StableDiffusionModel) LoadLoRA(fname string) (*LoRA, error) {
+	result, err := readLoRA(fname)
+	if err != nil {
+		return nil, err
+	}
+	p.loras.lock.Lock()
+	p.loras.loaded[result.Name] = result
+	p.loras.lock.Unlock()
+	return result, nil
+}
+
+// UnloadLoRA removes LoRA from model
+func (p *StableDiffusionModel) UnloadLoRA(name string) {
+	p.loras.lock.Lock()
+	delete(p.loras.loaded, name)
+	p.loras.lock.Unlock()
+}
+
+func readLoRA(fname string) (*LoRA, error) {
+	st, errOpen := openSafetensors(fname)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer st.Close()
+
+	result := LoRA{Name: strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))}
+	for _, name := range st.Names() {
+		var base, upName string
+		switch {
+		case strings.HasSuffix(name, ".lora_down.weight"):
+			base = strings.TrimSuffix(name, ".lora_down.weight")
+			upName = base + ".lora_up.weight"
+		case strings.HasSuffix(name, ".lora_A.weight"):
+			base = strings.TrimSuffix(name, ".lora_A.weight")
+			upName = base + ".lora_B.weight"
+		default:
+			continue
+		}
+		module, errModule := readLoRAModule(st, base, name, upName)
+		if errModule != nil {
+			return nil, fmt.Errorf("invalid LoRA %s err=%s", fname, errModule.Error())
+		}
+		result.modules = append(result.modules, module)
+	}
+	if len(result.modules) == 0 {
+		return nil, fmt.Errorf("no LoRA weights found from %s", fname)
+	}
+	return &result, nil
+}
+
+func readLoRAModule(st *safetensorsFile, base string, downName string, upName string) (loraModule, error) {
+	down, downShape, errDown := st.ReadFloat32(downName)
+	if errDown != nil {
+		return loraModule{}, errDown
+	}
+	up, upShape, errUp := st.ReadFloat32(upName)
+	if errUp != nil {
+		return loraModule{}, errUp
+	}
+	if len(downShape) < 2 || len(upShape) < 2 {
+		return loraModule{}, fmt.Errorf("%s is not matrix", base)
+	}
+	result := loraModule{
+		key:  normalizeLoRAKey(base),
+		up:   up,
+		down: down,
+		out:  upShape[0],
+		rank: downShape[0],
+	}
+	result.inner = len(down) / result.rank //Conv down weights are flattened
+	if upShape[1] != result.rank || len(up) != result.out*result.rank {
+		return loraModule{}, fmt.Errorf("%s up shape %v does not match rank %v", base, upShape, result.rank)
+	}
+	result.alpha = float32(result.rank)
+	if alpha, _, errAlpha := st.ReadFloat32(base + ".alpha"); errAlpha == nil && len(alpha) == 1 {
+		result.alpha = alpha[0]
+	}
+	return result, nil
+}
+
+// normalizeLoRAKey turns diffusers/peft names into kohya format
+func normalizeLoRAKey(base string) string {
+	if strings.HasPrefix(base, "unet.") {
+		return "lora_unet_" + strings.ReplaceAll(strings.TrimPrefix(base, "unet."), ".", "_")
+	}
+	if strings.HasPrefix(base, "text_encoder.") {
+		return "lora_te_" + strings.ReplaceAll(strings.TrimPrefix(base, "text_encoder."), ".", "_")
+	}
+	if strings.HasPrefix(base, "text_encoder_2.") { //SDXL
+		return "lora_te2_" + strings.ReplaceAll(strings.TrimPrefix(base, "text_encoder_2."), ".", "_")
+	}
+	return base
+}
+
+// loraKeysForTensor lists kohya names that can refer model weight. UNet has both original and diffusers naming,
+// SDXL text encoders are lora_te1_ and lora_te2_
+func loraKeysForTensor(name string) []string {
+	if !strings.HasSuffix(name, ".weight") {
+		return nil
+	}
+	path := strings.TrimSuffix(name, ".weight")
+	if strings.HasPrefix(path, "model.diffusion_model.") {
+		ldm := strings.TrimPrefix(path, "model.diffusion_model.")
+		result := []string{"lora_unet_" + strings.ReplaceAll(ldm, ".", "_")}
+		if diffusers, ok := ldmToDiffusers(ldm); ok {
+			result = append(result, "lora_unet_"+strings.ReplaceAll(diffusers, ".", "_"))
+		}
+		return result
+	}
+	if strings.HasPrefix(path, "cond_stage_model.transformer.") {
+		te := strings.ReplaceAll(strings.TrimPrefix(path, "cond_stage_model.transformer."), ".", "_")
+		return []string{"lora_te_" + te, "lora_te1_" + te}
+	}
+	if strings.HasPrefix(path, "cond_stage_model.1.transformer.") {
+		return []string{"lora_te2_" + strings.ReplaceAll(strings.TrimPrefix(path, "cond_stage_model.1.transformer."), ".", "_")}
+	}
+	return nil
+}
+
+var resnetDiffusersNames = map[string]string{
+	"in_layers.0":     "norm1",
+	"in_layers.2":     "conv1",
+	"emb_layers.1":    "time_emb_proj",
+	"out_layers.0":    "norm2",
+	"out_layers.3":    "conv2",
+	"skip_connection": "conv_shortcut",
+}
+
+// ldmToDiffusers converts UNet weight path from original layout to diffusers layout
+func ldmToDiffusers(path string) (string, bool) {
+	parts := strings.Split(path, ".")
+	resnet := func(prefix string, rest []string) (string, bool) {
+		renamed, haz := resnetDiffusersNames[strings.Join(rest, ".")]
+		return prefix + renamed, haz
+	}
+	switch parts[0] {
+	case "input_blocks":
+		if len(parts) < 3 {
+			return "", false
+		}
+		n, _ := strconv.Atoi(parts[1])
+		if n == 0 {
+			return "conv_in", true
+		}
+		if len(parts) < 4 {
+			return "", false
+		}
+		rest := parts[3:]
+		i := (n - 1) / 3
+		j := (n - 1) % 3
+		if n%3 == 0 {
+			return fmt.Sprintf("down_blocks.%d.downsamplers.0.conv", n/3-1), true
+		}
+		if parts[2] == "0" {
+			return resnet(fmt.Sprintf("down_blocks.%d.resnets.%d.", i, j), rest)
+		}
+		return fmt.Sprintf("down_blocks.%d.attentions.%d.%s", i, j, strings.Join(rest, ".")), true
+	case "middle_block":
+		if len(parts) < 3 {
+			return "", false
+		}
+		rest := parts[2:]
+		switch parts[1] {
+		case "0":
+			return resnet("mid_block.resnets.0.", rest)
+		case "1":
+			return "mid_block.attentions.0." + strings.Join(rest, "."), true
+		case "2":
+			return resnet("mid_block.resnets.1.", rest)
+		}
+	case "output_blocks":
+		if len(parts) < 4 {
+			return "", false
+		}
+		n, _ := strconv.Atoi(parts[1])
+		rest := parts[3:]
+		i := n / 3
+		j := n % 3
+		switch parts[2] {
+		case "0":
+			return resnet(fmt.Sprintf("up_blocks.%d.resnets.%d.", i, j), rest)
+		case "1":
+			if rest[0] == "conv" { //Up block without attention, first on SD1 and SD2
+				return fmt.Sprintf("up_blocks.%d.upsamplers.0.conv", i), true
+			}
+			return fmt.Sprintf("up_blocks.%d.attentions.%d.%s", i, j, strings.Join(rest, ".")), true
+		case "2":
+			return fmt.Sprintf("up_blocks.%d.upsamplers.0.conv", i), true
+		}
+	case "time_embed":
+		m := map[string]string{"0": "time_embedding.linear_1", "2": "time_embedding.linear_2"}
+		result, haz := m[strings.Join(parts[1:], ".")]
+		return result, haz
+	case "label_emb": //SDXL
+		m := map[string]string{"0.0": "add_embedding.linear_1", "0.2": "add_embedding.linear_2"}
+		result, haz := m[strings.Join(parts[1:], ".")]
+		return result, haz
+	case "out":
+		m := map[string]string{"0": "conv_norm_out", "2": "conv_out"}
+		result, haz := m[strings.Join(parts[1:], ".")]
+		return result, haz
+	}
+	return "", false
+}
+
+// takeLoRAs removes lora tags from prompt and returns them with LoRAs listed in parameters
+func (p *TextGenPars) takeLoRAs() []LoRAWeight {
+	prompt, tagged := extractLoRATags(p.Prompt)
+	p.Prompt = prompt
+	return append(append([]LoRAWeight{}, p.LoRAs...), tagged...)
+}
+
+// extractLoRATags returns prompt without <lora:name:weight> tags and weights from tags
+func extractLoRATags(prompt string) (string, []LoRAWeight) {
+	if !strings.Contains(prompt, "<lora:") {
+		return prompt, nil
+	}
+	cPrompt := C.CString(prompt)
+	defer C.free(unsafe.Pointer(cPrompt))
+	var cCleaned, cTags *C.char
+	C.extractLoraTags(cPrompt, &cCleaned, &cTags)
+	cleaned := C.GoString(cCleaned)
+	tags := C.GoString(cTags)
+	C.free(unsafe.Pointer(cCleaned))
+	C.free(unsafe.Pointer(cTags))
+
+	result := []LoRAWeight{}
+	for _, line := range strings.Split(tags, "\n") {
+		sep := strings.LastIndex(line, ":")
+		if sep < 0 {
+			continue
+		}
+		weight, _ := strconv.ParseFloat(line[sep+1:], 32)
+		result = append(result, LoRAWeight{Name: line[:sep], Weight: float32(weight)})
+	}
+	return cleaned, result
+}
+
+// weightsTarget is model weights that LoRA modifies. Generations without LoRA can share weights, LoRA needs exclusive access
+type weightsTarget struct {
+	sdModel C.StableDiffusionModel //Copy, cgo does not allow pointer into struct holding Go pointers
+	lock    *sync.RWMutex
+	loras   *loraRegistry
+}
+
+// run calls generate with LoRA deltas added and restores original weights after
+func (p weightsTarget) run(loras []LoRAWeight, generate func()) error {
+	if len(loras) == 0 {
+		p.lock.RLock()
+		generate()
+		p.lock.RUnlock()
+		return nil
+	}
+
+	adapters := make([]*LoRA, len(loras))
+	p.loras.lock.Lock()
+	for i, lw := range loras {
+		adapters[i] = p.loras.loaded[lw.Name]
+	}
+	p.loras.lock.Unlock()
+	for i, adapter := range adapters {
+		if adapter == nil {
+			return fmt.Errorf("LoRA %s not loaded", loras[i].Name)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	defer C.restoreWeights(&p.sdModel)
+
+	keyMap := p.loraKeyMap()
+	for i, adapter := range adapters {
+		if errApply := p.apply(keyMap, adapter, loras[i].Weight); errApply != nil {
+			return errApply
+		}
+	}
+	generate()
+	return nil
+}
+
+// loraKeyMap maps kohya names to model weight names
+func (p weightsTarget) loraKeyMap() map[string]string {
+	cNames := C.modelTensorNames(&p.sdModel)
+	names := C.GoString(cNames)
+	C.free(unsafe.Pointer(cNames))
+
+	result := make(map[string]string)
+	for _, name := range strings.Split(names, "\n") {
+		for _, key := range loraKeysForTensor(name) {
+			result[key] = name
+		}
+	}
+	return result
+}
+
+func (p weightsTarget) apply(keyMap map[string]string, adapter *LoRA, weight float32) error {
+	matched := 0
+	for _, module := range adapter.modules {
+		name, haz := keyMap[module.key]
+		if !haz {
+			continue
+		}
+		cName := C.CString(name)
+		ret := C.addWeightDelta(&p.sdModel, cName,
+			(*C.float)(unsafe.Pointer(&module.up[0])), (*C.float)(unsafe.Pointer(&module.down[0])),
+			C.int(module.out), C.int(module.rank), C.int(module.inner),
+			C.float(weight*module.alpha/float32(module.rank)))
+		C.free(unsafe.Pointer(cName))
+		if ret != 0 {
+			return fmt.Errorf("LoRA %s weight %s does not fit model", adapter.Name, module.key)
+		}
+		matched++
+	}
+	if matched == 0 {
+		return fmt.Errorf("LoRA %s does not match any model weight", adapter.Name)
+	}
+	return nil
+}
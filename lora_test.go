@@ -0,0 +1,164 @@
+package bindstablediff
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testTensor struct {
+	dtype string
+	shape []int
+	data  []byte
+}
+
+func f32Bytes(values ...float32) []byte {
+	result := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(result[i*4:], math.Float32bits(v))
+	}
+	return result
+}
+
+// writeTestSafetensors writes tensors to fname in test temp dir
+func writeTestSafetensors(t *testing.T, fname string, tensors map[string]testTensor) string {
+	names := make([]string, 0, len(tensors))
+	for name := range tensors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	header := map[string]any{"__metadata__": map[string]string{"format": "pt"}}
+	var data []byte
+	for _, name := range names {
+		tensor := tensors[name]
+		header[name] = safetensorsEntry{DType: tensor.dtype, Shape: tensor.shape, DataOffsets: [2]int64{int64(len(data)), int64(len(data) + len(tensor.data))}}
+		data = append(data, tensor.data...)
+	}
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := binary.LittleEndian.AppendUint64(nil, uint64(len(rawHeader)))
+	content = append(append(content, rawHeader...), data...)
+	result := filepath.Join(t.TempDir(), fname)
+	if err := os.WriteFile(result, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestLoRAPerModel(t *testing.T) {
+	fname := writeTestSafetensors(t, "pixelart.safetensors", map[string]testTensor{
+		"lora_unet_input_blocks_1_1_proj_in.lora_down.weight":    {"F32", []int{1, 4}, f32Bytes(1, 2, 3, 4)},
+		"lora_unet_input_blocks_1_1_proj_in.lora_up.weight":      {"F32", []int{2, 1}, f32Bytes(0.5, -0.5)},
+		"lora_unet_input_blocks_1_1_proj_in.alpha":               {"F32", []int{}, f32Bytes(2)},
+		"unet.down_blocks.0.attentions.0.proj_out.lora_A.weight": {"F32", []int{1, 2}, f32Bytes(1, 1)},
+		"unet.down_blocks.0.attentions.0.proj_out.lora_B.weight": {"F32", []int{2, 1}, f32Bytes(1, 1)},
+	})
+	a := StableDiffusionModel{lock: &sync.Mutex{}, weights: &sync.RWMutex{}, loras: newLoRARegistry()}
+	b := StableDiffusionModel{lock: &sync.Mutex{}, weights: &sync.RWMutex{}, loras: newLoRARegistry()}
+
+	lora, err := a.LoadLoRA(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lora.Name != "pixelart" || len(lora.modules) != 2 {
+		t.Fatalf("loaded %s with %v modules", lora.Name, len(lora.modules))
+	}
+	keys := []string{lora.modules[0].key, lora.modules[1].key}
+	sort.Strings(keys)
+	if want := []string{"lora_unet_down_blocks_0_attentions_0_proj_out", "lora_unet_input_blocks_1_1_proj_in"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("module keys %v, want %v", keys, want)
+	}
+	for _, module := range lora.modules {
+		if module.key == "lora_unet_input_blocks_1_1_proj_in" && (module.out != 2 || module.rank != 1 || module.inner != 4 || module.alpha != 2) {
+			t.Errorf("module %+v", module)
+		}
+	}
+
+	if a.loras.loaded["pixelart"] != lora {
+		t.Errorf("LoRA not registered on model it was loaded for")
+	}
+	errRun := b.weightsTarget().run([]LoRAWeight{{Name: "pixelart", Weight: 1}}, func() { t.Errorf("generated with LoRA of other model") })
+	if errRun == nil || !strings.Contains(errRun.Error(), "not loaded") {
+		t.Errorf("other model err=%v", errRun)
+	}
+
+	a.UnloadLoRA("pixelart")
+	if len(a.loras.loaded) != 0 {
+		t.Errorf("LoRA still registered after unload")
+	}
+}
+
+func TestNormalizeLoRAKey(t *testing.T) {
+	cases := map[string]string{
+		"unet.down_blocks.0.attentions.0.proj_in":                   "lora_unet_down_blocks_0_attentions_0_proj_in",
+		"text_encoder.text_model.encoder.layers.0.self_attn.q_proj": "lora_te_text_model_encoder_layers_0_self_attn_q_proj",
+		"text_encoder_2.text_model.encoder.layers.3.mlp.fc2":        "lora_te2_text_model_encoder_layers_3_mlp_fc2",
+		"lora_unet_input_blocks_1_1_proj_in":                        "lora_unet_input_blocks_1_1_proj_in",
+	}
+	for base, want := range cases {
+		if got := normalizeLoRAKey(base); got != want {
+			t.Errorf("normalizeLoRAKey(%s) = %s, want %s", base, got, want)
+		}
+	}
+}
+
+func TestLoRAKeysForTensor(t *testing.T) {
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"model.diffusion_model.input_blocks.0.0.weight", []string{"lora_unet_input_blocks_0_0", "lora_unet_conv_in"}},
+		{"model.diffusion_model.input_blocks.1.0.in_layers.2.weight", []string{"lora_unet_input_blocks_1_0_in_layers_2", "lora_unet_down_blocks_0_resnets_0_conv1"}},
+		{"model.diffusion_model.input_blocks.1.1.proj_in.weight", []string{"lora_unet_input_blocks_1_1_proj_in", "lora_unet_down_blocks_0_attentions_0_proj_in"}},
+		{"model.diffusion_model.input_blocks.5.0.skip_connection.weight", []string{"lora_unet_input_blocks_5_0_skip_connection", "lora_unet_down_blocks_1_resnets_1_conv_shortcut"}},
+		{"model.diffusion_model.input_blocks.3.0.op.weight", []string{"lora_unet_input_blocks_3_0_op", "lora_unet_down_blocks_0_downsamplers_0_conv"}},
+		{"model.diffusion_model.middle_block.1.transformer_blocks.0.attn2.to_k.weight", []string{"lora_unet_middle_block_1_transformer_blocks_0_attn2_to_k", "lora_unet_mid_block_attentions_0_transformer_blocks_0_attn2_to_k"}},
+		{"model.diffusion_model.middle_block.2.emb_layers.1.weight", []string{"lora_unet_middle_block_2_emb_layers_1", "lora_unet_mid_block_resnets_1_time_emb_proj"}},
+		{"model.diffusion_model.output_blocks.2.1.conv.weight", []string{"lora_unet_output_blocks_2_1_conv", "lora_unet_up_blocks_0_upsamplers_0_conv"}},
+		{"model.diffusion_model.output_blocks.4.1.transformer_blocks.0.ff.net.2.weight", []string{"lora_unet_output_blocks_4_1_transformer_blocks_0_ff_net_2", "lora_unet_up_blocks_1_attentions_1_transformer_blocks_0_ff_net_2"}},
+		{"model.diffusion_model.output_blocks.5.2.conv.weight", []string{"lora_unet_output_blocks_5_2_conv", "lora_unet_up_blocks_1_upsamplers_0_conv"}},
+		{"model.diffusion_model.time_embed.2.weight", []string{"lora_unet_time_embed_2", "lora_unet_time_embedding_linear_2"}},
+		{"model.diffusion_model.label_emb.0.0.weight", []string{"lora_unet_label_emb_0_0", "lora_unet_add_embedding_linear_1"}},
+		{"model.diffusion_model.out.2.weight", []string{"lora_unet_out_2", "lora_unet_conv_out"}},
+		{"model.diffusion_model.out.0.weight", []string{"lora_unet_out_0", "lora_unet_conv_norm_out"}},
+		{"cond_stage_model.transformer.text_model.encoder.layers.0.self_attn.q_proj.weight", []string{"lora_te_text_model_encoder_layers_0_self_attn_q_proj", "lora_te1_text_model_encoder_layers_0_self_attn_q_proj"}},
+		{"cond_stage_model.1.transformer.text_model.encoder.layers.0.mlp.fc1.weight", []string{"lora_te2_text_model_encoder_layers_0_mlp_fc1"}},
+		{"model.diffusion_model.input_blocks.1.1.proj_in.bias", nil},
+		{"first_stage_model.decoder.conv_in.weight", nil},
+	}
+	for _, c := range cases {
+		if got := loraKeysForTensor(c.name); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("loraKeysForTensor(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestExtractLoRATags(t *testing.T) {
+	cases := []struct {
+		prompt string
+		want   string
+		loras  []LoRAWeight
+	}{
+		{"a dog", "a dog", nil},
+		{"a dog <lora:pixelart:0.8>, sunny", "a dog , sunny", []LoRAWeight{{"pixelart", 0.8}}},
+		{"<lora:a:1.5>a cat<lora:b>", "a cat", []LoRAWeight{{"a", 1.5}, {"b", 1}}},
+		{"a <lora:neg:-0.5> cat", "a  cat", []LoRAWeight{{"neg", -0.5}}},
+		{"not a <lora tag", "not a <lora tag", nil},
+		{"a <lora:> cat", "a <lora:> cat", []LoRAWeight{}},
+	}
+	for _, c := range cases {
+		got, loras := extractLoRATags(c.prompt)
+		if got != c.want || !reflect.DeepEqual(loras, c.loras) {
+			t.Errorf("extractLoRATags(%#v) = %#v %v, want %#v %v", c.prompt, got, loras, c.want, c.loras)
+		}
+	}
+}
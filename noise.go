@@ -0,0 +1,133 @@
+package bindstablediff
+
+/*
+#include <stdint.h>
+*/
+import "C"
+import (
+	"fmt"
+	"math"
+	"runtime/cgo"
+	"strings"
+	"unsafe"
+)
+
+/*
+NoiseSource gives standard normal noise for initial latent and ancestral samplers. Values must depend only on seed
+and position in stream, so same seed gives same picture on every machine and build. Fill writes values from
+position offset on to dst
+*/
+type NoiseSource interface {
+	Fill(seed int64, offset uint64, dst []float32)
+}
+
+/*
+PortableNoise is deterministic NoiseSource that does not depend on C++ standard library or math library of
+platform. Value at position i of seed:
+  - u is splitmix64(seed, i) as uniform float64 in (0,1)
+  - result is inverse normal CDF of u by Wichura's algorithm AS241 (about 1e-16 relative error), rounded to
+    float32
+
+splitmix64(seed, n) is one output of splitmix64 with state uint64(seed)+(n+1)*0x9E3779B97F4A7C15, uniform is
+((z>>11)+0.5)/2^53. Tails need ln(u), it is computed here with fixed series instead of math.Log. Every step is
+single IEEE float64 operation rounded with explicit conversion, so compiler can not fuse them to FMA and result is
+bit-identical on every architecture
+*/
+type PortableNoise struct{}
+
+func (PortableNoise) Fill(seed int64, offset uint64, dst []float32) {
+	for i := range dst {
+		dst[i] = float32(inverseNormalCDF(splitmixUniform(seed, offset+uint64(i))))
+	}
+}
+
+func splitmixUniform(seed int64, n uint64) float64 {
+	z := uint64(seed) + (n+1)*0x9E3779B97F4A7C15
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	z ^= z >> 31
+	return (float64(z>>11) + 0.5) / (1 << 53)
+}
+
+// Coefficients of Wichura AS241 inverse normal CDF from highest power. Central region A/B, tails C/D and E/F
+var (
+	as241A = [...]float64{2.5090809287301226727e+3, 3.3430575583588128105e+4, 6.7265770927008700853e+4, 4.5921953931549871457e+4, 1.3731693765509461125e+4, 1.9715909503065514427e+3, 1.3314166789178437745e+2, 3.3871328727963666080e+0}
+	as241B = [...]float64{5.2264952788528545610e+3, 2.8729085735721942674e+4, 3.9307895800092710610e+4, 2.1213794301586595867e+4, 5.3941960214247511077e+3, 6.8718700749205790830e+2, 4.2313330701600911252e+1, 1}
+	as241C = [...]float64{7.74545014278341407640e-4, 2.27238449892691845833e-2, 2.41780725177450611770e-1, 1.27045825245236838258e+0, 3.64784832476320460504e+0, 5.76949722146069140550e+0, 4.63033784615654529590e+0, 1.42343711074968357734e+0}
+	as241D = [...]float64{1.05075007164441684324e-9, 5.47593808499534494600e-4, 1.51986665636164571966e-2, 1.48103976427480074590e-1, 6.89767334985100004550e-1, 1.67638483018380384940e+0, 2.05319162663775882187e+0, 1}
+	as241E = [...]float64{2.01033439929228813265e-7, 2.71155556874348757815e-5, 1.24266094738807843860e-3, 2.65321895265761230930e-2, 2.96560571828504891230e-1, 1.78482653991729133580e+0, 5.46378491116411436990e+0, 6.65790464350110377720e+0}
+	as241F = [...]float64{2.04426310338993978564e-15, 1.42151175831644588870e-7, 1.84631831751005468180e-5, 7.86869131145613259100e-4, 1.48753612908506148525e-2, 1.36929880922735805310e-1, 5.99832206555887937690e-1, 1}
+)
+
+// horner evaluates polynomial with coefficients from highest power, each product rounded separately
+func horner(coefs []float64, x float64) float64 {
+	result := coefs[0]
+	for _, c := range coefs[1:] {
+		result = float64(result*x) + c
+	}
+	return result
+}
+
+// inverseNormalCDF for p in (0,1)
+func inverseNormalCDF(p float64) float64 {
+	q := p - 0.5
+	if math.Abs(q) <= 0.425 {
+		r := 0.180625 - float64(q*q)
+		return float64(q*horner(as241A[:], r)) / horner(as241B[:], r)
+	}
+	r := p
+	if 0 < q {
+		r = 1 - p
+	}
+	r = math.Sqrt(-portableLog(r)) //sqrt is correctly rounded IEEE operation
+	var x float64
+	if r <= 5 {
+		r -= 1.6
+		x = horner(as241C[:], r) / horner(as241D[:], r)
+	} else {
+		r -= 5
+		x = horner(as241E[:], r) / horner(as241F[:], r)
+	}
+	if q < 0 {
+		return -x
+	}
+	return x
+}
+
+const portableLn2 = 0.6931471805599453 //Nearest float64 to ln 2
+
+// portableLog is natural logarithm for positive normal x. x = m*2^e with m in [sqrt(1/2), sqrt(2)) and
+// ln m = 2 atanh(s), s = (m-1)/(m+1). |s| < 0.172 so series to s^23 is accurate to float64
+func portableLog(x float64) float64 {
+	m, e := math.Frexp(x) //Exact, m in [0.5,1)
+	if m < math.Sqrt2/2 {
+		m = float64(m * 2)
+		e--
+	}
+	s := (m - 1) / (m + 1)
+	s2 := float64(s * s)
+	sum := 0.0
+	for k := 23; 1 < k; k -= 2 {
+		sum = float64((sum + 1/float64(k)) * s2)
+	}
+	return float64(float64(e)*portableLn2) + float64(2*float64(s+float64(s*sum)))
+}
+
+// ParseNoiseSource gives noise source by name. MODEL is nil, rng of model is used
+func ParseNoiseSource(s string) (NoiseSource, error) {
+	m := map[string]NoiseSource{
+		"MODEL":    nil,
+		"PORTABLE": PortableNoise{},
+	}
+	result, haz := m[strings.ToUpper(s)]
+	if !haz {
+		return nil, fmt.Errorf("invalid noise source name %s", s)
+	}
+	return result, nil
+}
+
+//export goNoiseFill
+func goNoiseFill(handle C.uintptr_t, seed C.int64_t, offset C.uint64_t, out *C.float, n C.uint32_t) {
+	source := cgo.Handle(handle).Value().(NoiseSource)
+	source.Fill(int64(seed), uint64(offset), unsafe.Slice((*float32)(unsafe.Pointer(out)), int(n)))
+}
@@ -0,0 +1,48 @@
+package bindstablediff
+
+import (
+	"math"
+	"testing"
+)
+
+// Golden values of PortableNoise, must never change. Computed independently from algorithm in PortableNoise doc
+func TestPortableNoiseGolden(t *testing.T) {
+	cases := []struct {
+		seed   int64
+		offset uint64
+		want   []uint32
+	}{
+		{42, 0, []uint32{0x3f25eef4, 0xbf7eacef, 0xbf1645c6, 0xbecd56c3, 0xbfe312fd, 0x3f8f1c66, 0xbf47102e, 0x3f58088c}},
+		{-1, 1000, []uint32{0x3f1253f1, 0xbf6c6580, 0x3efd4ebc, 0xbdb7e471}},
+	}
+	for _, c := range cases {
+		got := make([]float32, len(c.want))
+		PortableNoise{}.Fill(c.seed, c.offset, got)
+		for i, v := range got {
+			if math.Float32bits(v) != c.want[i] {
+				t.Errorf("seed %v position %v is %v (0x%08x), want 0x%08x", c.seed, c.offset+uint64(i), v, math.Float32bits(v), c.want[i])
+			}
+		}
+	}
+}
+
+// Tails and center of inverse normal CDF, bits of float64 result
+func TestInverseNormalCDF(t *testing.T) {
+	cases := []struct {
+		p    float64
+		want uint64
+	}{
+		{0.5 / (1 << 53), 0xc02095b059d67c4c},
+		{1e-10, 0xc0197203597a2154},
+		{0.01, 0xc0029c5c4630ff0e},
+		{0.3, 0xbfe0c7e39582c5fa},
+		{0.9, 0x3ff4813c36e26d34},
+		{0.999999999999, 0x401c2350895b2ea4},
+	}
+	for _, c := range cases {
+		got := inverseNormalCDF(c.p)
+		if math.Float64bits(got) != c.want {
+			t.Errorf("inverseNormalCDF(%v) = %v, want %v", c.p, got, math.Float64frombits(c.want))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bindstablediff
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// QuantizeInfo summarizes Quantize run
+type QuantizeInfo struct {
+	InSize         int64 //Bytes
+	OutSize        int64
+	Tensors        int
+	Quantized      int     //Tensors converted to new type, rest are copied as is
+	RelativeError  float32 //RMS error of converted weights relative to their RMS value
+	ExpectedImpact string  //Typical effect on pictures
+}
+
+// quantizeImpact is typical effect of weight type on pictures
+var quantizeImpact = map[EnumFType]string{
+	FTYPE_F32:  "lossless",
+	FTYPE_F16:  "practically lossless",
+	FTYPE_Q8_0: "near lossless, hard to tell apart from f16",
+	FTYPE_Q5_1: "small detail changes",
+	FTYPE_Q5_0: "small detail changes",
+	FTYPE_Q4_1: "noticeable detail changes, composition kept",
+	FTYPE_Q4_0: "largest loss, details and colours change",
+}
+
+func (p QuantizeInfo) String() string {
+	return fmt.Sprintf("%.1fMB -> %.1fMB (%.0f%%), %v of %v tensors converted, relative RMS error %.4f, %s",
+		float64(p.InSize)/1024/1024, float64(p.OutSize)/1024/1024, 100*float64(p.OutSize)/math.Max(1, float64(p.InSize)),
+		p.Quantized, p.Tensors, p.RelativeError, p.ExpectedImpact)
+}
+
+/*
+Quantize rewrites ggml model file with weights of new ftype, like f16 model to q8_0 without original checkpoint.
+Types are picked like convert.py does: 2-D weights are converted with ggml quantize functions (f16 if rows do not
+fill quantization blocks), 4-D conv weights are f16 and norms and biases f32. Tensors are streamed one by one so
+memory use stays low
+*/
+func Quantize(inPath string, outPath string, ftype EnumFType) (QuantizeInfo, error) {
+	result := QuantizeInfo{ExpectedImpact: quantizeImpact[ftype]}
+	weightType, errType := ftype.ggmlType()
+	if errType != nil {
+		return result, errType
+	}
+	inStat, errStat := os.Stat(inPath)
+	if errStat != nil {
+		return result, errStat
+	}
+	outStat, errOutStat := os.Stat(outPath)
+	if errOutStat == nil && os.SameFile(inStat, outStat) {
+		return result, fmt.Errorf("can not quantize %s in place", inPath)
+	}
+	result.InSize = inStat.Size()
+
+	in, errOpen := openGGMLFile(inPath)
+	if errOpen != nil {
+		return result, errOpen
+	}
+	defer in.Close()
+
+	out, errCreate := createGGMLFile(outPath, in.modelType, ftype, in.vocab)
+	if errCreate != nil {
+		return result, errCreate
+	}
+
+	errSum, refSum := 0.0, 0.0
+	errQuantize := func() error {
+		for {
+			t, errNext := in.Next()
+			if errNext == io.EOF {
+				return nil
+			}
+			if errNext != nil {
+				return errNext
+			}
+			result.Tensors++
+			newType := convertTensorType(t.name, t.ne, weightType)
+			if newType == t.ggmlType || t.name == "alphas_cumprod" {
+				if err := out.WriteTensor(t.name, t.ne, t.ggmlType, t.data); err != nil {
+					return err
+				}
+				continue
+			}
+			data, errDecode := decodeGGML(t.ggmlType, t.data, t.nElements())
+			if errDecode != nil {
+				return fmt.Errorf("tensor %s: %s", t.name, errDecode.Error())
+			}
+			encoded, errEncode := encodeGGML(newType, data)
+			if errEncode != nil {
+				return fmt.Errorf("tensor %s %v: %s", t.name, t.ne, errEncode.Error())
+			}
+			decoded, errDecode := decodeGGML(newType, encoded, len(data))
+			if errDecode != nil {
+				return fmt.Errorf("tensor %s: %s", t.name, errDecode.Error())
+			}
+			for i, v := range data {
+				d := float64(decoded[i] - v)
+				errSum += d * d
+				refSum += float64(v) * float64(v)
+			}
+			if err := out.WriteTensor(t.name, t.ne, newType, encoded); err != nil {
+				return err
+			}
+			result.Quantized++
+		}
+	}()
+	errClose := out.Close()
+	if errQuantize == nil {
+		errQuantize = errClose
+	}
+	if errQuantize != nil {
+		os.Remove(outPath)
+		return result, fmt.Errorf("quantizing %s failed err=%v", inPath, errQuantize)
+	}
+
+	if 0 < refSum {
+		result.RelativeError = float32(math.Sqrt(errSum / refSum))
+	}
+	if outStat, err := os.Stat(outPath); err == nil {
+		result.OutSize = outStat.Size()
+	}
+	return result, nil
+}
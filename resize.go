@@ -0,0 +1,250 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+*/
+import "C"
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// EnumResizeMode tells how img2img start image is fitted to Width x Height
+type EnumResizeMode int
+
+const (
+	JUST_RESIZE     EnumResizeMode = 0 // Stretch to target size, aspect ratio is not kept
+	CROP_AND_RESIZE EnumResizeMode = 1 // Scale to cover target and crop overflow from center
+	RESIZE_AND_FILL EnumResizeMode = 2 // Scale to fit inside target and fill empty area with stretched edges
+	LATENT_FILL     EnumResizeMode = 3 // Scale to fit inside target and fill empty area with noise, lets diffusion invent content there
+)
+
+func ParseResizeMode(s string) (EnumResizeMode, error) {
+	m := map[string]EnumResizeMode{
+		"JUST_RESIZE":     JUST_RESIZE,
+		"CROP_AND_RESIZE": CROP_AND_RESIZE,
+		"RESIZE_AND_FILL": RESIZE_AND_FILL,
+		"LATENT_FILL":     LATENT_FILL,
+	}
+	result, haz := m[strings.ToUpper(s)]
+	if !haz {
+		return JUST_RESIZE, fmt.Errorf("invalid resize mode name %s", s)
+	}
+	return result, nil
+}
+
+// UNet works on latents 1/8 of image size and downsamples those three times
+const sizeMultiple = 64
+
+// RoundToModelSize rounds image dimension to nearest size that UNet accepts
+func RoundToModelSize(v int) int {
+	result := int(math.Round(float64(v)/sizeMultiple)) * sizeMultiple
+	if result < sizeMultiple {
+		return sizeMultiple
+	}
+	return result
+}
+
+// initLayout remembers where original picture ended up, so result can be restored back
+type initLayout struct {
+	mode    EnumResizeMode
+	origW   int
+	origH   int
+	content image.Rectangle // area on generated picture that contains original image
+	crop    image.Rectangle // area of original image that was used (CROP_AND_RESIZE)
+}
+
+// setLatentFill tells C side which area of LATENT_FILL init image is picture, latent of the rest is replaced with noise
+func (p initLayout) setLatentFill(cPars *C.GenerationParams) {
+	if p.mode != LATENT_FILL {
+		return
+	}
+	cPars.latentFill = C.bool(true)
+	cPars.contentX = C.int(p.content.Min.X)
+	cPars.contentY = C.int(p.content.Min.Y)
+	cPars.contentWidth = C.int(p.content.Dx())
+	cPars.contentHeight = C.int(p.content.Dy())
+}
+
+// fitInside returns size of w x h scaled to fit inside maxW x maxH keeping aspect ratio
+func fitInside(w, h, maxW, maxH int) (int, int) {
+	scale := math.Min(float64(maxW)/float64(w), float64(maxH)/float64(h))
+	return max(1, int(math.Round(float64(w)*scale))), max(1, int(math.Round(float64(h)*scale)))
+}
+
+// prepareInitImage fits start image to parameters. Width and Height are rounded to multiple of 64, zero means size of start image
+func prepareInitImage(startImage image.Image, parameters *TextGenPars) (*image.RGBA, initLayout, error) {
+	b := startImage.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return nil, initLayout{}, fmt.Errorf("empty start image")
+	}
+	if parameters.Width <= 0 {
+		parameters.Width = b.Dx()
+	}
+	if parameters.Height <= 0 {
+		parameters.Height = b.Dy()
+	}
+	parameters.Width = RoundToModelSize(parameters.Width)
+	parameters.Height = RoundToModelSize(parameters.Height)
+	w := parameters.Width
+	h := parameters.Height
+
+	layout := initLayout{
+		mode:    parameters.ResizeMode,
+		origW:   b.Dx(),
+		origH:   b.Dy(),
+		content: image.Rect(0, 0, w, h),
+		crop:    image.Rect(0, 0, b.Dx(), b.Dy()),
+	}
+
+	switch parameters.ResizeMode {
+	case JUST_RESIZE:
+		return resizeLanczos(startImage, w, h), layout, nil
+
+	case CROP_AND_RESIZE:
+		cropW, cropH := fitInside(w, h, b.Dx(), b.Dy()) //Largest area with target aspect ratio
+		x0 := (b.Dx() - cropW) / 2
+		y0 := (b.Dy() - cropH) / 2
+		layout.crop = image.Rect(x0, y0, x0+cropW, y0+cropH)
+		cropped := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+		draw.Draw(cropped, cropped.Bounds(), startImage, b.Min.Add(layout.crop.Min), draw.Src)
+		return resizeLanczos(cropped, w, h), layout, nil
+
+	case RESIZE_AND_FILL, LATENT_FILL:
+		fitW, fitH := fitInside(b.Dx(), b.Dy(), w, h)
+		x0 := (w - fitW) / 2
+		y0 := (h - fitH) / 2
+		layout.content = image.Rect(x0, y0, x0+fitW, y0+fitH)
+
+		//Stretched picture as background gives edge colors to empty area. LATENT_FILL replaces its latent with noise after encode
+		result := resizeLanczos(startImage, w, h)
+		draw.Draw(result, layout.content, resizeLanczos(startImage, fitW, fitH), image.Point{}, draw.Src)
+		return result, layout, nil
+	}
+	return nil, layout, fmt.Errorf("invalid resize mode %d", parameters.ResizeMode)
+}
+
+// restore scales generated picture back to size and aspect ratio of original start image
+func (p initLayout) restore(generated image.Image, original image.Image) image.Image {
+	switch p.mode {
+	case CROP_AND_RESIZE: //Parts cropped away are taken from original
+		result := image.NewRGBA(image.Rect(0, 0, p.origW, p.origH))
+		draw.Draw(result, result.Bounds(), original, original.Bounds().Min, draw.Src)
+		draw.Draw(result, p.crop, resizeLanczos(generated, p.crop.Dx(), p.crop.Dy()), image.Point{}, draw.Src)
+		return result
+	case RESIZE_AND_FILL, LATENT_FILL:
+		content := image.NewRGBA(image.Rect(0, 0, p.content.Dx(), p.content.Dy()))
+		draw.Draw(content, content.Bounds(), generated, generated.Bounds().Min.Add(p.content.Min), draw.Src)
+		return resizeLanczos(content, p.origW, p.origH)
+	}
+	return resizeLanczos(generated, p.origW, p.origH)
+}
+
+func clampByte(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if 255 <= v {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+/*
+Lanczos resampling, done separately for rows and columns.
+No need for external image libraries
+*/
+const lanczosA = 3
+
+func lanczos(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if x <= -lanczosA || lanczosA <= x {
+		return 0
+	}
+	px := math.Pi * x
+	return lanczosA * math.Sin(px) * math.Sin(px/lanczosA) / (px * px)
+}
+
+type filterTap struct {
+	start   int //first source pixel
+	weights []float64
+}
+
+// lanczosTaps calculates normalized filter weights for each destination pixel
+func lanczosTaps(srcLen int, dstLen int) []filterTap {
+	result := make([]filterTap, dstLen)
+	scale := float64(srcLen) / float64(dstLen)
+	filterScale := math.Max(scale, 1) //Widen filter when downscaling, avoids aliasing
+	support := lanczosA * filterScale
+	for i := range result {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := max(0, int(math.Ceil(center-support)))
+		end := min(srcLen-1, int(math.Floor(center+support)))
+		weights := make([]float64, end-start+1)
+		sum := 0.0
+		for j := range weights {
+			weights[j] = lanczos((float64(start+j) - center) / filterScale)
+			sum += weights[j]
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] /= sum
+			}
+		}
+		result[i] = filterTap{start: start, weights: weights}
+	}
+	return result
+}
+
+func resizeLanczos(img image.Image, width int, height int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if b.Dx() == width && b.Dy() == height {
+		return src
+	}
+
+	//Horizontal pass to float buffer
+	xTaps := lanczosTaps(b.Dx(), width)
+	tmp := make([]float64, width*b.Dy()*4)
+	for y := 0; y < b.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, tap := range xTaps {
+			var acc [4]float64
+			for j, w := range tap.weights {
+				pos := (tap.start + j) * 4
+				for c := 0; c < 4; c++ {
+					acc[c] += w * float64(row[pos+c])
+				}
+			}
+			copy(tmp[(y*width+x)*4:], acc[:])
+		}
+	}
+
+	//Vertical pass to result
+	yTaps := lanczosTaps(b.Dy(), height)
+	result := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, tap := range yTaps {
+		for x := 0; x < width; x++ {
+			var acc [4]float64
+			for j, w := range tap.weights {
+				pos := ((tap.start+j)*width + x) * 4
+				for c := 0; c < 4; c++ {
+					acc[c] += w * tmp[pos+c]
+				}
+			}
+			pos := y*result.Stride + x*4
+			a := clampByte(acc[3])
+			for c := 0; c < 3; c++ {
+				result.Pix[pos+c] = min(clampByte(acc[c]), a) //Premultiplied color can not exceed alpha
+			}
+			result.Pix[pos+3] = a
+		}
+	}
+	return result
+}
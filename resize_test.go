@@ -0,0 +1,169 @@
+package bindstablediff
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func solidImage(r image.Rectangle, c color.RGBA) *image.RGBA {
+	result := image.NewRGBA(r)
+	draw.Draw(result, r, &image.Uniform{c}, image.Point{}, draw.Src)
+	return result
+}
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+)
+
+func TestRoundToModelSize(t *testing.T) {
+	cases := []struct{ v, want int }{
+		{0, 64}, {1, 64}, {95, 64}, {96, 128}, {200, 192}, {300, 320}, {512, 512}, {1000, 1024},
+	}
+	for _, c := range cases {
+		if got := RoundToModelSize(c.v); got != c.want {
+			t.Errorf("RoundToModelSize(%v) = %v, want %v", c.v, got, c.want)
+		}
+	}
+}
+
+func TestPrepareInitImage(t *testing.T) {
+	cases := []struct {
+		name          string
+		start         image.Rectangle
+		mode          EnumResizeMode
+		width, height int
+		wantW, wantH  int
+		content       image.Rectangle
+		crop          image.Rectangle
+	}{
+		{"just resize to own size", image.Rect(0, 0, 300, 200), JUST_RESIZE, 0, 0, 320, 192, image.Rect(0, 0, 320, 192), image.Rect(0, 0, 300, 200)},
+		{"just resize", image.Rect(10, 20, 310, 220), JUST_RESIZE, 500, 260, 512, 256, image.Rect(0, 0, 512, 256), image.Rect(0, 0, 300, 200)},
+		{"crop wide", image.Rect(0, 0, 300, 200), CROP_AND_RESIZE, 256, 256, 256, 256, image.Rect(0, 0, 256, 256), image.Rect(50, 0, 250, 200)},
+		{"crop tall", image.Rect(5, 5, 205, 305), CROP_AND_RESIZE, 512, 256, 512, 256, image.Rect(0, 0, 512, 256), image.Rect(0, 100, 200, 200)},
+		{"fill wide", image.Rect(0, 0, 300, 200), RESIZE_AND_FILL, 256, 256, 256, 256, image.Rect(0, 42, 256, 213), image.Rect(0, 0, 300, 200)},
+		{"latent fill tall", image.Rect(0, 0, 200, 300), LATENT_FILL, 512, 256, 512, 256, image.Rect(170, 0, 341, 256), image.Rect(0, 0, 200, 300)},
+	}
+	for _, c := range cases {
+		pars := TextGenPars{Width: c.width, Height: c.height, ResizeMode: c.mode}
+		result, layout, err := prepareInitImage(solidImage(c.start, red), &pars)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if pars.Width != c.wantW || pars.Height != c.wantH {
+			t.Errorf("%s: size %vx%v, want %vx%v", c.name, pars.Width, pars.Height, c.wantW, c.wantH)
+		}
+		if result.Bounds() != image.Rect(0, 0, c.wantW, c.wantH) {
+			t.Errorf("%s: image bounds %v", c.name, result.Bounds())
+		}
+		if layout.content != c.content || layout.crop != c.crop {
+			t.Errorf("%s: content %v crop %v, want %v %v", c.name, layout.content, layout.crop, c.content, c.crop)
+		}
+		if got := result.RGBAAt(c.wantW/2, c.wantH/2); got != red {
+			t.Errorf("%s: center is %v, want %v", c.name, got, red)
+		}
+	}
+
+	pars := TextGenPars{ResizeMode: EnumResizeMode(9)}
+	if _, _, err := prepareInitImage(solidImage(image.Rect(0, 0, 64, 64), red), &pars); err == nil {
+		t.Errorf("invalid resize mode accepted")
+	}
+	if _, _, err := prepareInitImage(image.NewRGBA(image.Rect(0, 0, 0, 64)), &TextGenPars{}); err == nil {
+		t.Errorf("empty start image accepted")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	original := solidImage(image.Rect(5, 5, 205, 305), red) //200x300
+
+	//Cropped away parts come from original
+	crop := initLayout{mode: CROP_AND_RESIZE, origW: 200, origH: 300, crop: image.Rect(0, 100, 200, 200)}
+	restored := crop.restore(solidImage(image.Rect(0, 0, 512, 256), blue), original).(*image.RGBA)
+	if restored.Bounds() != image.Rect(0, 0, 200, 300) {
+		t.Fatalf("crop restored to %v", restored.Bounds())
+	}
+	for _, p := range []struct {
+		x, y int
+		want color.RGBA
+	}{{10, 10, red}, {100, 150, blue}, {199, 100, blue}, {0, 99, red}, {100, 299, red}} {
+		if got := restored.RGBAAt(p.x, p.y); got != p.want {
+			t.Errorf("crop restored (%v,%v) is %v, want %v", p.x, p.y, got, p.want)
+		}
+	}
+
+	//Only content area is scaled back, filled border is dropped
+	content := image.Rect(170, 0, 341, 256)
+	generated := solidImage(image.Rect(0, 0, 512, 256), green)
+	draw.Draw(generated, content, &image.Uniform{blue}, image.Point{}, draw.Src)
+	for _, mode := range []EnumResizeMode{RESIZE_AND_FILL, LATENT_FILL} {
+		fill := initLayout{mode: mode, origW: 200, origH: 300, content: content}
+		restored := fill.restore(generated, original).(*image.RGBA)
+		if restored.Bounds() != image.Rect(0, 0, 200, 300) {
+			t.Fatalf("mode %v restored to %v", mode, restored.Bounds())
+		}
+		for y := 0; y < 300; y += 7 {
+			for x := 0; x < 200; x += 7 {
+				if got := restored.RGBAAt(x, y); got != blue {
+					t.Fatalf("mode %v restored (%v,%v) is %v, want %v", mode, x, y, got, blue)
+				}
+			}
+		}
+	}
+
+	resized := initLayout{mode: JUST_RESIZE, origW: 200, origH: 300}.restore(generated, original)
+	if resized.Bounds() != image.Rect(0, 0, 200, 300) {
+		t.Errorf("just resize restored to %v", resized.Bounds())
+	}
+}
+
+func TestLanczosTaps(t *testing.T) {
+	for _, c := range []struct{ src, dst int }{{300, 64}, {64, 300}, {7, 3}, {3, 7}, {100, 100}} {
+		taps := lanczosTaps(c.src, c.dst)
+		if len(taps) != c.dst {
+			t.Fatalf("%v -> %v: %v taps", c.src, c.dst, len(taps))
+		}
+		for i, tap := range taps {
+			if tap.start < 0 || c.src < tap.start+len(tap.weights) {
+				t.Errorf("%v -> %v: tap %v reads %v..%v", c.src, c.dst, i, tap.start, tap.start+len(tap.weights)-1)
+			}
+			sum := 0.0
+			for _, w := range tap.weights {
+				sum += w
+			}
+			if 1e-9 < math.Abs(sum-1) {
+				t.Errorf("%v -> %v: tap %v weights sum to %v", c.src, c.dst, i, sum)
+			}
+		}
+	}
+}
+
+func TestResizeLanczosNonSquare(t *testing.T) {
+	//Left half black, right half white. Every row stays same and edges keep their colors
+	src := solidImage(image.Rect(3, 4, 103, 44), color.RGBA{0, 0, 0, 255})
+	draw.Draw(src, image.Rect(53, 4, 103, 44), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.Point{}, draw.Src)
+
+	for _, size := range []image.Point{{50, 120}, {240, 30}, {100, 40}} {
+		result := resizeLanczos(src, size.X, size.Y)
+		if result.Bounds() != image.Rect(0, 0, size.X, size.Y) {
+			t.Fatalf("resized to %v, want %v", result.Bounds(), size)
+		}
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				if result.RGBAAt(x, y) != result.RGBAAt(x, 0) {
+					t.Fatalf("%v: rows differ at (%v,%v)", size, x, y)
+				}
+			}
+		}
+		if left := result.RGBAAt(0, 0); left.R != 0 || left.A != 255 {
+			t.Errorf("%v: left edge is %v", size, left)
+		}
+		if right := result.RGBAAt(size.X-1, 0); right.R != 255 || right.A != 255 {
+			t.Errorf("%v: right edge is %v", size, right)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package bindstablediff
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+Minimal safetensors reader. File is 8 byte little endian header length, JSON header and raw tensor data.
+Floating point tensors are converted to float32 when read
+*/
+
+type safetensorsEntry struct {
+	DType       string   `json:"dtype"`
+	Shape       []int    `json:"shape"`
+	DataOffsets [2]int64 `json:"data_offsets"`
+}
+
+type safetensorsFile struct {
+	f         *os.File
+	entries   map[string]safetensorsEntry
+	metadata  map[string]string
+	dataStart int64
+}
+
+const safetensorsMaxHeader = 100 * 1024 * 1024
+
+func openSafetensors(fname string) (*safetensorsFile, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	var headerLen uint64
+	if err := binary.Read(f, binary.LittleEndian, &headerLen); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading safetensors header length from %s failed err=%v", fname, err)
+	}
+	if safetensorsMaxHeader < headerLen {
+		f.Close()
+		return nil, fmt.Errorf("invalid safetensors header length %v in %s", headerLen, fname)
+	}
+	rawHeader := make([]byte, headerLen)
+	if _, err := io.ReadFull(f, rawHeader); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading safetensors header from %s failed err=%v", fname, err)
+	}
+
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("invalid safetensors header in %s err=%v", fname, err)
+	}
+
+	result := safetensorsFile{
+		f:         f,
+		entries:   make(map[string]safetensorsEntry),
+		metadata:  make(map[string]string),
+		dataStart: int64(8 + headerLen),
+	}
+	for name, raw := range header {
+		if name == "__metadata__" {
+			json.Unmarshal(raw, &result.metadata) //Metadata is optional information
+			continue
+		}
+		var entry safetensorsEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("invalid safetensors entry %s in %s err=%v", name, fname, err)
+		}
+		result.entries[name] = entry
+	}
+	return &result, nil
+}
+
+func (p *safetensorsFile) Close() error {
+	return p.f.Close()
+}
+
+// Names returns tensor names in sorted order
+func (p *safetensorsFile) Names() []string {
+	result := make([]string, 0, len(p.entries))
+	for name := range p.entries {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (p *safetensorsFile) Shape(name string) []int {
+	return p.entries[name].Shape
+}
+
+// ReadRaw returns tensor data as is, with dtype
+func (p *safetensorsFile) ReadRaw(name string) ([]byte, string, error) {
+	entry, haz := p.entries[name]
+	if !haz {
+		return nil, "", fmt.Errorf("tensor %s not found", name)
+	}
+	size := entry.DataOffsets[1] - entry.DataOffsets[0]
+	if size < 0 {
+		return nil, "", fmt.Errorf("invalid data offsets on tensor %s", name)
+	}
+	result := make([]byte, size)
+	if _, err := p.f.ReadAt(result, p.dataStart+entry.DataOffsets[0]); err != nil {
+		return nil, "", fmt.Errorf("reading tensor %s failed err=%v", name, err)
+	}
+	return result, entry.DType, nil
+}
+
+// ReadFloat32 reads F64, F32, F16 or BF16 tensor as float32
+func (p *safetensorsFile) ReadFloat32(name string) ([]float32, []int, error) {
+	raw, dtype, err := p.ReadRaw(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, errConv := toFloat32(raw, dtype)
+	if errConv != nil {
+		return nil, nil, fmt.Errorf("tensor %s: %s", name, errConv.Error())
+	}
+	return result, p.entries[name].Shape, nil
+}
+
+func toFloat32(raw []byte, dtype string) ([]float32, error) {
+	switch dtype {
+	case "F64":
+		result := make([]float32, len(raw)/8)
+		for i := range result {
+			result[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(raw[i*8:])))
+		}
+		return result, nil
+	case "F32":
+		result := make([]float32, len(raw)/4)
+		for i := range result {
+			result[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+		}
+		return result, nil
+	case "F16":
+		result := make([]float32, len(raw)/2)
+		for i := range result {
+			result[i] = float16ToFloat32(binary.LittleEndian.Uint16(raw[i*2:]))
+		}
+		return result, nil
+	case "BF16":
+		result := make([]float32, len(raw)/2)
+		for i := range result {
+			result[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(raw[i*2:])) << 16)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("unsupported dtype %s", dtype)
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		//Subnormal, normalize
+		for mant&0x400 == 0 {
+			mant <<= 1
+			exp--
+		}
+		exp++
+		mant &= 0x3ff
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
@@ -0,0 +1,46 @@
+package bindstablediff
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func u16Bytes(values ...uint16) []byte {
+	result := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(result[i*2:], v)
+	}
+	return result
+}
+
+func TestToFloat32(t *testing.T) {
+	cases := []struct {
+		dtype string
+		raw   []byte
+		want  []float32
+	}{
+		{"F16", u16Bytes(0x3c00, 0xc000, 0x3800, 0x7bff, 0x0400, 0x0001, 0x8000), []float32{1, -2, 0.5, 65504, 1.0 / (1 << 14), 1.0 / (1 << 24), float32(math.Copysign(0, -1))}},
+		{"F16", u16Bytes(0x7c00, 0xfc00), []float32{float32(math.Inf(1)), float32(math.Inf(-1))}},
+		{"BF16", u16Bytes(0x3f80, 0xc000, 0x4049, 0x0000), []float32{1, -2, 3.140625, 0}},
+		{"F32", f32Bytes(1.5, -0.25), []float32{1.5, -0.25}},
+	}
+	for _, c := range cases {
+		got, err := toFloat32(c.raw, c.dtype)
+		if err != nil {
+			t.Errorf("%s: %v", c.dtype, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) || math.Signbit(float64(got[len(got)-1])) != math.Signbit(float64(c.want[len(c.want)-1])) {
+			t.Errorf("%s %x decoded to %v, want %v", c.dtype, c.raw, got, c.want)
+		}
+	}
+
+	if got, _ := toFloat32(u16Bytes(0x7e00), "F16"); !math.IsNaN(float64(got[0])) {
+		t.Errorf("F16 NaN decoded to %v", got[0])
+	}
+	if _, err := toFloat32(u16Bytes(1), "I16"); err == nil {
+		t.Errorf("I16 accepted")
+	}
+}
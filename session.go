@@ -0,0 +1,91 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+)
+
+/*
+Session is generation context that shares read-only weights of model. Sessions run in parallel, each with
+its own thread count, random generator and compute buffers. Calls on one session are serialized. Generation
+with LoRA changes weights, so it waits other sessions and blocks them while running.
+Typical use is one session per worker with thread count of NumCPU divided by number of workers
+*/
+type Session struct {
+	sdSession C.GenerationSession
+	lock      *sync.Mutex
+	weights   weightsTarget
+	sdModel   C.StableDiffusionModel
+	modelType EnumModelType //Model may be closed before session
+}
+
+func (p *StableDiffusionModel) NewSession(nThreads int) (*Session, error) {
+	if nThreads < 1 {
+		nThreads = runtime.NumCPU()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed() {
+		return nil, errClosed
+	}
+	result := Session{lock: &sync.Mutex{}, sdModel: p.sdModel, modelType: EnumModelType(C.modelType(&p.sdModel))}
+	result.weights = weightsTarget{sdModel: result.sdModel, lock: p.weights, loras: p.loras}
+	ret := C.newSession(&p.sdModel, C.int(nThreads), &result.sdSession)
+	if ret != 0 {
+		return nil, fmt.Errorf("session init fail with code %v", ret)
+	}
+	return &result, nil
+}
+
+func (p *Session) Txt2Img(parameters TextGenPars) (image.Image, error) {
+	return runTxt2Img(p.lock, p.closed, p.weightsTarget, parameters, func(cPars *C.GenerationParams) *C.uint8_t {
+		return C.sessionTxt2img(&p.sdSession, cPars)
+	})
+}
+
+// Img2Img works like StableDiffusionModel.Img2Img
+func (p *Session) Img2Img(startImage image.Image, parameters TextGenPars) (image.Image, error) {
+	return runImg2Img(p.lock, p.closed, p.weightsTarget, startImage, parameters, func(initImage *C.uchar, cPars *C.GenerationParams) *C.uint8_t {
+		return C.sessionImg2img(&p.sdSession, initImage, cPars)
+	})
+}
+
+// closed is called with lock held
+func (p *Session) closed() bool {
+	return p.sdSession.session == nil
+}
+
+func (p *Session) weightsTarget() weightsTarget {
+	return p.weights
+}
+
+// ModelType tells architecture of model session was created from
+func (p *Session) ModelType() EnumModelType {
+	return p.modelType
+}
+
+// Upscale works like StableDiffusionModel.Upscale
+func (p *Session) Upscale(img image.Image, factor float64, pars TextGenPars) (image.Image, error) {
+	return upscale(p.Img2Img, p.ModelType().NativeSize(), img, factor, pars, nil)
+}
+
+func (p *Session) UpscaleWithProgress(img image.Image, factor float64, pars TextGenPars, progress func(done int, total int)) (image.Image, error) {
+	return upscale(p.Img2Img, p.ModelType().NativeSize(), img, factor, pars, progress)
+}
+
+func (p *Session) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.sdSession.session == nil {
+		return fmt.Errorf("session already closed")
+	}
+	C.freeSession(&p.sdSession)
+	return nil
+}
@@ -1,10 +1,12 @@
 #include <assert.h>
 #include <algorithm>
+#include <atomic>
 #include <cstring>
 #include <fstream>
 #include <iostream>
 #include <iterator>
 #include <map>
+#include <mutex>
 #include <random>
 #include <regex>
 #include <set>
@@ -13,6 +15,18 @@
 #include <unordered_map>
 #include <vector>
 
+#if defined(_WIN32)
+#define WIN32_LEAN_AND_MEAN
+#define NOMINMAX
+#define NOGDI
+#include <windows.h>
+#else
+#include <fcntl.h>
+#include <sys/mman.h>
+#include <sys/stat.h>
+#include <unistd.h>
+#endif
+
 #include "ggml.h"
 #include "rng.h"
 #include "rng_philox.h"
@@ -50,15 +64,22 @@ static SDLogLevel log_level = SDLogLevel::INFO;
 
 #define TIMESTEPS 1000
 
+#define MAX_PARAMS_TENSOR_NUM 4096  // upper bound of weight tensors in one component, sizes contexts of mapped weights
+
+#define VAE_TILE_SIZE 64    // latent pixels, 512px image
+#define VAE_TILE_OVERLAP 8  // latent pixels
+
 enum ModelType {
     SD1 = 0,
     SD2 = 1,
+    SDXL = 2,
     MODEL_TYPE_COUNT,
 };
 
 const char* model_type_to_str[] = {
     "SD1.x",
-    "SD2.x"};
+    "SD2.x",
+    "SDXL"};
 
 /*================================================== Helper Functions ================================================*/
 
@@ -218,6 +239,22 @@ struct ggml_tensor* new_timestep_embedding(struct ggml_context* ctx, struct ggml
     return embedding;
 }
 
+// SDXL size and crop conditioning, timestep embedding of each value one after another: [dim * values.size(), ]
+std::vector<float> size_embedding(const std::vector<float>& values, int dim, int max_period = 10000) {
+    int half = dim / 2;
+    std::vector<float> result;
+    for (float value : values) {
+        std::vector<float> embedding(dim, 0.f);
+        for (int j = 0; j < half; ++j) {
+            float arg = value * (float)std::exp(-std::log(max_period) * j / half);
+            embedding[j] = std::cos(arg);
+            embedding[j + half] = std::sin(arg);
+        }
+        result.insert(result.end(), embedding.begin(), embedding.end());
+    }
+    return result;
+}
+
 std::vector<uint8_t> ggml_to_image_vec(struct ggml_tensor* t) {
     int64_t w = t->ne[0];
     int64_t h = t->ne[1];
@@ -261,6 +298,33 @@ void image_vec_to_ggml(const std::vector<uint8_t>& vec,
     }
 }
 
+// bilinear resize of [W, H, C, N] tensor to size of dst
+void ggml_tensor_resize_bilinear(const struct ggml_tensor* src, struct ggml_tensor* dst) {
+    int64_t src_w = src->ne[0];
+    int64_t src_h = src->ne[1];
+    float scale_x = (float)src_w / dst->ne[0];
+    float scale_y = (float)src_h / dst->ne[1];
+    for (int i = 0; i < dst->ne[3]; i++) {
+        for (int j = 0; j < dst->ne[2]; j++) {
+            for (int k = 0; k < dst->ne[1]; k++) {
+                float y = std::max(0.0f, (k + 0.5f) * scale_y - 0.5f);
+                int y0 = std::min((int)y, (int)src_h - 1);
+                int y1 = std::min(y0 + 1, (int)src_h - 1);
+                float fy = y - y0;
+                for (int l = 0; l < dst->ne[0]; l++) {
+                    float x = std::max(0.0f, (l + 0.5f) * scale_x - 0.5f);
+                    int x0 = std::min((int)x, (int)src_w - 1);
+                    int x1 = std::min(x0 + 1, (int)src_w - 1);
+                    float fx = x - x0;
+                    float top = ggml_tensor_get_f32(src, x0, y0, j, i) * (1 - fx) + ggml_tensor_get_f32(src, x1, y0, j, i) * fx;
+                    float bottom = ggml_tensor_get_f32(src, x0, y1, j, i) * (1 - fx) + ggml_tensor_get_f32(src, x1, y1, j, i) * fx;
+                    ggml_tensor_set_f32(dst, top * (1 - fy) + bottom * fy, l, k, j, i);
+                }
+            }
+        }
+    }
+}
+
 struct ggml_tensor* ggml_group_norm_32(struct ggml_context* ctx,
                                        struct ggml_tensor* a) {
     return ggml_group_norm(ctx, a, 32);
@@ -284,6 +348,7 @@ class CLIPTokenizer {
    private:
     ModelType model_type = SD1;
     std::map<std::string, int32_t> encoder;
+    std::map<int32_t, std::string> decoder;
     std::regex pat;
 
     static std::string strip(const std::string& str) {
@@ -319,6 +384,21 @@ class CLIPTokenizer {
 
     void add_token(std::string token, int32_t token_id) {
         encoder[token] = token_id;
+        decoder[token_id] = token;
+    }
+
+    // text of token without end of word marker
+    std::string decode(int32_t token_id) {
+        auto it = decoder.find(token_id);
+        if (it == decoder.end()) {
+            return UNK_TOKEN;
+        }
+        std::string token = it->second;
+        const std::string end_of_word = "</w>";
+        if (token.size() >= end_of_word.size() && token.compare(token.size() - end_of_word.size(), end_of_word.size(), end_of_word) == 0) {
+            token.resize(token.size() - end_of_word.size());
+        }
+        return token;
     }
 
     std::vector<int> tokenize(std::string text, size_t max_length = 0, bool padding = false) {
@@ -389,6 +469,7 @@ class CLIPTokenizer {
 //   \) - literal character ')'
 //   \] - literal character ']'
 //   \\ - literal character '\'
+//   BREAK - ['BREAK', -1] entry, starts new 75 token chunk
 //   anything else - just text
 //
 // >>> parse_prompt_attention('normal text')
@@ -411,6 +492,12 @@ class CLIPTokenizer {
 //  [', sun, ', 1.1],
 //  ['sky', 1.4641000000000006],
 //  ['.', 1.1]]
+const std::pair<std::string, float> PROMPT_BREAK = {"BREAK", -1.0f};
+
+bool is_prompt_break(const std::pair<std::string, float>& item) {
+    return item.first == PROMPT_BREAK.first && item.second == PROMPT_BREAK.second;
+}
+
 std::vector<std::pair<std::string, float>> parse_prompt_attention(const std::string& text) {
     std::vector<std::pair<std::string, float>> res;
     std::vector<int> round_brackets;
@@ -424,7 +511,9 @@ std::vector<std::pair<std::string, float>> parse_prompt_attention(const std::str
 
     auto multiply_range = [&](int start_position, float multiplier) {
         for (int p = start_position; p < res.size(); ++p) {
-            res[p].second *= multiplier;
+            if (!is_prompt_break(res[p])) {
+                res[p].second *= multiplier;
+            }
         }
     };
 
@@ -453,7 +542,14 @@ std::vector<std::pair<std::string, float>> parse_prompt_attention(const std::str
         } else if (text == "\\(") {
             res.push_back({text.substr(1), 1.0f});
         } else {
-            res.push_back({text, 1.0f});
+            // BREAK keyword becomes separate entry that forces new chunk
+            std::sregex_token_iterator it(text.begin(), text.end(), re_break, -1), end;
+            for (bool first = true; it != end; ++it, first = false) {
+                if (!first) {
+                    res.push_back(PROMPT_BREAK);
+                }
+                res.push_back({*it, 1.0f});
+            }
         }
 
         remaining_text = m.suffix();
@@ -473,7 +569,7 @@ std::vector<std::pair<std::string, float>> parse_prompt_attention(const std::str
 
     int i = 0;
     while (i + 1 < res.size()) {
-        if (res[i].second == res[i + 1].second) {
+        if (res[i].second == res[i + 1].second && !is_prompt_break(res[i]) && !is_prompt_break(res[i + 1])) {
             res[i].first += res[i + 1].first;
             res.erase(res.begin() + i + 1);
         } else {
@@ -484,6 +580,163 @@ std::vector<std::pair<std::string, float>> parse_prompt_attention(const std::str
     return res;
 }
 
+// index of ']' that closes '[' at open, nested brackets and escaped characters are skipped
+static size_t find_closing_bracket(const std::string& text, size_t open) {
+    int depth = 0;
+    for (size_t i = open; i < text.size(); i++) {
+        if (text[i] == '\\') {
+            i++;
+        } else if (text[i] == '[') {
+            depth++;
+        } else if (text[i] == ']') {
+            depth--;
+            if (depth == 0) {
+                return i;
+            }
+        }
+    }
+    return std::string::npos;
+}
+
+// splits on sep that is not inside brackets or parentheses
+static std::vector<std::string> split_top_level(const std::string& text, char sep) {
+    std::vector<std::string> result;
+    std::string curr;
+    int depth = 0;
+    for (size_t i = 0; i < text.size(); i++) {
+        char ch = text[i];
+        if (ch == '\\' && i + 1 < text.size()) {
+            curr += text.substr(i, 2);
+            i++;
+            continue;
+        }
+        if (ch == '[' || ch == '(') {
+            depth++;
+        } else if ((ch == ']' || ch == ')') && depth > 0) {
+            depth--;
+        } else if (ch == sep && depth == 0) {
+            result.push_back(curr);
+            curr.clear();
+            continue;
+        }
+        curr += ch;
+    }
+    result.push_back(curr);
+    return result;
+}
+
+static bool parse_step_number(const std::string& text, float& value) {
+    const char* start = text.c_str();
+    char* end = NULL;
+    value = strtof(start, &end);
+    if (end == start) {
+        return false;
+    }
+    while (*end == ' ') {
+        end++;
+    }
+    return *end == '\0';
+}
+
+// Ref: https://github.com/AUTOMATIC1111/stable-diffusion-webui/blob/cad87bf4e3e0b0a759afa94e933527c3123d59bc/modules/prompt_parser.py#L26
+//
+// Evaluates prompt editing and alternation for sampling step (1..steps):
+//   [from:to:when] - from until step when, then to. when below 1 is fraction of steps
+//   [to:when] - to is added after step when
+//   [from::when] - from is removed after step when
+//   [a|b|c] - alternates every step
+//   [abc] - emphasis, kept for parse_prompt_attention
+//
+// >>> prompt_at_step('a [dog:cat:0.5]', 5, 10)
+// 'a dog'
+// >>> prompt_at_step('a [dog:cat:0.5]', 6, 10)
+// 'a cat'
+// >>> prompt_at_step('a [dog|cat]', 2, 10)
+// 'a cat'
+std::string prompt_at_step(const std::string& text, int step, int steps) {
+    std::string result;
+    for (size_t i = 0; i < text.size(); i++) {
+        char ch = text[i];
+        if (ch == '\\' && i + 1 < text.size()) {
+            result += text.substr(i, 2);
+            i++;
+            continue;
+        }
+        size_t close = ch == '[' ? find_closing_bracket(text, i) : std::string::npos;
+        if (close == std::string::npos) {
+            result += ch;
+            continue;
+        }
+        std::string inner = text.substr(i + 1, close - i - 1);
+        i = close;
+
+        std::vector<std::string> options = split_top_level(inner, '|');
+        if (options.size() > 1) {
+            result += prompt_at_step(options[(step - 1) % options.size()], step, steps);
+            continue;
+        }
+
+        std::vector<std::string> parts = split_top_level(inner, ':');
+        float when = 0;
+        if ((parts.size() == 2 || parts.size() == 3) && parse_step_number(parts.back(), when)) {
+            if (when < 1) {
+                when *= steps;
+            }
+            std::string from = parts.size() == 3 ? parts[0] : "";
+            std::string to = parts[parts.size() - 2];
+            result += prompt_at_step(step <= (int)when ? from : to, step, steps);
+            continue;
+        }
+        result += "[" + prompt_at_step(inner, step, steps) + "]";
+    }
+    return result;
+}
+
+// Ref: https://github.com/AUTOMATIC1111/stable-diffusion-webui/blob/cad87bf4e3e0b0a759afa94e933527c3123d59bc/modules/prompt_parser.py#L218
+//
+// Splits composable diffusion prompt to sub-prompts and their guidance weights, weight is 1 if missing
+// >>> parse_prompt_and('a cat :1.2 AND a dog :0.6')
+// [['a cat', 1.2], ['a dog', 0.6]]
+std::vector<std::pair<std::string, float>> parse_prompt_and(const std::string& text) {
+    std::regex re_and(R"(\bAND\b)");
+    std::regex re_weight(R"(^([\s\S]*?)(?:\s*:\s*([-+]?(?:\d+\.?|\d*\.\d+)))?\s*$)");
+    std::vector<std::pair<std::string, float>> res;
+
+    std::sregex_token_iterator it(text.begin(), text.end(), re_and, -1), end;
+    for (; it != end; ++it) {
+        std::string part = *it;
+        std::smatch m;
+        if (std::regex_match(part, m, re_weight) && m[2].matched) {
+            res.push_back({m[1], strtof(m[2].str().c_str(), NULL)});
+        } else {
+            res.push_back({part, 1.0f});
+        }
+    }
+    if (res.empty()) {
+        res.push_back({"", 1.0f});
+    }
+    return res;
+}
+
+// A1111 style lora tags <lora:name:weight> are removed from prompt, weight is 1 if missing
+// >>> extract_lora_tags('a dog <lora:pixelart:0.8>, sunny', loras)
+// 'a dog , sunny', loras = [['pixelart', 0.8]]
+std::string extract_lora_tags(const std::string& text, std::vector<std::pair<std::string, float>>& loras) {
+    std::regex re_lora(R"(<lora:([^:>]+)(?::([+-]?[.\d]+))?>)");
+    std::string result;
+    std::smatch m;
+    std::string remaining_text = text;
+
+    while (std::regex_search(remaining_text, m, re_lora)) {
+        std::string weight = m[2];
+        loras.push_back({m[1], weight.empty() ? 1.0f : strtof(weight.c_str(), NULL)});
+        result += m.prefix();
+        remaining_text = m.suffix();
+    }
+    result += remaining_text;
+    return result;
+}
+
 /*================================================ FrozenCLIPEmbedder ================================================*/
 
 struct ResidualAttentionBlock {
@@ -646,10 +899,10 @@ struct ResidualAttentionBlock {
         x = ggml_mul_mat(ctx, fc1_w, x);
         x = ggml_add(ctx, ggml_repeat(ctx, fc1_b, x), x);
 
-        if (hidden_size == 1024) {  // SD 2.x
-            x = ggml_gelu_inplace(ctx, x);
-        } else {  // SD 1.x
+        if (hidden_size == 768) {  // openai CLIP of SD 1.x and SDXL
             x = ggml_gelu_quick_inplace(ctx, x);
+        } else {  // open_clip of SD 2.x and SDXL
+            x = ggml_gelu_inplace(ctx, x);
         }
 
         x = ggml_mul_mat(ctx, fc2_w, x);
@@ -662,17 +915,26 @@ struct ResidualAttentionBlock {
     }
 };
 
+enum CLIPVersion {
+    OPENAI_CLIP_VIT_L_14,   // SD1.x and first text encoder of SDXL
+    OPEN_CLIP_VIT_H_14,     // SD2.x
+    OPEN_CLIP_VIT_BIGG_14,  // second text encoder of SDXL, has text projection for pooled output
+};
+
 // SD1.x: https://huggingface.co/openai/clip-vit-large-patch14/blob/main/config.json
 // SD2.x: https://huggingface.co/laion/CLIP-ViT-H-14-laion2B-s32B-b79K/blob/main/config.json
+// SDXL: https://huggingface.co/laion/CLIP-ViT-bigG-14-laion2B-39B-b160k/blob/main/config.json
 struct CLIPTextModel {
     ModelType model_type = SD1;
+    CLIPVersion version = OPENAI_CLIP_VIT_L_14;
     // network hparams
     int32_t vocab_size = 49408;
     int32_t max_position_embeddings = 77;
-    int32_t hidden_size = 768;         // 1024 for SD 2.x
-    int32_t intermediate_size = 3072;  // 4096 for SD 2.x
-    int32_t n_head = 12;               // num_attention_heads, 16 for SD 2.x
-    int32_t num_hidden_layers = 12;    // 24 for SD 2.x
+    int32_t hidden_size = 768;         // 1024 for SD 2.x, 1280 for bigG
+    int32_t intermediate_size = 3072;  // 4096 for SD 2.x, 5120 for bigG
+    int32_t n_head = 12;               // num_attention_heads, 16 for SD 2.x, 20 for bigG
+    int32_t num_hidden_layers = 12;    // 24 for SD 2.x, 32 for bigG
+    int32_t projection_dim = 1280;     // bigG only
 
     // embeddings
     struct ggml_tensor* position_ids;
@@ -682,14 +944,20 @@ struct CLIPTextModel {
     std::vector<ResidualAttentionBlock> resblocks;
     struct ggml_tensor* final_ln_w;
     struct ggml_tensor* final_ln_b;
+    struct ggml_tensor* text_projection = NULL;  // [hidden_size, projection_dim], pooled = x @ text_projection
 
-    CLIPTextModel(ModelType model_type = SD1)
-        : model_type(model_type) {
-        if (model_type == SD2) {
+    CLIPTextModel(ModelType model_type = SD1, CLIPVersion version = OPENAI_CLIP_VIT_L_14)
+        : model_type(model_type), version(version) {
+        if (version == OPEN_CLIP_VIT_H_14) {
             hidden_size = 1024;
             intermediate_size = 4096;
             n_head = 16;
             num_hidden_layers = 24;
+        } else if (version == OPEN_CLIP_VIT_BIGG_14) {
+            hidden_size = 1280;
+            intermediate_size = 5120;
+            n_head = 20;
+            num_hidden_layers = 32;
         }
         resblocks.resize(num_hidden_layers);
         set_resblocks_hp_params();
@@ -714,15 +982,22 @@ struct CLIPTextModel {
             mem_size += resblocks[i].compute_params_mem_size(wtype);
         }
         mem_size += 2 * hidden_size * ggml_type_sizef(GGML_TYPE_F32);  // final_ln_w/b
-        mem_size += ggml_tensor_overhead();                            // object overhead
+        if (version == OPEN_CLIP_VIT_BIGG_14) {
+            mem_size += hidden_size * projection_dim * ggml_type_sizef(GGML_TYPE_F32);  // text_projection
+        }
+        mem_size += 2 * ggml_tensor_overhead();  // object overhead
         return static_cast<size_t>(mem_size);
     }
 
     void init_params(struct ggml_context* ctx, ggml_type wtype) {
+        // not in model file, needs memory also when weights are mapped
+        bool no_alloc = ggml_get_no_alloc(ctx);
+        ggml_set_no_alloc(ctx, false);
         position_ids = ggml_new_tensor_1d(ctx, GGML_TYPE_I32, max_position_embeddings);
         for (int i = 0; i < max_position_embeddings; i++) {
             ggml_set_i32_1d(position_ids, i, i);
         }
+        ggml_set_no_alloc(ctx, no_alloc);
         token_embed_weight = ggml_new_tensor_2d(ctx, wtype, hidden_size, vocab_size);
         position_embed_weight = ggml_new_tensor_2d(ctx, wtype, hidden_size, max_position_embeddings);
 
@@ -732,6 +1007,10 @@ struct CLIPTextModel {
 
         final_ln_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, hidden_size);
         final_ln_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, hidden_size);
+
+        if (version == OPEN_CLIP_VIT_BIGG_14) {
+            text_projection = ggml_new_tensor_2d(ctx, GGML_TYPE_F32, projection_dim, hidden_size);
+        }
     }
 
     void map_by_name(std::map<std::string, struct ggml_tensor*>& tensors, const std::string prefix) {
@@ -742,34 +1021,85 @@ struct CLIPTextModel {
         for (int i = 0; i < num_hidden_layers; i++) {
             resblocks[i].map_by_name(tensors, prefix + "encoder.layers." + std::to_string(i) + ".");
         }
+        if (text_projection != NULL) {
+            tensors[prefix + "text_projection"] = text_projection;
+        }
+    }
+
+    // token embedding rows of tokens to out, ids from vocab_size up are rows of custom_vectors
+    void get_token_embeddings(const std::vector<int>& tokens, const std::vector<float>& custom_vectors, float* out) {
+        for (size_t i = 0; i < tokens.size(); i++) {
+            float* dst = out + i * hidden_size;
+            int id = tokens[i];
+            if (id >= vocab_size) {
+                memcpy(dst, custom_vectors.data() + (size_t)(id - vocab_size) * hidden_size, hidden_size * sizeof(float));
+                continue;
+            }
+            const void* row = (const char*)token_embed_weight->data + id * token_embed_weight->nb[1];
+            if (token_embed_weight->type == GGML_TYPE_F32) {
+                memcpy(dst, row, hidden_size * sizeof(float));
+            } else if (token_embed_weight->type == GGML_TYPE_F16) {
+                ggml_fp16_to_fp32_row((const ggml_fp16_t*)row, dst, hidden_size);
+            } else {
+                ggml_internal_get_type_traits(token_embed_weight->type).to_float(row, dst, hidden_size);
+            }
+        }
+    }
+
+    // number of last layers skipped, clip_skip 0 is model default
+    int skipped_layers(int clip_skip) {
+        if (clip_skip <= 0) {
+            return model_type == SD1 ? 0 : 1;  // layer: "penultimate" on SD2 and SDXL
+        }
+        return std::min(clip_skip - 1, num_hidden_layers - 1);
     }
 
-    struct ggml_tensor* forward(struct ggml_context* ctx, struct ggml_tensor* input_ids) {
+    struct ggml_tensor* final_layer_norm(struct ggml_context* ctx, struct ggml_tensor* x) {
+        x = ggml_norm(ctx, x);
+        x = ggml_add(ctx, ggml_mul(ctx, ggml_repeat(ctx, final_ln_w, x), x),
+                     ggml_repeat(ctx, final_ln_b, x));
+        return x;
+    }
+
+    struct ggml_tensor* forward(struct ggml_context* ctx,
+                                struct ggml_tensor* input_ids,
+                                struct ggml_tensor* token_embeds = NULL,
+                                int clip_skip = 0,
+                                struct ggml_tensor** pooled = NULL,
+                                int eos_pos = 0) {
         // input_ids: [N, n_token]
+        // token_embeds: [N, n_token, hidden_size], used instead of token_embed_weight lookup when prompt has custom words
+        // clip_skip: 1 = output of last layer, 2 = penultimate layer (A1111 "clip skip 2") and so on
+        // pooled: [projection_dim, ], set when given. Output of last layer at eos_pos projected with text_projection
         GGML_ASSERT(input_ids->ne[0] <= position_ids->ne[0]);
 
         // token_embedding + position_embedding
         struct ggml_tensor* x;
         x = ggml_add(ctx,
-                     ggml_get_rows(ctx, token_embed_weight, input_ids),
+                     token_embeds != NULL ? token_embeds : ggml_get_rows(ctx, token_embed_weight, input_ids),
                      ggml_get_rows(ctx,
                                    position_embed_weight,
                                    ggml_view_1d(ctx, position_ids, input_ids->ne[0], 0)));  // [N, n_token, hidden_size]
 
         // transformer
-        for (int i = 0; i < num_hidden_layers; i++) {
-            if (model_type == SD2 && i == num_hidden_layers - 1) {  // layer: "penultimate"
-                break;
-            }
+        int n_layers = num_hidden_layers - skipped_layers(clip_skip);
+        for (int i = 0; i < n_layers; i++) {
             x = resblocks[i].forward(ctx, x);  // [N, n_token, hidden_size]
         }
 
-        // final layer norm
-        {
-            x = ggml_norm(ctx, x);
+        if (pooled != NULL && text_projection != NULL) {
+            struct ggml_tensor* last = x;
+            for (int i = n_layers; i < num_hidden_layers; i++) {
+                last = resblocks[i].forward(ctx, last);
+            }
+            last = final_layer_norm(ctx, last);
+            last = ggml_view_1d(ctx, last, hidden_size, eos_pos * last->nb[1]);                            // [hidden_size, ]
+            *pooled = ggml_mul_mat(ctx, ggml_cont(ctx, ggml_transpose(ctx, text_projection)), last);  // [projection_dim, ]
+        }
 
-            x = ggml_add(ctx, ggml_mul(ctx, ggml_repeat(ctx, final_ln_w, x), x),
-                         ggml_repeat(ctx, final_ln_b, x));
+        // SDXL uses hidden states without final layer norm
+        if (model_type != SDXL) {
+            x = final_layer_norm(ctx, x);
         }
 
         return x;  // [N, n_token, hidden_size]
@@ -794,9 +1124,109 @@ struct FrozenCLIPEmbedderWithCustomWords {
     ModelType model_type = SD1;
     CLIPTokenizer tokenizer;
     CLIPTextModel text_model;
+    CLIPTextModel text_model2;  // SDXL only, open_clip bigG. Context is concatenation of both hidden states
+
+    // textual inversion embeddings. Token ids from vocab_size up refer to vectors in custom_vectors
+    std::map<std::string, std::vector<int>> custom_words;
+    std::vector<float> custom_vectors;
+    std::vector<float> custom_vectors2;  // SDXL, vectors for text_model2
 
     FrozenCLIPEmbedderWithCustomWords(ModelType model_type = SD1)
-        : model_type(model_type), tokenizer(model_type), text_model(model_type) {}
+        : model_type(model_type),
+          tokenizer(model_type),
+          text_model(model_type, model_type == SD2 ? OPEN_CLIP_VIT_H_14 : OPENAI_CLIP_VIT_L_14),
+          text_model2(model_type, OPEN_CLIP_VIT_BIGG_14) {}
+
+    // size of cross attention context, SDXL has hidden states of both text models
+    int context_dim() {
+        if (model_type == SDXL) {
+            return text_model.hidden_size + text_model2.hidden_size;
+        }
+        return text_model.hidden_size;
+    }
+
+    // vectors of SDXL embedding have text_model part followed by text_model2 part
+    bool add_custom_word(const std::string& name, const float* vectors, int n_vectors, int dim) {
+        if (dim != context_dim() || n_vectors <= 0) {
+            LOG_ERROR("embedding '%s' has %d vectors of size %d, text model needs size %d",
+                      name.c_str(), n_vectors, dim, context_dim());
+            return false;
+        }
+        std::string word = name;
+        std::transform(word.begin(), word.end(), word.begin(), [](unsigned char c) { return std::tolower(c); });
+
+        int hidden_size = text_model.hidden_size;
+        int first_id = text_model.vocab_size + (int)(custom_vectors.size() / hidden_size);
+        std::vector<int> ids;
+        for (int i = 0; i < n_vectors; i++) {
+            ids.push_back(first_id + i);
+            const float* vector = vectors + (size_t)i * dim;
+            custom_vectors.insert(custom_vectors.end(), vector, vector + hidden_size);
+            custom_vectors2.insert(custom_vectors2.end(), vector + hidden_size, vector + dim);
+        }
+        custom_words[word] = ids;
+        LOG_INFO("embedding '%s' added with %d vectors", word.c_str(), n_vectors);
+        return true;
+    }
+
+    // token text, custom tokens are shown as embedding name
+    std::string decode(int token_id) {
+        if (token_id < text_model.vocab_size) {
+            return tokenizer.decode(token_id);
+        }
+        for (auto& pair : custom_words) {
+            if (std::find(pair.second.begin(), pair.second.end(), token_id) != pair.second.end()) {
+                return pair.first;
+            }
+        }
+        return UNK_TOKEN;
+    }
+
+    bool has_custom_tokens(const std::vector<int>& tokens) {
+        for (int id : tokens) {
+            if (id >= text_model.vocab_size) {
+                return true;
+            }
+        }
+        return false;
+    }
+
+    // like tokenizer.encode but embedding names become their custom token ids
+    std::vector<int> encode_with_custom_words(const std::string& text) {
+        if (custom_words.empty()) {
+            return tokenizer.encode(text);
+        }
+        // longest names first, so that name can not match only beginning of other name
+        std::vector<std::string> words;
+        for (auto& pair : custom_words) {
+            words.push_back(pair.first);
+        }
+        std::sort(words.begin(), words.end(), [](const std::string& a, const std::string& b) { return a.size() > b.size(); });
+        std::string pattern;
+        for (const auto& word : words) {
+            if (!pattern.empty()) {
+                pattern += "|";
+            }
+            pattern += std::regex_replace(word, std::regex(R"([.^$|()\[\]{}*+?\\])"), R"(\$&)");
+        }
+        std::regex re_word("(^|[^[:alnum:]_])(" + pattern + ")(?=[^[:alnum:]_]|$)", std::regex::icase);
+
+        std::vector<int> tokens;
+        std::smatch m;
+        std::string remaining_text = text;
+        while (std::regex_search(remaining_text, m, re_word)) {
+            std::vector<int> prefix_tokens = tokenizer.encode(m.prefix().str() + m[1].str());
+            tokens.insert(tokens.end(), prefix_tokens.begin(), prefix_tokens.end());
+            std::string word = m[2];
+            std::transform(word.begin(), word.end(), word.begin(), [](unsigned char c) { return std::tolower(c); });
+            const std::vector<int>& ids = custom_words[word];
+            tokens.insert(tokens.end(), ids.begin(), ids.end());
+            remaining_text = m.suffix();
+        }
+        std::vector<int> rest_tokens = tokenizer.encode(remaining_text);
+        tokens.insert(tokens.end(), rest_tokens.begin(), rest_tokens.end());
+        return tokens;
+    }
 
     std::pair<std::vector<int>, std::vector<float>> tokenize(std::string text,
                                                              size_t max_length = 0,
@@ -816,9 +1246,12 @@ struct FrozenCLIPEmbedderWithCustomWords {
         std::vector<int> tokens;
         std::vector<float> weights;
         for (const auto& item : parsed_attention) {
+            if (is_prompt_break(item)) {
+                continue;
+            }
             const std::string& curr_text = item.first;
             float curr_weight = item.second;
-            std::vector<int> curr_tokens = tokenizer.encode(curr_text);
+            std::vector<int> curr_tokens = encode_with_custom_words(curr_text);
             tokens.insert(tokens.end(), curr_tokens.begin(), curr_tokens.end());
             weights.insert(weights.end(), curr_tokens.size(), curr_weight);
         }
@@ -852,6 +1285,76 @@ struct FrozenCLIPEmbedderWithCustomWords {
 
         return {tokens, weights};
     }
+
+    // Ref: https://github.com/AUTOMATIC1111/stable-diffusion-webui/blob/cad87bf4e3e0b0a759afa94e933527c3123d59bc/modules/sd_hijack_clip.py#L93
+    // Splits prompt to chunks of 75 tokens, each is BOS + tokens + EOS padded to 77. BREAK starts new chunk and
+    // full chunk is split after last comma if it is within 20 tokens from end. Empty chunks are added up to min_chunks
+    std::pair<std::vector<int>, std::vector<float>> tokenize_chunks(const std::string& text, int min_chunks = 1) {
+        const size_t chunk_len = text_model.max_position_embeddings - 2;
+        const size_t comma_backtrack = 20;
+        int pad_token_id = model_type == SD2 ? 0 : PAD_TOKEN_ID;
+        std::vector<int> comma_tokens = tokenizer.encode(",");
+        int comma_id = comma_tokens.empty() ? -1 : comma_tokens[0];
+
+        std::vector<int> tokens;
+        std::vector<float> weights;
+        std::vector<int> chunk_tokens;
+        std::vector<float> chunk_weights;
+        int last_comma = -1;
+
+        auto next_chunk = [&]() {
+            tokens.push_back(BOS_TOKEN_ID);
+            weights.push_back(1.0f);
+            tokens.insert(tokens.end(), chunk_tokens.begin(), chunk_tokens.end());
+            weights.insert(weights.end(), chunk_weights.begin(), chunk_weights.end());
+            tokens.push_back(EOS_TOKEN_ID);
+            weights.push_back(1.0f);
+            size_t padding = chunk_len - chunk_tokens.size();
+            tokens.insert(tokens.end(), padding, pad_token_id);
+            weights.insert(weights.end(), padding, 1.0f);
+            chunk_tokens.clear();
+            chunk_weights.clear();
+            last_comma = -1;
+        };
+
+        for (const auto& item : parse_prompt_attention(text)) {
+            if (is_prompt_break(item)) {
+                if (!chunk_tokens.empty()) {
+                    next_chunk();
+                }
+                continue;
+            }
+            std::vector<int> curr_tokens = encode_with_custom_words(item.first);
+            for (int token : curr_tokens) {
+                if (chunk_tokens.size() == chunk_len) {
+                    if (last_comma >= 0 && chunk_tokens.size() - (last_comma + 1) <= comma_backtrack) {
+                        // move words after comma to next chunk
+                        std::vector<int> rest_tokens(chunk_tokens.begin() + last_comma + 1, chunk_tokens.end());
+                        std::vector<float> rest_weights(chunk_weights.begin() + last_comma + 1, chunk_weights.end());
+                        chunk_tokens.resize(last_comma + 1);
+                        chunk_weights.resize(last_comma + 1);
+                        next_chunk();
+                        chunk_tokens = rest_tokens;
+                        chunk_weights = rest_weights;
+                    } else {
+                        next_chunk();
+                    }
+                }
+                if (token == comma_id) {
+                    last_comma = (int)chunk_tokens.size();
+                }
+                chunk_tokens.push_back(token);
+                chunk_weights.push_back(item.second);
+            }
+        }
+        if (!chunk_tokens.empty() || tokens.empty()) {
+            next_chunk();
+        }
+        while (tokens.size() < (size_t)min_chunks * text_model.max_position_embeddings) {
+            next_chunk();
+        }
+        return {tokens, weights};
+    }
 };
 
 /*==================================================== UnetModel =====================================================*/
@@ -1015,7 +1518,7 @@ struct SpatialTransformer {
     int in_channels;        // mult * model_channels
     int n_head;             // num_heads
     int d_head;             // in_channels // n_heads
-    int depth = 1;          // 1
+    int depth = 1;          // 1, up to 10 for SDXL
     int context_dim = 768;  // hidden_size, 1024 for SD2.x
 
     // group norm
@@ -1026,9 +1529,8 @@ struct SpatialTransformer {
     struct ggml_tensor* proj_in_w;  // [in_channels, in_channels, 1, 1]
     struct ggml_tensor* proj_in_b;  // [in_channels,]
 
-    // transformer
-    struct
-    {
+    // transformer blocks
+    struct TransformerBlock {
         // layer norm 1
         struct ggml_tensor* norm1_w;  // [in_channels, ]
         struct ggml_tensor* norm1_b;  // [in_channels, ]
@@ -1063,7 +1565,8 @@ struct SpatialTransformer {
 
         struct ggml_tensor* ff_2_w;  // [in_channels, in_channels * 4]
         struct ggml_tensor* ff_2_b;  // [in_channels,]
-    } transformer;
+    };
+    std::vector<TransformerBlock> transformers;
 
     // proj_out
     struct ggml_tensor* proj_out_w;  // [in_channels, in_channels, 1, 1]
@@ -1075,17 +1578,19 @@ struct SpatialTransformer {
         mem_size += 2 * in_channels * in_channels * 1 * 1 * ggml_type_sizef(GGML_TYPE_F16);  // proj_in_w/proj_out_w
         mem_size += 2 * in_channels * ggml_type_sizef(GGML_TYPE_F32);                        // proj_in_b/proj_out_b
 
-        // transformer
+        // transformer blocks
         {
-            mem_size += 6 * in_channels * ggml_type_sizef(GGML_TYPE_F32);            // norm1-3_w/b
-            mem_size += 6 * in_channels * in_channels * ggml_type_sizef(wtype);      // attn1_q/k/v/out_w attn2_q/out_w
-            mem_size += 2 * in_channels * context_dim * ggml_type_sizef(wtype);      // attn2_k/v_w
-            mem_size += in_channels * 4 * 2 * in_channels * ggml_type_sizef(wtype);  // ff_0_proj_w
-            mem_size += in_channels * 4 * 2 * ggml_type_sizef(GGML_TYPE_F32);        // ff_0_proj_b
-            mem_size += in_channels * 4 * in_channels * ggml_type_sizef(wtype);      // ff_2_w
-            mem_size += in_channels * ggml_type_sizef(GGML_TYPE_F32);                // ff_2_b
-        }
-        mem_size += 26 * ggml_tensor_overhead();  // object overhead
+            double block_size = 0;
+            block_size += 6 * in_channels * ggml_type_sizef(GGML_TYPE_F32);            // norm1-3_w/b
+            block_size += 6 * in_channels * in_channels * ggml_type_sizef(wtype);      // attn1_q/k/v/out_w attn2_q/out_w
+            block_size += 2 * in_channels * context_dim * ggml_type_sizef(wtype);      // attn2_k/v_w
+            block_size += in_channels * 4 * 2 * in_channels * ggml_type_sizef(wtype);  // ff_0_proj_w
+            block_size += in_channels * 4 * 2 * ggml_type_sizef(GGML_TYPE_F32);        // ff_0_proj_b
+            block_size += in_channels * 4 * in_channels * ggml_type_sizef(wtype);      // ff_2_w
+            block_size += in_channels * ggml_type_sizef(GGML_TYPE_F32);                // ff_2_b
+            mem_size += depth * block_size;
+        }
+        mem_size += (6 + 20 * depth) * ggml_tensor_overhead();  // object overhead
         return static_cast<size_t>(mem_size);
     }
 
@@ -1098,35 +1603,38 @@ struct SpatialTransformer {
         proj_out_w = ggml_new_tensor_4d(ctx, GGML_TYPE_F16, 1, 1, in_channels, in_channels);
         proj_out_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        // transformer
-        transformer.norm1_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
-        transformer.norm1_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+        // transformer blocks
+        transformers.resize(depth);
+        for (auto& transformer : transformers) {
+            transformer.norm1_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.norm1_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        transformer.attn1_q_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
-        transformer.attn1_k_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
-        transformer.attn1_v_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn1_q_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn1_k_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn1_v_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
 
-        transformer.attn1_out_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
-        transformer.attn1_out_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.attn1_out_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn1_out_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        transformer.norm2_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
-        transformer.norm2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.norm2_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.norm2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        transformer.attn2_q_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
-        transformer.attn2_k_w = ggml_new_tensor_2d(ctx, wtype, context_dim, in_channels);
-        transformer.attn2_v_w = ggml_new_tensor_2d(ctx, wtype, context_dim, in_channels);
+            transformer.attn2_q_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn2_k_w = ggml_new_tensor_2d(ctx, wtype, context_dim, in_channels);
+            transformer.attn2_v_w = ggml_new_tensor_2d(ctx, wtype, context_dim, in_channels);
 
-        transformer.attn2_out_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
-        transformer.attn2_out_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.attn2_out_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels);
+            transformer.attn2_out_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        transformer.norm3_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
-        transformer.norm3_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.norm3_w = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.norm3_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
 
-        transformer.ff_0_proj_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels * 4 * 2);
-        transformer.ff_0_proj_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels * 4 * 2);
+            transformer.ff_0_proj_w = ggml_new_tensor_2d(ctx, wtype, in_channels, in_channels * 4 * 2);
+            transformer.ff_0_proj_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels * 4 * 2);
 
-        transformer.ff_2_w = ggml_new_tensor_2d(ctx, wtype, in_channels * 4, in_channels);
-        transformer.ff_2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+            transformer.ff_2_w = ggml_new_tensor_2d(ctx, wtype, in_channels * 4, in_channels);
+            transformer.ff_2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, in_channels);
+        }
     }
 
     void map_by_name(std::map<std::string, struct ggml_tensor*>& tensors, const std::string prefix) {
@@ -1135,9 +1643,10 @@ struct SpatialTransformer {
         tensors[prefix + "proj_in.weight"] = proj_in_w;
         tensors[prefix + "proj_in.bias"] = proj_in_b;
 
-        // transformer
-        {
-            std::string transformer_prefix = prefix + "transformer_blocks.0.";
+        // transformer blocks
+        for (int i = 0; i < depth; i++) {
+            auto& transformer = transformers[i];
+            std::string transformer_prefix = prefix + "transformer_blocks." + std::to_string(i) + ".";
             tensors[transformer_prefix + "attn1.to_q.weight"] = transformer.attn1_q_w;
             tensors[transformer_prefix + "attn1.to_k.weight"] = transformer.attn1_k_w;
             tensors[transformer_prefix + "attn1.to_v.weight"] = transformer.attn1_v_w;
@@ -1195,7 +1704,7 @@ struct SpatialTransformer {
         const int64_t max_position = context->ne[1];
         x = ggml_cont(ctx, ggml_permute(ctx, x, 1, 2, 0, 3));  // [N, h, w, in_channels]
 
-        {
+        for (auto& transformer : transformers) {
             auto r = x;
             // layer norm 1
             {
@@ -1404,9 +1913,9 @@ struct DownSample {
                                int ith,
                                int nth,
                                void* userdata) {
-        assert(sizeof(dst->nb[0]) == sizeof(float));
-        assert(sizeof(a->nb[0]) == sizeof(float));
-        assert(sizeof(b->nb[0]) == sizeof(float));
+        assert(dst->nb[0] == sizeof(float));
+        assert(a->nb[0] == sizeof(float));
+        assert(b->nb[0] == sizeof(float));
         float value = 0;
 
         for (int i = 0; i < dst->ne[3]; i++) {
@@ -1496,12 +2005,14 @@ struct UNetModel {
     int model_channels = 320;
     int out_channels = 4;
     int num_res_blocks = 2;
-    int attention_resolutions[3] = {4, 2, 1};
-    int channel_mult[4] = {1, 2, 4, 4};
+    std::vector<int> attention_resolutions = {4, 2, 1};
+    std::vector<int> channel_mult = {1, 2, 4, 4};
+    std::vector<int> transformer_depth = {1, 1, 1, 1};
     int time_embed_dim = 1280;  // model_channels*4
     int num_heads = 8;
     int num_head_channels = -1;  // channels // num_heads
-    int context_dim = 768;       // 1024 for SD2.x
+    int context_dim = 768;       // 1024 for SD2.x, 2048 for SDXL
+    int adm_in_channels = 0;     // 2816 for SDXL, 0 means no label_emb
 
     // network params
     struct ggml_tensor* time_embed_0_w;  // [time_embed_dim, model_channels]
@@ -1510,6 +2021,13 @@ struct UNetModel {
     struct ggml_tensor* time_embed_2_w;  // [time_embed_dim, time_embed_dim]
     struct ggml_tensor* time_embed_2_b;  // [time_embed_dim, ]
 
+    // SDXL only
+    struct ggml_tensor* label_emb_0_0_w = NULL;  // [time_embed_dim, adm_in_channels]
+    struct ggml_tensor* label_emb_0_0_b = NULL;  // [time_embed_dim, ]
+    // label_emb_0_1 is nn.SILU()
+    struct ggml_tensor* label_emb_0_2_w = NULL;  // [time_embed_dim, time_embed_dim]
+    struct ggml_tensor* label_emb_0_2_b = NULL;  // [time_embed_dim, ]
+
     struct ggml_tensor* input_block_0_w;  // [model_channels, in_channels, 3, 3]
     struct ggml_tensor* input_block_0_b;  // [model_channels, ]
 
@@ -1541,6 +2059,14 @@ struct UNetModel {
             context_dim = 1024;
             num_head_channels = 64;
             num_heads = -1;
+        } else if (model_type == SDXL) {
+            context_dim = 2048;
+            num_head_channels = 64;
+            num_heads = -1;
+            attention_resolutions = {4, 2};
+            channel_mult = {1, 2, 4};
+            transformer_depth = {1, 2, 10};
+            adm_in_channels = 2816;
         }
         // set up hparams of blocks
 
@@ -1550,7 +2076,7 @@ struct UNetModel {
         int ch = model_channels;
         int ds = 1;
 
-        int len_mults = sizeof(channel_mult) / sizeof(int);
+        int len_mults = channel_mult.size();
         for (int i = 0; i < len_mults; i++) {
             int mult = channel_mult[i];
             for (int j = 0; j < num_res_blocks; j++) {
@@ -1560,7 +2086,7 @@ struct UNetModel {
 
                 ch = mult * model_channels;
 
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     int n_head = num_heads;
                     int d_head = ch / num_heads;
                     if (num_head_channels != -1) {
@@ -1571,6 +2097,7 @@ struct UNetModel {
                     input_transformers[i][j].n_head = n_head;
                     input_transformers[i][j].d_head = d_head;
                     input_transformers[i][j].context_dim = context_dim;
+                    input_transformers[i][j].depth = transformer_depth[i];
                 }
                 input_block_chans.push_back(ch);
             }
@@ -1598,6 +2125,7 @@ struct UNetModel {
         middle_block_1.n_head = n_head;
         middle_block_1.d_head = d_head;
         middle_block_1.context_dim = context_dim;
+        middle_block_1.depth = transformer_depth.back();
 
         middle_block_2.channels = ch;
         middle_block_2.emb_channels = time_embed_dim;
@@ -1616,7 +2144,7 @@ struct UNetModel {
 
                 ch = mult * model_channels;
 
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     int n_head = num_heads;
                     int d_head = ch / num_heads;
                     if (num_head_channels != -1) {
@@ -1627,6 +2155,7 @@ struct UNetModel {
                     output_transformers[i][j].n_head = n_head;
                     output_transformers[i][j].d_head = d_head;
                     output_transformers[i][j].context_dim = context_dim;
+                    output_transformers[i][j].depth = transformer_depth[i];
                 }
 
                 if (i > 0 && j == num_res_blocks) {
@@ -1639,6 +2168,15 @@ struct UNetModel {
         }
     }
 
+    bool has_attention(int ds) {
+        for (int res : attention_resolutions) {
+            if (ds == res) {
+                return true;
+            }
+        }
+        return false;
+    }
+
     size_t compute_params_mem_size(ggml_type wtype) {
         double mem_size = 0;
         mem_size += time_embed_dim * model_channels * ggml_type_sizef(wtype);  // time_embed_0_w
@@ -1651,13 +2189,20 @@ struct UNetModel {
 
         mem_size += 6 * ggml_tensor_overhead();  // object overhead
 
+        if (adm_in_channels > 0) {
+            mem_size += time_embed_dim * adm_in_channels * ggml_type_sizef(wtype);  // label_emb_0_0_w
+            mem_size += time_embed_dim * time_embed_dim * ggml_type_sizef(wtype);   // label_emb_0_2_w
+            mem_size += 2 * time_embed_dim * ggml_type_sizef(GGML_TYPE_F32);        // label_emb_0_0_b/label_emb_0_2_b
+            mem_size += 4 * ggml_tensor_overhead();
+        }
+
         // input_blocks
         int ds = 1;
-        int len_mults = sizeof(channel_mult) / sizeof(int);
+        int len_mults = channel_mult.size();
         for (int i = 0; i < len_mults; i++) {
             for (int j = 0; j < num_res_blocks; j++) {
                 mem_size += input_res_blocks[i][j].compute_params_mem_size(wtype);
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     mem_size += input_transformers[i][j].compute_params_mem_size(wtype);
                 }
             }
@@ -1677,7 +2222,7 @@ struct UNetModel {
             for (int j = 0; j < num_res_blocks + 1; j++) {
                 mem_size += output_res_blocks[i][j].compute_params_mem_size(wtype);
 
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     mem_size += output_transformers[i][j].compute_params_mem_size(wtype);
                 }
 
@@ -1706,15 +2251,22 @@ struct UNetModel {
         time_embed_2_w = ggml_new_tensor_2d(ctx, wtype, time_embed_dim, time_embed_dim);
         time_embed_2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, time_embed_dim);
 
+        if (adm_in_channels > 0) {
+            label_emb_0_0_w = ggml_new_tensor_2d(ctx, wtype, adm_in_channels, time_embed_dim);
+            label_emb_0_0_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, time_embed_dim);
+            label_emb_0_2_w = ggml_new_tensor_2d(ctx, wtype, time_embed_dim, time_embed_dim);
+            label_emb_0_2_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, time_embed_dim);
+        }
+
         // input_blocks
         input_block_0_w = ggml_new_tensor_4d(ctx, GGML_TYPE_F16, 3, 3, in_channels, model_channels);
         input_block_0_b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, model_channels);
         int ds = 1;
-        int len_mults = sizeof(channel_mult) / sizeof(int);
+        int len_mults = channel_mult.size();
         for (int i = 0; i < len_mults; i++) {
             for (int j = 0; j < num_res_blocks; j++) {
                 input_res_blocks[i][j].init_params(ctx, wtype);
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     input_transformers[i][j].init_params(ctx, wtype);
                 }
             }
@@ -1734,7 +2286,7 @@ struct UNetModel {
             for (int j = 0; j < num_res_blocks + 1; j++) {
                 output_res_blocks[i][j].init_params(ctx, wtype);
 
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     output_transformers[i][j].init_params(ctx, wtype);
                 }
 
@@ -1761,11 +2313,18 @@ struct UNetModel {
         tensors[prefix + "time_embed.2.weight"] = time_embed_2_w;
         tensors[prefix + "time_embed.2.bias"] = time_embed_2_b;
 
+        if (adm_in_channels > 0) {
+            tensors[prefix + "label_emb.0.0.weight"] = label_emb_0_0_w;
+            tensors[prefix + "label_emb.0.0.bias"] = label_emb_0_0_b;
+            tensors[prefix + "label_emb.0.2.weight"] = label_emb_0_2_w;
+            tensors[prefix + "label_emb.0.2.bias"] = label_emb_0_2_b;
+        }
+
         // input_blocks
         tensors[prefix + "input_blocks.0.0.weight"] = input_block_0_w;
         tensors[prefix + "input_blocks.0.0.bias"] = input_block_0_b;
 
-        int len_mults = sizeof(channel_mult) / sizeof(int);
+        int len_mults = channel_mult.size();
         int input_block_idx = 0;
         int ds = 1;
         for (int i = 0; i < len_mults; i++) {
@@ -1773,7 +2332,7 @@ struct UNetModel {
                 input_block_idx += 1;
 
                 input_res_blocks[i][j].map_by_name(tensors, prefix + "input_blocks." + std::to_string(input_block_idx) + ".0.");
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     input_transformers[i][j].map_by_name(tensors, prefix + "input_blocks." + std::to_string(input_block_idx) + ".1.");
                 }
             }
@@ -1796,7 +2355,7 @@ struct UNetModel {
                 output_res_blocks[i][j].map_by_name(tensors, prefix + "output_blocks." + std::to_string(output_block_idx) + ".0.");
 
                 int up_sample_idx = 1;
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     output_transformers[i][j].map_by_name(tensors, prefix + "output_blocks." + std::to_string(output_block_idx) + ".1.");
                     up_sample_idx++;
                 }
@@ -1821,11 +2380,13 @@ struct UNetModel {
                                 struct ggml_tensor* x,
                                 struct ggml_tensor* timesteps,
                                 struct ggml_tensor* context,
-                                struct ggml_tensor* t_emb = NULL) {
+                                struct ggml_tensor* t_emb = NULL,
+                                struct ggml_tensor* y = NULL) {
         // x: [N, in_channels, h, w]
         // timesteps: [N, ]
         // t_emb: [N, model_channels]
         // context: [N, max_position, hidden_size]([N, 77, 768])
+        // y: [N, adm_in_channels], SDXL pooled text embedding + size conditioning
         if (t_emb == NULL && timesteps != NULL) {
             t_emb = new_timestep_embedding(ctx, timesteps, model_channels);  // [N, model_channels]
         }
@@ -1837,6 +2398,16 @@ struct UNetModel {
         emb = ggml_mul_mat(ctx, time_embed_2_w, emb);
         emb = ggml_add(ctx, ggml_repeat(ctx, time_embed_2_b, emb), emb);  // [N, time_embed_dim]
 
+        // label_emb
+        if (y != NULL && adm_in_channels > 0) {
+            auto label_emb = ggml_mul_mat(ctx, label_emb_0_0_w, y);
+            label_emb = ggml_add(ctx, ggml_repeat(ctx, label_emb_0_0_b, label_emb), label_emb);
+            label_emb = ggml_silu_inplace(ctx, label_emb);
+            label_emb = ggml_mul_mat(ctx, label_emb_0_2_w, label_emb);
+            label_emb = ggml_add(ctx, ggml_repeat(ctx, label_emb_0_2_b, label_emb), label_emb);  // [N, time_embed_dim]
+            emb = ggml_add(ctx, emb, label_emb);
+        }
+
         // input_blocks
         std::vector<struct ggml_tensor*> hs;
         // input block 0
@@ -1848,13 +2419,13 @@ struct UNetModel {
                                  h));  // [N, model_channels, h, w]
         hs.push_back(h);
         // input block 1-11
-        int len_mults = sizeof(channel_mult) / sizeof(int);
+        int len_mults = channel_mult.size();
         int ds = 1;
         for (int i = 0; i < len_mults; i++) {
             int mult = channel_mult[i];
             for (int j = 0; j < num_res_blocks; j++) {
                 h = input_res_blocks[i][j].forward(ctx, h, emb);  // [N, mult*model_channels, h, w]
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     h = input_transformers[i][j].forward(ctx, h, context);  // [N, mult*model_channels, h, w]
                 }
                 hs.push_back(h);
@@ -1881,7 +2452,7 @@ struct UNetModel {
                 h = ggml_concat(ctx, h, h_skip);
                 h = output_res_blocks[i][j].forward(ctx, h, emb);
 
-                if (ds == attention_resolutions[0] || ds == attention_resolutions[1] || ds == attention_resolutions[2]) {
+                if (has_attention(ds)) {
                     h = output_transformers[i][j].forward(ctx, h, context);
                 }
 
@@ -2650,75 +3221,282 @@ struct AutoEncoderKL {
     }
 };
 
-/*================================================= CompVisDenoiser ==================================================*/
+/*================================================= TinyAutoEncoder ==================================================*/
 
-// Ref: https://github.com/crowsonkb/k-diffusion/blob/master/k_diffusion/external.py
+// Ref: https://github.com/madebyollin/taesd
+// Tiny autoencoder for fast decode of drafts and previews. Latents are same as unet ones (scaled), image is in [0, 1]
 
-struct SigmaSchedule {
-    float alphas_cumprod[TIMESTEPS];
-    float sigmas[TIMESTEPS];
-    float log_sigmas[TIMESTEPS];
+struct TAEConv {
+    int in_channels;
+    int out_channels;
+    int stride = 1;
+    bool bias = true;
 
-    virtual std::vector<float> get_sigmas(uint32_t n) = 0;
+    struct ggml_tensor* w;  // [out_channels, in_channels, 3, 3]
+    struct ggml_tensor* b;  // [out_channels, ]
 
-    float sigma_to_t(float sigma) {
-        float log_sigma = std::log(sigma);
-        std::vector<float> dists;
-        dists.reserve(TIMESTEPS);
-        for (float log_sigma_val : log_sigmas) {
-            dists.push_back(log_sigma - log_sigma_val);
-        }
+    size_t compute_params_mem_size() {
+        double mem_size = 0;
+        mem_size += out_channels * in_channels * 3 * 3 * ggml_type_sizef(GGML_TYPE_F16);  // w
+        mem_size += out_channels * ggml_type_sizef(GGML_TYPE_F32);                        // b
+        mem_size += 2 * ggml_tensor_overhead();                                           // object overhead
+        return static_cast<size_t>(mem_size);
+    }
 
-        int low_idx = 0;
-        for (size_t i = 0; i < TIMESTEPS; i++) {
-            if (dists[i] >= 0) {
-                low_idx++;
-            }
+    void init_params(struct ggml_context* ctx) {
+        w = ggml_new_tensor_4d(ctx, GGML_TYPE_F16, 3, 3, in_channels, out_channels);
+        if (bias) {
+            b = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, out_channels);
         }
-        low_idx = std::min(std::max(low_idx - 1, 0), TIMESTEPS - 2);
-        int high_idx = low_idx + 1;
-
-        float low = log_sigmas[low_idx];
-        float high = log_sigmas[high_idx];
-        float w = (low - log_sigma) / (low - high);
-        w = std::max(0.f, std::min(1.f, w));
-        float t = (1.0f - w) * low_idx + w * high_idx;
+    }
 
-        return t;
+    void map_by_name(std::map<std::string, struct ggml_tensor*>& tensors, const std::string prefix) {
+        tensors[prefix + "weight"] = w;
+        if (bias) {
+            tensors[prefix + "bias"] = b;
+        }
     }
 
-    float t_to_sigma(float t) {
-        int low_idx = static_cast<int>(std::floor(t));
-        int high_idx = static_cast<int>(std::ceil(t));
-        float w = t - static_cast<float>(low_idx);
-        float log_sigma = (1.0f - w) * log_sigmas[low_idx] + w * log_sigmas[high_idx];
-        return std::exp(log_sigma);
+    struct ggml_tensor* forward(struct ggml_context* ctx, struct ggml_tensor* x) {
+        // x: [N, in_channels, h, w]
+        x = ggml_conv_2d(ctx, w, x, stride, stride, 1, 1, 1, 1);
+        if (bias) {
+            x = ggml_add(ctx,
+                         x,
+                         ggml_repeat(ctx,
+                                     ggml_reshape_4d(ctx, b, 1, 1, b->ne[0], 1),
+                                     x));  // [N, out_channels, h/stride, w/stride]
+        }
+        return x;
     }
 };
 
-struct DiscreteSchedule : SigmaSchedule {
-    std::vector<float> get_sigmas(uint32_t n) {
-        std::vector<float> result;
+// conv, relu, conv, relu, conv and relu of sum with input. Channels do not change, so skip is identity
+struct TAEBlock {
+    int channels = 64;
+    TAEConv convs[3];
 
-        int t_max = TIMESTEPS - 1;
+    TAEBlock() {
+        for (int i = 0; i < 3; i++) {
+            convs[i].in_channels = channels;
+            convs[i].out_channels = channels;
+        }
+    }
 
-        if (n == 0) {
-            return result;
-        } else if (n == 1) {
-            result.push_back(t_to_sigma(t_max));
-            result.push_back(0);
-            return result;
+    void init_params(struct ggml_context* ctx) {
+        for (int i = 0; i < 3; i++) {
+            convs[i].init_params(ctx);
         }
+    }
 
-        float step = static_cast<float>(t_max) / static_cast<float>(n - 1);
-        for (int i = 0; i < n; ++i) {
-            float t = t_max - step * i;
-            result.push_back(t_to_sigma(t));
+    size_t compute_params_mem_size() {
+        size_t mem_size = 0;
+        for (int i = 0; i < 3; i++) {
+            mem_size += convs[i].compute_params_mem_size();
         }
-        result.push_back(0);
-        return result;
+        return mem_size;
     }
-};
+
+    void map_by_name(std::map<std::string, struct ggml_tensor*>& tensors, const std::string prefix) {
+        convs[0].map_by_name(tensors, prefix + "conv.0.");
+        convs[1].map_by_name(tensors, prefix + "conv.2.");
+        convs[2].map_by_name(tensors, prefix + "conv.4.");
+    }
+
+    struct ggml_tensor* forward(struct ggml_context* ctx, struct ggml_tensor* x) {
+        auto h = ggml_relu_inplace(ctx, convs[0].forward(ctx, x));
+        h = ggml_relu_inplace(ctx, convs[1].forward(ctx, h));
+        h = convs[2].forward(ctx, h);
+        return ggml_relu_inplace(ctx, ggml_add(ctx, h, x));
+    }
+};
+
+struct TinyAutoEncoder {
+    static const int channels = 64;
+    static const int latent_channels = 4;
+
+    // decoder, names are indexes of torch Sequential: 0 clamp, 1 conv, 2 relu, 3-5 blocks, 6 upsample, 7 conv...
+    TAEConv dec_conv_in;     // 1
+    TAEBlock dec_blocks[10];  // 3,4,5 8,9,10 13,14,15 18
+    TAEConv dec_up_convs[3];  // 7, 12, 17. No bias
+    TAEConv dec_conv_out;    // 19
+
+    // encoder: 0 conv, 1 block, 2 strided conv, 3-5 blocks, 6 strided conv...
+    TAEConv enc_conv_in;       // 0
+    TAEBlock enc_blocks[10];    // 1 3,4,5 7,8,9 11,12,13
+    TAEConv enc_down_convs[3];  // 2, 6, 10. Stride 2, no bias
+    TAEConv enc_conv_out;      // 14
+
+    TinyAutoEncoder() {
+        dec_conv_in.in_channels = latent_channels;
+        dec_conv_in.out_channels = channels;
+        dec_conv_out.in_channels = channels;
+        dec_conv_out.out_channels = 3;
+        enc_conv_in.in_channels = 3;
+        enc_conv_in.out_channels = channels;
+        enc_conv_out.in_channels = channels;
+        enc_conv_out.out_channels = latent_channels;
+        for (int i = 0; i < 3; i++) {
+            dec_up_convs[i].in_channels = channels;
+            dec_up_convs[i].out_channels = channels;
+            dec_up_convs[i].bias = false;
+            enc_down_convs[i].in_channels = channels;
+            enc_down_convs[i].out_channels = channels;
+            enc_down_convs[i].stride = 2;
+            enc_down_convs[i].bias = false;
+        }
+    }
+
+    size_t compute_params_mem_size() {
+        size_t mem_size = 0;
+        mem_size += dec_conv_in.compute_params_mem_size() + dec_conv_out.compute_params_mem_size();
+        mem_size += enc_conv_in.compute_params_mem_size() + enc_conv_out.compute_params_mem_size();
+        for (int i = 0; i < 10; i++) {
+            mem_size += dec_blocks[i].compute_params_mem_size() + enc_blocks[i].compute_params_mem_size();
+        }
+        for (int i = 0; i < 3; i++) {
+            mem_size += dec_up_convs[i].compute_params_mem_size() + enc_down_convs[i].compute_params_mem_size();
+        }
+        return mem_size;
+    }
+
+    void init_params(struct ggml_context* ctx) {
+        dec_conv_in.init_params(ctx);
+        dec_conv_out.init_params(ctx);
+        enc_conv_in.init_params(ctx);
+        enc_conv_out.init_params(ctx);
+        for (int i = 0; i < 10; i++) {
+            dec_blocks[i].init_params(ctx);
+            enc_blocks[i].init_params(ctx);
+        }
+        for (int i = 0; i < 3; i++) {
+            dec_up_convs[i].init_params(ctx);
+            enc_down_convs[i].init_params(ctx);
+        }
+    }
+
+    void map_by_name(std::map<std::string, struct ggml_tensor*>& tensors, const std::string prefix) {
+        dec_conv_in.map_by_name(tensors, prefix + "decoder.1.");
+        for (int i = 0; i < 3; i++) {
+            for (int j = 0; j < 3; j++) {
+                dec_blocks[i * 3 + j].map_by_name(tensors, prefix + "decoder." + std::to_string(3 + i * 5 + j) + ".");
+            }
+            dec_up_convs[i].map_by_name(tensors, prefix + "decoder." + std::to_string(7 + i * 5) + ".");
+        }
+        dec_blocks[9].map_by_name(tensors, prefix + "decoder.18.");
+        dec_conv_out.map_by_name(tensors, prefix + "decoder.19.");
+
+        enc_conv_in.map_by_name(tensors, prefix + "encoder.0.");
+        enc_blocks[0].map_by_name(tensors, prefix + "encoder.1.");
+        for (int i = 0; i < 3; i++) {
+            enc_down_convs[i].map_by_name(tensors, prefix + "encoder." + std::to_string(2 + i * 4) + ".");
+            for (int j = 0; j < 3; j++) {
+                enc_blocks[1 + i * 3 + j].map_by_name(tensors, prefix + "encoder." + std::to_string(3 + i * 4 + j) + ".");
+            }
+        }
+        enc_conv_out.map_by_name(tensors, prefix + "encoder.14.");
+    }
+
+    struct ggml_tensor* decode(struct ggml_context* ctx, struct ggml_tensor* z) {
+        // z: [N, latent_channels, h, w]
+        // clamp: tanh(z / 3) * 3
+        auto h = ggml_scale(ctx, z, ggml_new_f32(ctx, 1.0f / 3));
+        h = ggml_scale_inplace(ctx, ggml_tanh_inplace(ctx, h), ggml_new_f32(ctx, 3.0f));
+        h = ggml_relu_inplace(ctx, dec_conv_in.forward(ctx, h));
+        for (int i = 0; i < 3; i++) {
+            for (int j = 0; j < 3; j++) {
+                h = dec_blocks[i * 3 + j].forward(ctx, h);
+            }
+            h = ggml_upscale(ctx, h, 2);
+            h = dec_up_convs[i].forward(ctx, h);
+        }
+        h = dec_blocks[9].forward(ctx, h);
+        return dec_conv_out.forward(ctx, h);  // [N, 3, h*8, w*8]
+    }
+
+    struct ggml_tensor* encode(struct ggml_context* ctx, struct ggml_tensor* x) {
+        // x: [N, 3, h, w]
+        auto h = enc_conv_in.forward(ctx, x);
+        h = enc_blocks[0].forward(ctx, h);
+        for (int i = 0; i < 3; i++) {
+            h = enc_down_convs[i].forward(ctx, h);
+            for (int j = 0; j < 3; j++) {
+                h = enc_blocks[1 + i * 3 + j].forward(ctx, h);
+            }
+        }
+        return enc_conv_out.forward(ctx, h);  // [N, latent_channels, h/8, w/8]
+    }
+};
+
+/*================================================= CompVisDenoiser ==================================================*/
+
+// Ref: https://github.com/crowsonkb/k-diffusion/blob/master/k_diffusion/external.py
+
+struct SigmaSchedule {
+    float alphas_cumprod[TIMESTEPS];
+    float sigmas[TIMESTEPS];
+    float log_sigmas[TIMESTEPS];
+
+    virtual std::vector<float> get_sigmas(uint32_t n) = 0;
+
+    float sigma_to_t(float sigma) {
+        float log_sigma = std::log(sigma);
+        std::vector<float> dists;
+        dists.reserve(TIMESTEPS);
+        for (float log_sigma_val : log_sigmas) {
+            dists.push_back(log_sigma - log_sigma_val);
+        }
+
+        int low_idx = 0;
+        for (size_t i = 0; i < TIMESTEPS; i++) {
+            if (dists[i] >= 0) {
+                low_idx++;
+            }
+        }
+        low_idx = std::min(std::max(low_idx - 1, 0), TIMESTEPS - 2);
+        int high_idx = low_idx + 1;
+
+        float low = log_sigmas[low_idx];
+        float high = log_sigmas[high_idx];
+        float w = (low - log_sigma) / (low - high);
+        w = std::max(0.f, std::min(1.f, w));
+        float t = (1.0f - w) * low_idx + w * high_idx;
+
+        return t;
+    }
+
+    float t_to_sigma(float t) {
+        int low_idx = static_cast<int>(std::floor(t));
+        int high_idx = static_cast<int>(std::ceil(t));
+        float w = t - static_cast<float>(low_idx);
+        float log_sigma = (1.0f - w) * log_sigmas[low_idx] + w * log_sigmas[high_idx];
+        return std::exp(log_sigma);
+    }
+};
+
+struct DiscreteSchedule : SigmaSchedule {
+    std::vector<float> get_sigmas(uint32_t n) {
+        std::vector<float> result;
+
+        int t_max = TIMESTEPS - 1;
+
+        if (n == 0) {
+            return result;
+        } else if (n == 1) {
+            result.push_back(t_to_sigma(t_max));
+            result.push_back(0);
+            return result;
+        }
+
+        float step = static_cast<float>(t_max) / static_cast<float>(n - 1);
+        for (int i = 0; i < n; ++i) {
+            float t = t_max - step * i;
+            result.push_back(t_to_sigma(t));
+        }
+        result.push_back(0);
+        return result;
+    }
+};
 
 struct KarrasSchedule : SigmaSchedule {
     std::vector<float> get_sigmas(uint32_t n) {
@@ -2767,6 +3545,218 @@ struct CompVisVDenoiser : public Denoiser {
     }
 };
 
+// Dynamic thresholding, ref: https://github.com/mcmonkeyprojects/sd-dynamic-thresholding
+// uncond and diff are denoised uncond and (cond - uncond) as [W*H, C]. Result of cfg_scale is centered per channel,
+// clamped to percentile and rescaled to range that mimic_scale would give.
+static void dynamic_thresholding(float* result,
+                                 const float* uncond,
+                                 const float* diff,
+                                 int64_t channel_size,
+                                 int64_t channels,
+                                 float cfg_scale,
+                                 float mimic_scale,
+                                 float percentile) {
+    std::vector<float> centered(channel_size);
+    std::vector<float> abs_values(channel_size);
+    for (int64_t ch = 0; ch < channels; ch++) {
+        const float* u = uncond + ch * channel_size;
+        const float* d = diff + ch * channel_size;
+        float* r = result + ch * channel_size;
+
+        double mim_mean = 0;
+        double cfg_mean = 0;
+        for (int64_t i = 0; i < channel_size; i++) {
+            mim_mean += u[i] + mimic_scale * d[i];
+            cfg_mean += u[i] + cfg_scale * d[i];
+        }
+        mim_mean /= channel_size;
+        cfg_mean /= channel_size;
+
+        float mim_max = 0.f;
+        for (int64_t i = 0; i < channel_size; i++) {
+            mim_max = std::max(mim_max, std::fabs(u[i] + mimic_scale * d[i] - (float)mim_mean));
+            centered[i] = u[i] + cfg_scale * d[i] - (float)cfg_mean;
+            abs_values[i] = std::fabs(centered[i]);
+        }
+        int64_t k = std::min(channel_size - 1, (int64_t)(percentile * (channel_size - 1)));
+        std::nth_element(abs_values.begin(), abs_values.begin() + k, abs_values.end());
+        float cfg_max = std::max(abs_values[k], mim_max);
+
+        for (int64_t i = 0; i < channel_size; i++) {
+            float v = std::max(-cfg_max, std::min(centered[i], cfg_max));
+            r[i] = (cfg_max > 0.f ? v / cfg_max * mim_max : v) + (float)cfg_mean;
+        }
+    }
+}
+
+// CFG rescale, ref: "Common Diffusion Noise Schedules are Flawed" 3.4
+// Guided result is scaled to std of cond and mixed with original by phi
+static void rescale_cfg(float* result, const float* cond, int64_t n, float phi) {
+    auto stddev = [n](const float* v) {
+        double sum = 0;
+        double sum_sq = 0;
+        for (int64_t i = 0; i < n; i++) {
+            sum += v[i];
+            sum_sq += (double)v[i] * v[i];
+        }
+        double mean = sum / n;
+        return std::sqrt(std::max(0.0, sum_sq / n - mean * mean));
+    };
+    double std_cfg = stddev(result);
+    if (std_cfg == 0) {
+        return;
+    }
+    float factor = (float)(stddev(cond) / std_cfg);
+    for (int64_t i = 0; i < n; i++) {
+        result[i] = phi * result[i] * factor + (1 - phi) * result[i];
+    }
+}
+
+std::vector<float> cfg_scale_schedule(const SDParams& params, int steps) {
+    std::vector<float> result(steps, params.cfg_scale);
+    for (int i = 0; i < steps; i++) {
+        float t = steps > 1 ? (float)i / (steps - 1) : 0.f;
+        if (!params.cfg_scales.empty()) {
+            result[i] = params.cfg_scales[std::min((size_t)i, params.cfg_scales.size() - 1)];
+        } else if (params.cfg_schedule == CFG_LINEAR) {
+            result[i] = params.cfg_scale + (params.cfg_scale_end - params.cfg_scale) * t;
+        } else if (params.cfg_schedule == CFG_COSINE) {
+            float pi = std::acos(-1.0f);
+            result[i] = params.cfg_scale_end + (params.cfg_scale - params.cfg_scale_end) * 0.5f * (1 + std::cos(pi * t));
+        }
+        if (params.cfg_stop_at < 1.0f && params.cfg_stop_at * steps <= i) {
+            result[i] = 1.0f;
+        }
+    }
+    return result;
+}
+
+static bool has_guidance(const std::vector<float>& cfg_scales) {
+    for (float scale : cfg_scales) {
+        if (scale != 1.0f) {
+            return true;
+        }
+    }
+    return false;
+}
+
+// spherical interpolation from low to high, linear when vectors are almost parallel
+static std::vector<float> slerp(float t, const std::vector<float>& low, const std::vector<float>& high) {
+    double dot = 0;
+    double low_norm = 0;
+    double high_norm = 0;
+    for (size_t i = 0; i < low.size(); i++) {
+        dot += (double)low[i] * high[i];
+        low_norm += (double)low[i] * low[i];
+        high_norm += (double)high[i] * high[i];
+    }
+    double cos_omega = dot / std::sqrt(low_norm * high_norm);
+    float a = 1 - t;
+    float b = t;
+    if (std::fabs(cos_omega) < 0.9995) {
+        double omega = std::acos(cos_omega);
+        a = (float)(std::sin((1 - t) * omega) / std::sin(omega));
+        b = (float)(std::sin(t * omega) / std::sin(omega));
+    }
+    std::vector<float> result(low.size());
+    for (size_t i = 0; i < low.size(); i++) {
+        result[i] = a * low[i] + b * high[i];
+    }
+    return result;
+}
+
+// noise from NoiseCallback, keeps track of position in stream
+class CallbackRNG : public RNG {
+   private:
+    NoiseCallback callback;
+    uintptr_t user_data;
+    int64_t seed = 0;
+    uint64_t offset = 0;
+
+   public:
+    CallbackRNG(NoiseCallback callback, uintptr_t user_data)
+        : callback(callback), user_data(user_data) {}
+
+    void manual_seed(uint64_t seed) {
+        this->seed = (int64_t)seed;
+        offset = 0;
+    }
+
+    std::vector<float> randn(uint32_t n) {
+        std::vector<float> result(n);
+        callback(user_data, seed, offset, result.data(), n);
+        offset += n;
+        return result;
+    }
+};
+
+// model file mapped to memory. Pages are private copy-on-write: untouched weights are shared with other processes
+// through page cache, weights modified by lora get private copy
+struct MappedFile {
+    void* addr = NULL;
+    size_t size = 0;
+#if defined(_WIN32)
+    HANDLE mapping = NULL;
+#endif
+
+    bool map(const std::string& file_path) {
+#if defined(_WIN32)
+        HANDLE file = CreateFileA(file_path.c_str(), GENERIC_READ, FILE_SHARE_READ, NULL, OPEN_EXISTING, FILE_ATTRIBUTE_NORMAL, NULL);
+        if (file == INVALID_HANDLE_VALUE) {
+            return false;
+        }
+        LARGE_INTEGER file_size;
+        if (!GetFileSizeEx(file, &file_size)) {
+            CloseHandle(file);
+            return false;
+        }
+        mapping = CreateFileMappingA(file, NULL, PAGE_WRITECOPY, 0, 0, NULL);
+        CloseHandle(file);
+        if (mapping == NULL) {
+            return false;
+        }
+        addr = MapViewOfFile(mapping, FILE_MAP_COPY, 0, 0, 0);
+        if (addr == NULL) {
+            CloseHandle(mapping);
+            mapping = NULL;
+            return false;
+        }
+        size = (size_t)file_size.QuadPart;
+        return true;
+#else
+        int fd = open(file_path.c_str(), O_RDONLY);
+        if (fd < 0) {
+            return false;
+        }
+        struct stat st;
+        if (fstat(fd, &st) != 0) {
+            close(fd);
+            return false;
+        }
+        void* p = mmap(NULL, (size_t)st.st_size, PROT_READ | PROT_WRITE, MAP_PRIVATE, fd, 0);
+        close(fd);
+        if (p == MAP_FAILED) {
+            return false;
+        }
+        addr = p;
+        size = (size_t)st.st_size;
+        return true;
+#endif
+    }
+
+    ~MappedFile() {
+        if (addr == NULL) {
+            return;
+        }
+#if defined(_WIN32)
+        UnmapViewOfFile(addr);
+        CloseHandle(mapping);
+#else
+        munmap(addr, size);
+#endif
+    }
+};
+
 /*=============================================== StableDiffusionGGML ================================================*/
 
 class StableDiffusionGGML {
@@ -2779,14 +3769,15 @@ class StableDiffusionGGML {
     bool vae_decode_only = false;
     bool free_params_immediately = false;
 
-    std::shared_ptr<RNG> rng = std::make_shared<STDDefaultRNG>();
+    RNGType rng_type = STD_DEFAULT_RNG;
     int32_t ftype = 1;
     int n_threads = -1;
     float scale_factor = 0.18215f;
-    size_t max_mem_size = 0;
-    size_t curr_params_mem_size = 0;
-    size_t max_params_mem_size = 0;
-    size_t max_rt_mem_size = 0;
+    // memory statistics, updated by all sessions
+    std::atomic<size_t> max_mem_size{0};
+    std::atomic<size_t> curr_params_mem_size{0};
+    std::atomic<size_t> max_params_mem_size{0};
+    std::atomic<size_t> max_rt_mem_size{0};
 
     FrozenCLIPEmbedderWithCustomWords cond_stage_model;
     UNetModel diffusion_model;
@@ -2794,6 +3785,36 @@ class StableDiffusionGGML {
 
     std::shared_ptr<Denoiser> denoiser = std::make_shared<CompVisDenoiser>();
 
+    std::map<std::string, struct ggml_tensor*> tensors;           // weights by name in model file
+    std::set<std::string> loaded_tensor_names;                   // names seen while loading
+    std::map<std::string, std::vector<uint8_t>> weight_backups;  // original data of modified weights
+
+    // weights used in place from mapped model file, contexts hold only tensor structs
+    std::shared_ptr<MappedFile> mapped_file;
+    std::vector<uint8_t> unmapped_params;  // zeroed data of weights not in mapped file
+
+    // low memory mode (free_params_immediately): weights of each component are released after use and read
+    // again from model file before next use
+    enum ParamsComponent {
+        CLIP_PARAMS,
+        UNET_PARAMS,
+        VAE_PARAMS,
+    };
+    std::string model_path;                        // empty when weights can not be read again
+    std::map<std::string, size_t> tensor_offsets;  // data position of weights in model file
+    ggml_type params_wtype = GGML_TYPE_F16;
+    std::mutex params_mutex;
+    int active_generations = 0;  // guarded by params_mutex, weights are released only when no other generation runs
+    bool vae_replaced = false;  // vae weights are from other file, low memory mode keeps them
+
+    // TAESD tiny autoencoder, loaded separately. Decoder and encoder are usable when all their weights are set
+    TinyAutoEncoder taesd;
+    ggml_context* taesd_params_ctx = NULL;
+    std::map<std::string, struct ggml_tensor*> taesd_tensors;
+    std::set<std::string> taesd_loaded_names;
+    bool taesd_has_decoder = false;
+    bool taesd_has_encoder = false;
+
     StableDiffusionGGML() = default;
 
     StableDiffusionGGML(int n_threads,
@@ -2804,10 +3825,61 @@ class StableDiffusionGGML {
           vae_decode_only(vae_decode_only),
           free_params_immediately(free_params_immediately) {
         first_stage_model.decode_only = vae_decode_only;
-        if (rng_type == STD_DEFAULT_RNG) {
-            rng = std::make_shared<STDDefaultRNG>();
+        this->rng_type = rng_type;
+    }
+
+    // each generation call has own rng so calls do not share random state
+    std::shared_ptr<RNG> create_rng(int64_t seed, const SDParams& sd_params) {
+        std::shared_ptr<RNG> rng;
+        if (sd_params.noise_callback != NULL) {
+            rng = std::make_shared<CallbackRNG>(sd_params.noise_callback, sd_params.noise_user_data);
         } else if (rng_type == CUDA_RNG) {
             rng = std::make_shared<PhiloxRNG>();
+        } else {
+            rng = std::make_shared<STDDefaultRNG>();
+        }
+        rng->manual_seed(seed);
+        return rng;
+    }
+
+    // initial noise of sampling. Noise of variation_seed is slerped in by variation_strength. Noise is generated on
+    // src_w x src_h latent size and placed to center of x, so composition of seed survives size change (A1111 seed resize)
+    void set_initial_noise(ggml_tensor* x,
+                           const SDParams& sd_params,
+                           int64_t seed,
+                           std::shared_ptr<RNG> rng,
+                           int64_t src_w,
+                           int64_t src_h) {
+        int64_t W = x->ne[0];
+        int64_t H = x->ne[1];
+        int64_t C = x->ne[2] * x->ne[3];
+        std::vector<float> noise = rng->randn(src_w * src_h * C);
+        if (sd_params.variation_strength > 0.f) {
+            std::vector<float> variation = create_rng(sd_params.variation_seed, sd_params)->randn(src_w * src_h * C);
+            noise = slerp(sd_params.variation_strength, noise, variation);
+            LOG_INFO("variation seed %lld strength %.2f", (long long)sd_params.variation_seed, sd_params.variation_strength);
+        }
+
+        float* vec = (float*)x->data;
+        if (src_w == W && src_h == H) {
+            memcpy(vec, noise.data(), noise.size() * sizeof(float));
+            return;
+        }
+        LOG_INFO("seed noise resized from %dx%d", (int)src_w * 8, (int)src_h * 8);
+        std::vector<float> base = create_rng(seed, sd_params)->randn(W * H * C);
+        memcpy(vec, base.data(), base.size() * sizeof(float));
+        int64_t dx = (W - src_w) / 2;
+        int64_t dy = (H - src_h) / 2;
+        int64_t tx = std::max(dx, (int64_t)0);
+        int64_t ty = std::max(dy, (int64_t)0);
+        int64_t sx = std::max(-dx, (int64_t)0);
+        int64_t sy = std::max(-dy, (int64_t)0);
+        int64_t w = std::min(src_w - sx, W - tx);
+        int64_t h = std::min(src_h - sy, H - ty);
+        for (int64_t c = 0; c < C; c++) {
+            for (int64_t j = 0; j < h; j++) {
+                memcpy(vec + (c * H + ty + j) * W + tx, noise.data() + (c * src_h + sy + j) * src_w + sx, w * sizeof(float));
+            }
         }
     }
 
@@ -2824,11 +3896,26 @@ class StableDiffusionGGML {
             ggml_free(vae_params_ctx);
             vae_params_ctx = NULL;
         }
+        if (taesd_params_ctx != NULL) {
+            ggml_free(taesd_params_ctx);
+            taesd_params_ctx = NULL;
+        }
     }
 
-    bool load_from_file(const std::string& file_path, Schedule schedule) {
+    bool load_from_file(const std::string& file_path, Schedule schedule, bool use_mmap) {
         LOG_INFO("loading model from '%s'", file_path.c_str());
 
+        mapped_file = NULL;
+        model_path = "";
+        tensor_offsets.clear();
+        if (use_mmap) {
+            mapped_file = std::make_shared<MappedFile>();
+            if (!mapped_file->map(file_path)) {
+                LOG_WARN("mapping '%s' failed, reading weights to memory", file_path.c_str());
+                mapped_file = NULL;
+            }
+        }
+
         std::ifstream file(file_path, std::ios::binary);
         if (!file.is_open()) {
             LOG_ERROR("failed to open '%s'", file_path.c_str());
@@ -2855,20 +3942,19 @@ class StableDiffusionGGML {
             LOG_ERROR("invalid model file '%s' (bad model type value %d)", file_path.c_str(), ftype);
             return false;
         }
-        LOG_INFO("model type: %s", model_type_to_str[model_type]);
-
-        if (model_type == SD2) {
-            cond_stage_model = FrozenCLIPEmbedderWithCustomWords((ModelType)model_type);
-            diffusion_model = UNetModel((ModelType)model_type);
-        }
 
         ggml_type wtype = ggml_ftype_to_ggml_type((ggml_ftype)(ftype & 0xFFFF));
-        LOG_INFO("ftype: %s", ggml_type_name(wtype));
         if (wtype == GGML_TYPE_COUNT) {
             LOG_ERROR("invalid model file '%s' (bad ftype value %d)", file_path.c_str(), ftype);
             return false;
         }
 
+        // low memory mode keeps only tensor structs now, weights are read on first use
+        bool lazy = free_params_immediately && !mapped_file;
+        if (!init_params((ModelType)model_type, wtype, mapped_file != NULL || lazy)) {
+            return false;
+        }
+
         LOG_DEBUG("loading vocab");
         // load vocab
         {
@@ -2896,94 +3982,11 @@ class StableDiffusionGGML {
             }
         }
 
-        // create the ggml context for network params
-        LOG_DEBUG("ggml tensor size = %d bytes", (int)sizeof(ggml_tensor));
-        {
-            // cond_stage_model(FrozenCLIPEmbedder)
-            double ctx_size = 1 * 1024 * 1024;  // 1 MB, for padding
-            ctx_size += cond_stage_model.text_model.compute_params_mem_size(wtype);
-            LOG_DEBUG("clip params ctx size = % 6.2f MB", ctx_size / (1024.0 * 1024.0));
-
-            struct ggml_init_params params;
-            params.mem_size = static_cast<size_t>(ctx_size);
-            params.mem_buffer = NULL;
-            params.no_alloc = false;
-            params.dynamic = false;
-
-            clip_params_ctx = ggml_init(params);
-            if (!clip_params_ctx) {
-                LOG_ERROR("ggml_init() failed");
-                return false;
-            }
-        }
-
-        {
-            // diffusion_model(UNetModel)
-            double ctx_size = 1 * 1024 * 1024;  // 1 MB, for padding
-            ctx_size += diffusion_model.compute_params_mem_size(wtype);
-            LOG_DEBUG("unet params ctx size = % 6.2f MB", ctx_size / (1024.0 * 1024.0));
-
-            struct ggml_init_params params;
-            params.mem_size = static_cast<size_t>(ctx_size);
-            params.mem_buffer = NULL;
-            params.no_alloc = false;
-            params.dynamic = false;
-
-            unet_params_ctx = ggml_init(params);
-            if (!unet_params_ctx) {
-                LOG_ERROR("ggml_init() failed");
-                ggml_free(clip_params_ctx);
-                clip_params_ctx = NULL;
-                return false;
-            }
-        }
-
-        {
-            // first_stage_model(AutoEncoderKL)
-            double ctx_size = 1 * 1024 * 1024;  // 1 MB, for padding
-            ctx_size += first_stage_model.compute_params_mem_size(wtype);
-            LOG_DEBUG("vae params ctx size = % 6.2f MB", ctx_size / (1024.0 * 1024.0));
-
-            struct ggml_init_params params;
-            params.mem_size = static_cast<size_t>(ctx_size);
-            params.mem_buffer = NULL;
-            params.no_alloc = false;
-            params.dynamic = false;
-
-            vae_params_ctx = ggml_init(params);
-            if (!vae_params_ctx) {
-                LOG_ERROR("ggml_init() failed");
-                ggml_free(clip_params_ctx);
-                clip_params_ctx = NULL;
-                ggml_free(unet_params_ctx);
-                unet_params_ctx = NULL;
-                return false;
-            }
-        }
-
-        std::map<std::string, struct ggml_tensor*> tensors;
-
-        LOG_DEBUG("preparing memory for the weights");
-        // prepare memory for the weights
-        {
-            // cond_stage_model(FrozenCLIPEmbedder)
-            cond_stage_model.text_model.init_params(clip_params_ctx, wtype);
-            cond_stage_model.text_model.map_by_name(tensors, "cond_stage_model.transformer.text_model.");
-
-            // diffusion_model(UNetModel)
-            diffusion_model.init_params(unet_params_ctx, wtype);
-            diffusion_model.map_by_name(tensors, "model.diffusion_model.");
-
-            // firest_stage_model(AutoEncoderKL)
-            first_stage_model.init_params(vae_params_ctx, wtype);
-            first_stage_model.map_by_name(tensors, "first_stage_model.");
-        }
-
         LOG_DEBUG("loading weights");
-        std::set<std::string> tensor_names_in_file;
         int64_t t0 = ggml_time_ms();
         // load weights
         float alphas_cumprod[TIMESTEPS];
+        bool has_alphas_cumprod = false;
         {
             int n_tensors = 0;
             size_t total_size = 0;
@@ -3013,92 +4016,418 @@ class StableDiffusionGGML {
                 std::string name(length, 0);
                 file.read(&name[0], length);
 
-                tensor_names_in_file.insert(std::string(name.data()));
+                loaded_tensor_names.insert(std::string(name.data()));
 
                 if (std::string(name.data()) == "alphas_cumprod") {
                     file.read(reinterpret_cast<char*>(alphas_cumprod), nelements * ggml_type_size((ggml_type)ttype));
+                    has_alphas_cumprod = true;
+                    continue;
+                }
+
+                struct ggml_tensor* tensor;
+                if (tensors.find(name.data()) != tensors.end()) {
+                    tensor = tensors[name.data()];
+                } else {
+                    if (name.find("quant") == std::string::npos && name.find("first_stage_model.encoder.") == std::string::npos) {
+                        LOG_WARN("unknown tensor '%s' in model file", name.data());
+                    } else {
+                        if (!vae_decode_only) {
+                            LOG_WARN("unknown tensor '%s' in model file", name.data());
+                            return false;
+                        }
+                    }
+                    file.ignore(num_bytes);
                     continue;
                 }
 
-                struct ggml_tensor* tensor;
-                if (tensors.find(name.data()) != tensors.end()) {
-                    tensor = tensors[name.data()];
-                } else {
-                    if (name.find("quant") == std::string::npos && name.find("first_stage_model.encoder.") == std::string::npos) {
-                        LOG_WARN("unknown tensor '%s' in model file", name.data());
-                    } else {
-                        if (!vae_decode_only) {
-                            LOG_WARN("unknown tensor '%s' in model file", name.data());
-                            return false;
-                        }
-                    }
-                    file.ignore(num_bytes);
-                    continue;
-                }
+                if (tensor->ne[0] != ne[0] || tensor->ne[1] != ne[1] || tensor->ne[2] != ne[2] || tensor->ne[3] != ne[3]) {
+                    LOG_ERROR(
+                        "tensor '%s' has wrong shape in model file: "
+                        "got [%d, %d, %d, %d], expected [%d, %d, %d, %d]",
+                        name.data(),
+                        ne[0], ne[1], ne[2], ne[3],
+                        (int)tensor->ne[0], (int)tensor->ne[1], (int)tensor->ne[2], (int)tensor->ne[3]);
+                    return false;
+                }
+
+                if (ggml_nelements(tensor) != nelements) {
+                    LOG_ERROR(
+                        "tensor '%s' has wrong number of elements in model file: "
+                        "got %u, expert %zu",
+                        name.data(), nelements, ggml_nelements(tensor));
+                    return false;
+                }
+
+                if (tensor->type != ttype) {
+                    LOG_ERROR("tensor '%s' has wrong type in model file: got %s, expect %s",
+                              name.data(), ggml_type_name(ggml_type(ttype)), ggml_type_name(tensor->type));
+                    return false;
+                }
+
+                size_t offset = (size_t)file.tellg();
+                tensor_offsets[name.data()] = offset;
+                if (mapped_file) {
+                    if (offset + num_bytes > mapped_file->size) {
+                        LOG_ERROR("tensor '%s' is beyond end of model file", name.data());
+                        return false;
+                    }
+                    tensor->data = (char*)mapped_file->addr + offset;
+                    file.seekg(num_bytes, std::ios::cur);
+                } else if (lazy) {
+                    file.seekg(num_bytes, std::ios::cur);
+                } else {
+                    file.read(reinterpret_cast<char*>(tensor->data), num_bytes);
+                }
+
+                total_size += ggml_nbytes(tensor);
+            }
+            LOG_DEBUG("model size = %.2fMB", total_size / 1024.0 / 1024.0);
+        }
+        int64_t t1 = ggml_time_ms();
+        LOG_INFO("loading model from '%s' completed, taking %.2fs", file_path.c_str(), (t1 - t0) * 1.0f / 1000);
+        file.close();
+
+        if (!mapped_file) {
+            model_path = file_path;
+        }
+        if (lazy) {
+            // drop struct only contexts, load_params creates real ones
+            free_params_ctx(CLIP_PARAMS);
+            free_params_ctx(UNET_PARAMS);
+            free_params_ctx(VAE_PARAMS);
+        }
+        return finish_loading(has_alphas_cumprod ? alphas_cumprod : NULL, schedule);
+    }
+
+    // creates weight contexts of model type, tensors are mapped by name for loading. no_alloc contexts have only
+    // tensor structs, data is set later (mapped file or low memory mode)
+    bool init_params(ModelType model_type, ggml_type wtype, bool no_alloc = false) {
+        LOG_INFO("model type: %s", model_type_to_str[model_type]);
+        LOG_INFO("ftype: %s", ggml_type_name(wtype));
+        if (model_type != SD1) {
+            cond_stage_model = FrozenCLIPEmbedderWithCustomWords(model_type);
+            diffusion_model = UNetModel(model_type);
+        }
+        if (model_type == SDXL) {
+            scale_factor = 0.13025f;
+        }
+        params_wtype = wtype;
+
+        // create the ggml context for network params
+        LOG_DEBUG("ggml tensor size = %d bytes", (int)sizeof(ggml_tensor));
+        tensors.clear();
+        LOG_DEBUG("preparing memory for the weights");
+        if (!create_params(CLIP_PARAMS, wtype, no_alloc) ||
+            !create_params(UNET_PARAMS, wtype, no_alloc) ||
+            !create_params(VAE_PARAMS, wtype, no_alloc)) {
+            free_params_ctx(CLIP_PARAMS);
+            free_params_ctx(UNET_PARAMS);
+            free_params_ctx(VAE_PARAMS);
+            return false;
+        }
+
+        loaded_tensor_names.clear();
+        return true;
+    }
+
+    ggml_context*& params_ctx(ParamsComponent component) {
+        switch (component) {
+            case CLIP_PARAMS:
+                return clip_params_ctx;
+            case UNET_PARAMS:
+                return unet_params_ctx;
+            default:
+                return vae_params_ctx;
+        }
+    }
+
+    static const char* params_prefix(ParamsComponent component) {
+        switch (component) {
+            case CLIP_PARAMS:
+                return "cond_stage_model.";
+            case UNET_PARAMS:
+                return "model.diffusion_model.";
+            default:
+                return "first_stage_model.";
+        }
+    }
+
+    static bool has_prefix(const std::string& name, const char* prefix) {
+        return name.compare(0, strlen(prefix), prefix) == 0;
+    }
+
+    // creates weight context of one component and maps its tensors by name
+    bool create_params(ParamsComponent component, ggml_type wtype, bool no_alloc) {
+        const char* names[] = {"clip", "unet", "vae"};
+        double ctx_size = 1 * 1024 * 1024;  // 1 MB, for padding
+        if (no_alloc) {
+            ctx_size += MAX_PARAMS_TENSOR_NUM * ggml_tensor_overhead();
+        } else if (component == CLIP_PARAMS) {
+            ctx_size += cond_stage_model.text_model.compute_params_mem_size(wtype);
+            if (cond_stage_model.model_type == SDXL) {
+                ctx_size += cond_stage_model.text_model2.compute_params_mem_size(wtype);
+            }
+        } else if (component == UNET_PARAMS) {
+            ctx_size += diffusion_model.compute_params_mem_size(wtype);
+        } else {
+            ctx_size += first_stage_model.compute_params_mem_size(wtype);
+        }
+        LOG_DEBUG("%s params ctx size = % 6.2f MB", names[component], ctx_size / (1024.0 * 1024.0));
+
+        struct ggml_init_params params;
+        params.mem_size = static_cast<size_t>(ctx_size);
+        params.mem_buffer = NULL;
+        params.no_alloc = no_alloc;
+        params.dynamic = false;
+
+        ggml_context* ctx = ggml_init(params);
+        if (!ctx) {
+            LOG_ERROR("ggml_init() failed");
+            return false;
+        }
+        params_ctx(component) = ctx;
+
+        switch (component) {
+            case CLIP_PARAMS:
+                // cond_stage_model(FrozenCLIPEmbedder)
+                cond_stage_model.text_model.init_params(ctx, wtype);
+                cond_stage_model.text_model.map_by_name(tensors, "cond_stage_model.transformer.text_model.");
+                if (cond_stage_model.model_type == SDXL) {
+                    cond_stage_model.text_model2.init_params(ctx, wtype);
+                    cond_stage_model.text_model2.map_by_name(tensors, "cond_stage_model.1.transformer.text_model.");
+                }
+                break;
+            case UNET_PARAMS:
+                // diffusion_model(UNetModel)
+                diffusion_model.init_params(ctx, wtype);
+                diffusion_model.map_by_name(tensors, "model.diffusion_model.");
+                break;
+            case VAE_PARAMS:
+                // firest_stage_model(AutoEncoderKL)
+                first_stage_model.init_params(ctx, wtype);
+                first_stage_model.map_by_name(tensors, "first_stage_model.");
+                break;
+        }
+        return true;
+    }
+
+    // frees context of component, its tensors are left without data
+    void free_params_ctx(ParamsComponent component) {
+        ggml_context*& ctx = params_ctx(component);
+        if (ctx == NULL) {
+            return;
+        }
+        const char* prefix = params_prefix(component);
+        for (auto& pair : tensors) {
+            if (has_prefix(pair.first, prefix)) {
+                pair.second = NULL;
+                weight_backups.erase(pair.first);
+            }
+        }
+        ggml_free(ctx);
+        ctx = NULL;
+    }
+
+    bool can_release_params() {
+        return !model_path.empty();
+    }
+
+    // low memory mode: reads released weights of component from model file before use
+    bool load_params(ParamsComponent component) {
+        std::lock_guard<std::mutex> lock(params_mutex);
+        if (params_ctx(component) != NULL) {
+            return true;
+        }
+        if (!can_release_params()) {
+            LOG_ERROR("weights of '%s' are released and can not be read again", params_prefix(component));
+            return false;
+        }
+        int64_t t0 = ggml_time_ms();
+        if (!create_params(component, params_wtype, false)) {
+            return false;
+        }
+        std::ifstream file(model_path, std::ios::binary);
+        const char* prefix = params_prefix(component);
+        for (auto& pair : tensor_offsets) {
+            if (!has_prefix(pair.first, prefix)) {
+                continue;
+            }
+            struct ggml_tensor* tensor = tensors[pair.first];
+            file.seekg(pair.second);
+            file.read(reinterpret_cast<char*>(tensor->data), ggml_nbytes(tensor));
+        }
+        if (!file) {
+            LOG_ERROR("reading weights of '%s' from '%s' failed", prefix, model_path.c_str());
+            free_params_ctx(component);
+            return false;
+        }
+        for (auto& pair : tensors) {
+            if (has_prefix(pair.first, prefix)) {
+                ggml_set_name(pair.second, pair.first.c_str());
+            }
+        }
+        curr_params_mem_size += ggml_used_mem(params_ctx(component));
+        if (curr_params_mem_size > max_params_mem_size) {
+            max_params_mem_size = curr_params_mem_size.load();
+        }
+        LOG_INFO("weights of '%s' read from model file, taking %.2fs", prefix, (ggml_time_ms() - t0) * 1.0f / 1000);
+        return true;
+    }
+
+    // low memory mode: frees weights of component after use. Weights stay when they can not be read again or when
+    // other generation (model or session) is running, last generation to end releases them
+    void release_params(ParamsComponent component) {
+        std::lock_guard<std::mutex> lock(params_mutex);
+        if (active_generations > 1) {
+            return;
+        }
+        release_params_locked(component);
+    }
+
+    void release_params_locked(ParamsComponent component) {
+        if (!can_release_params() || params_ctx(component) == NULL) {
+            return;
+        }
+        if (component == VAE_PARAMS && vae_replaced) {
+            return;
+        }
+        curr_params_mem_size -= ggml_used_mem(params_ctx(component));
+        free_params_ctx(component);
+    }
+
+    void begin_generation() {
+        std::lock_guard<std::mutex> lock(params_mutex);
+        active_generations++;
+    }
 
-                if (tensor->ne[0] != ne[0] || tensor->ne[1] != ne[1] || tensor->ne[2] != ne[2] || tensor->ne[3] != ne[3]) {
-                    LOG_ERROR(
-                        "tensor '%s' has wrong shape in model file: "
-                        "got [%d, %d, %d, %d], expected [%d, %d, %d, %d]",
-                        name.data(),
-                        ne[0], ne[1], ne[2], ne[3],
-                        (int)tensor->ne[0], (int)tensor->ne[1], (int)tensor->ne[2], (int)tensor->ne[3]);
-                    return false;
-                }
+    void end_generation() {
+        std::lock_guard<std::mutex> lock(params_mutex);
+        active_generations--;
+        if (active_generations == 0 && free_params_immediately) {
+            release_params_locked(CLIP_PARAMS);
+            release_params_locked(UNET_PARAMS);
+            release_params_locked(VAE_PARAMS);
+        }
+    }
 
-                if (ggml_nelements(tensor) != nelements) {
-                    LOG_ERROR(
-                        "tensor '%s' has wrong number of elements in model file: "
-                        "got %u, expert %zu",
-                        name.data(), nelements, ggml_nelements(tensor));
-                    return false;
-                }
+    // sets weight from f32 data, converted to type of model tensor. ne is in ggml order
+    bool load_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+        loaded_tensor_names.insert(name);
+        auto it = tensors.find(name);
+        if (it == tensors.end()) {
+            if (name.find("quant") == std::string::npos && name.find("first_stage_model.encoder.") == std::string::npos) {
+                LOG_WARN("unknown tensor '%s' in model file", name.c_str());
+                return true;
+            }
+            if (!vae_decode_only) {
+                LOG_WARN("unknown tensor '%s' in model file", name.c_str());
+                return false;
+            }
+            return true;
+        }
+        return set_tensor_data(name, it->second, ne, data);
+    }
 
-                if (tensor->type != ttype) {
-                    LOG_ERROR("tensor '%s' has wrong type in model file: got %s, expect %s",
-                              name.data(), ggml_type_name(ggml_type(ttype)), ggml_type_name(tensor->type));
-                    return false;
-                }
+    // checks shape and copies f32 data to weight, cast or quantized to type of weight
+    bool set_tensor_data(const std::string& name, struct ggml_tensor* tensor, const std::vector<int64_t>& ne, const float* data) {
+        int64_t nelements = 1;
+        for (size_t i = 0; i < ne.size(); i++) {
+            nelements *= ne[i];
+        }
+        for (int i = 0; i < 4; i++) {
+            int64_t n = i < (int)ne.size() ? ne[i] : 1;
+            if (tensor->ne[i] != n) {
+                LOG_ERROR("tensor '%s' has wrong shape in model file: got %lld at dim %d, expected %lld",
+                          name.c_str(), (long long)n, i, (long long)tensor->ne[i]);
+                return false;
+            }
+        }
+        if (ggml_nelements(tensor) != nelements) {
+            LOG_ERROR("tensor '%s' has wrong number of elements in model file", name.c_str());
+            return false;
+        }
 
-                file.read(reinterpret_cast<char*>(tensor->data), num_bytes);
+        if (tensor->type == GGML_TYPE_F32) {
+            memcpy(tensor->data, data, nelements * sizeof(float));
+        } else if (tensor->type == GGML_TYPE_F16) {
+            ggml_fp32_to_fp16_row(data, (ggml_fp16_t*)tensor->data, (int)nelements);
+        } else {
+            if (tensor->ne[0] % ggml_blck_size(tensor->type) != 0) {
+                LOG_ERROR("tensor '%s' row size %lld can not be quantized to %s",
+                          name.c_str(), (long long)tensor->ne[0], ggml_type_name(tensor->type));
+                return false;
+            }
+            int64_t hist[16] = {0};
+            ggml_quantize_chunk(tensor->type, data, tensor->data, 0, (int)nelements, hist);
+        }
+        return true;
+    }
 
-                total_size += ggml_nbytes(tensor);
+    // checks that every weight was loaded, alphas_cumprod has TIMESTEPS values
+    bool finish_loading(const float* alphas_cumprod, Schedule schedule) {
+        bool some_tensor_not_init = false;
+        for (auto pair : tensors) {
+            if (pair.first.find("cond_stage_model.transformer.text_model.encoder.layers.23") != std::string::npos) {
+                continue;
             }
-            bool some_tensor_not_init = false;
-            for (auto pair : tensors) {
-                if (pair.first.find("cond_stage_model.transformer.text_model.encoder.layers.23") != std::string::npos) {
-                    continue;
+            if (loaded_tensor_names.find(pair.first) == loaded_tensor_names.end()) {
+                LOG_ERROR("tensor '%s' not in model file", pair.first.c_str());
+                some_tensor_not_init = true;
+            }
+        }
+        if (alphas_cumprod == NULL) {
+            LOG_ERROR("tensor alphas_cumprod not in model file");
+            some_tensor_not_init = true;
+        }
+        if (some_tensor_not_init) {
+            return false;
+        }
+
+        if (mapped_file) {
+            size_t unmapped_size = 0;
+            for (auto& pair : tensors) {
+                if (pair.second->data == NULL) {
+                    unmapped_size += GGML_PAD(ggml_nbytes(pair.second), 32);
                 }
-                if (tensor_names_in_file.find(pair.first) == tensor_names_in_file.end()) {
-                    LOG_ERROR("tensor '%s' not in model file", pair.first.c_str());
-                    some_tensor_not_init = true;
+            }
+            unmapped_params.assign(unmapped_size, 0);
+            size_t offset = 0;
+            for (auto& pair : tensors) {
+                if (pair.second->data == NULL) {
+                    pair.second->data = unmapped_params.data() + offset;
+                    offset += GGML_PAD(ggml_nbytes(pair.second), 32);
                 }
             }
-            if (tensor_names_in_file.find("alphas_cumprod") == tensor_names_in_file.end()) {
-                LOG_ERROR("tensor alphas_cumprod not in model file");
-                some_tensor_not_init = true;
+            LOG_INFO("weights used in place from mapped model file (%.2fMB)", mapped_file->size / 1024.0 / 1024.0);
+        }
+
+        // named weights are not renamed when graphs are built, sessions can share them
+        for (auto& pair : tensors) {
+            if (pair.second != NULL) {
+                ggml_set_name(pair.second, pair.first.c_str());
             }
-            if (some_tensor_not_init) {
-                file.close();
-                return false;
+        }
+        if (free_params_immediately) {
+            if (can_release_params()) {
+                LOG_INFO("low memory mode, weights are read from model file before each use");
+            } else {
+                LOG_WARN("low memory mode needs model file read without mmap, weights stay in memory");
             }
-            LOG_DEBUG("model size = %.2fMB", total_size / 1024.0 / 1024.0);
         }
-        max_params_mem_size = ggml_used_mem(clip_params_ctx) + ggml_used_mem(unet_params_ctx) + ggml_used_mem(vae_params_ctx);
-        max_mem_size = max_params_mem_size;
-        curr_params_mem_size = max_params_mem_size;
+        size_t clip_size = clip_params_ctx ? ggml_used_mem(clip_params_ctx) : 0;
+        size_t unet_size = unet_params_ctx ? ggml_used_mem(unet_params_ctx) : 0;
+        size_t vae_size = vae_params_ctx ? ggml_used_mem(vae_params_ctx) : 0;
+        max_params_mem_size = clip_size + unet_size + vae_size;
+        max_mem_size = max_params_mem_size.load();
+        curr_params_mem_size = max_params_mem_size.load();
         LOG_INFO("total params size = %.2fMB (clip %.2fMB, unet %.2fMB, vae %.2fMB)",
                  max_params_mem_size / 1024.0 / 1024.0,
-                 ggml_used_mem(clip_params_ctx) / 1024.0 / 1024.0,
-                 ggml_used_mem(unet_params_ctx) / 1024.0 / 1024.0,
-                 ggml_used_mem(vae_params_ctx) / 1024.0 / 1024.0);
-        int64_t t1 = ggml_time_ms();
-        LOG_INFO("loading model from '%s' completed, taking %.2fs", file_path.c_str(), (t1 - t0) * 1.0f / 1000);
-        file.close();
-
+                 clip_size / 1024.0 / 1024.0,
+                 unet_size / 1024.0 / 1024.0,
+                 vae_size / 1024.0 / 1024.0);
         // check is_using_v_parameterization_for_sd2
         bool is_using_v_parameterization = false;
-        if (model_type == SD2) {
+        if (cond_stage_model.model_type == SD2) {
             struct ggml_init_params params;
             params.mem_size = static_cast<size_t>(10 * 1024) * 1024;  // 10M
             params.mem_buffer = NULL;
@@ -3109,9 +4438,17 @@ class StableDiffusionGGML {
                 LOG_ERROR("ggml_init() failed");
                 return false;
             }
+            if (!load_params(UNET_PARAMS)) {
+                ggml_free(ctx);
+                return false;
+            }
             if (is_using_v_parameterization_for_sd2(ctx)) {
                 is_using_v_parameterization = true;
             }
+            ggml_free(ctx);
+            if (free_params_immediately) {
+                release_params(UNET_PARAMS);
+            }
         }
 
         if (is_using_v_parameterization) {
@@ -3176,7 +4513,7 @@ class StableDiffusionGGML {
             ggml_set_dynamic(ctx, params.dynamic);
 
             struct ggml_tensor* out = diffusion_model.forward(ctx, x_t, NULL, c, t_emb);
-            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx);
+            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx) + ggml_graph_overhead();
 
             struct ggml_cgraph* diffusion_graph = ggml_build_forward_ctx(ctx, out);
             struct ggml_cplan cplan = ggml_graph_plan(diffusion_graph, n_threads);
@@ -3251,12 +4588,215 @@ class StableDiffusionGGML {
         return result < -1;
     }
 
-    ggml_tensor* get_learned_condition(ggml_context* res_ctx, const std::string& text) {
-        auto tokens_and_weights = cond_stage_model.tokenize(text,
-                                                            cond_stage_model.text_model.max_position_embeddings,
-                                                            true);
-        std::vector<int>& tokens = tokens_and_weights.first;
-        std::vector<float>& weights = tokens_and_weights.second;
+    // encoded prompt, pooled is SDXL only
+    struct Condition {
+        ggml_tensor* context = NULL;  // [N, 77 * chunks, context_dim]
+        ggml_tensor* pooled = NULL;   // [N, projection_dim]
+    };
+
+    // prompt text of each sampling step for each schedule. Distinct texts are encoded once, all with same chunk count.
+    // encoded is valid only for clip_skip it was encoded with
+    struct PromptSchedules {
+        std::vector<std::vector<std::string>> step_texts;
+        std::map<std::string, Condition> encoded;
+        int n_chunks = 1;
+        int clip_skip = 0;
+
+        // conditioning of each sampling step, [0] is step 1
+        std::vector<Condition> get(size_t index) {
+            std::vector<Condition> result;
+            for (const auto& text : step_texts[index]) {
+                result.push_back(encoded[text]);
+            }
+            return result;
+        }
+    };
+
+    // AND sub-prompts, each with conditioning of each sampling step and guidance weight
+    struct Conditioning {
+        std::vector<std::vector<Condition>> steps;
+        std::vector<float> weights;
+
+        Condition at(size_t prompt, size_t step_index) const {
+            const auto& prompt_steps = steps[prompt];
+            return prompt_steps[std::min(step_index, prompt_steps.size() - 1)];
+        }
+    };
+
+    // adds schedules of sub-prompts and negative prompt, take_conditioning reads them back in same order
+    void plan_conditioning(std::vector<std::pair<std::string, int>>& prompts_and_steps,
+                           const std::vector<std::pair<std::string, float>>& sub_prompts,
+                           const std::string& negative_prompt,
+                           bool uncond,
+                           int steps) {
+        for (const auto& sub_prompt : sub_prompts) {
+            prompts_and_steps.push_back({sub_prompt.first, steps});
+        }
+        if (uncond) {
+            prompts_and_steps.push_back({negative_prompt, steps});
+        }
+    }
+
+    void take_conditioning(PromptSchedules& schedules,
+                           size_t& index,
+                           const std::vector<std::pair<std::string, float>>& sub_prompts,
+                           bool uncond,
+                           Conditioning& c,
+                           std::vector<Condition>& uc) {
+        for (const auto& sub_prompt : sub_prompts) {
+            c.steps.push_back(schedules.get(index++));
+            c.weights.push_back(sub_prompt.second);
+        }
+        if (uncond) {
+            uc = schedules.get(index++);
+        }
+    }
+
+    PromptSchedules plan_prompt_schedules(const std::vector<std::pair<std::string, int>>& prompts_and_steps, int clip_skip) {
+        PromptSchedules result;
+        result.clip_skip = clip_skip;
+        for (const auto& item : prompts_and_steps) {
+            int steps = std::max(item.second, 1);
+            std::vector<std::string> texts;
+            for (int step = 1; step <= steps; step++) {
+                texts.push_back(prompt_at_step(item.first, step, steps));
+                if (result.encoded.find(texts.back()) == result.encoded.end()) {
+                    result.encoded[texts.back()] = Condition();
+                    result.n_chunks = std::max(result.n_chunks, condition_chunks(texts.back()));
+                }
+            }
+            result.step_texts.push_back(texts);
+        }
+        if (result.encoded.size() > prompts_and_steps.size()) {
+            LOG_INFO("prompt editing uses %zu prompt variants", result.encoded.size());
+        }
+        return result;
+    }
+
+    // memory needed in result context for encoded prompt schedules
+    size_t prompt_schedules_mem_size(const PromptSchedules& schedules) {
+        size_t per_text = schedules.n_chunks * cond_stage_model.text_model.max_position_embeddings *
+                          cond_stage_model.context_dim() * sizeof(float);
+        if (cond_stage_model.model_type == SDXL) {
+            per_text += cond_stage_model.text_model2.projection_dim * sizeof(float) + ggml_tensor_overhead();
+        }
+        return schedules.encoded.size() * (per_text + ggml_tensor_overhead());
+    }
+
+    bool encode_prompt_schedules(ggml_context* res_ctx, PromptSchedules& schedules, int n_threads) {
+        if (!load_params(CLIP_PARAMS)) {
+            return false;
+        }
+        for (auto& pair : schedules.encoded) {
+            pair.second = get_learned_condition(res_ctx, pair.first, n_threads, schedules.n_chunks, schedules.clip_skip);
+            if (pair.second.context == NULL) {
+                return false;
+            }
+        }
+        return true;
+    }
+
+    // number of 77 token chunks prompt needs, uncond and cond must have same length
+    int condition_chunks(const std::string& text) {
+        return (int)(cond_stage_model.tokenize_chunks(text).first.size() / cond_stage_model.text_model.max_position_embeddings);
+    }
+
+    // long prompts are encoded in chunks that are concatenated, context is [1, 77 * chunks, context_dim].
+    // SDXL pooled output is taken from first chunk
+    Condition get_learned_condition(ggml_context* res_ctx,
+                                       const std::string& text,
+                                       int n_threads,
+                                       int min_chunks = 1,
+                                       int clip_skip = 0) {
+        auto tokens_and_weights = cond_stage_model.tokenize_chunks(text, min_chunks);
+        int chunk_len = cond_stage_model.text_model.max_position_embeddings;
+        int n_chunks = (int)(tokens_and_weights.first.size() / chunk_len);
+        Condition result;
+        result.context = ggml_new_tensor_3d(res_ctx, GGML_TYPE_F32, cond_stage_model.context_dim(), chunk_len * n_chunks, 1);
+        if (cond_stage_model.model_type == SDXL) {
+            result.pooled = ggml_new_tensor_2d(res_ctx, GGML_TYPE_F32, cond_stage_model.text_model2.projection_dim, 1);
+        }
+        for (int chunk = 0; chunk < n_chunks; chunk++) {
+            std::vector<int> tokens(tokens_and_weights.first.begin() + chunk * chunk_len,
+                                    tokens_and_weights.first.begin() + (chunk + 1) * chunk_len);
+            std::vector<float> weights(tokens_and_weights.second.begin() + chunk * chunk_len,
+                                       tokens_and_weights.second.begin() + (chunk + 1) * chunk_len);
+            if (!compute_condition_chunk(result.context, chunk == 0 ? result.pooled : NULL, chunk, tokens, weights, n_threads, clip_skip)) {
+                return Condition();
+            }
+        }
+        if (n_chunks > 1) {
+            LOG_INFO("prompt encoded in %d chunks", n_chunks);
+        }
+        return result;
+    }
+
+    struct ConditionGraph {
+        ggml_tensor* input_ids = NULL;
+        ggml_tensor* token_embeds = NULL;
+        ggml_tensor* hidden_states = NULL;
+        // SDXL text_model2
+        ggml_tensor* input_ids2 = NULL;
+        ggml_tensor* token_embeds2 = NULL;
+        ggml_tensor* hidden_states2 = NULL;
+        ggml_tensor* pooled = NULL;
+    };
+
+    ConditionGraph build_condition_graph(ggml_context* ctx, size_t n_tokens, bool custom_tokens, bool with_pooled, int eos_pos, int clip_skip) {
+        ConditionGraph g;
+        ggml_set_dynamic(ctx, false);
+        g.input_ids = ggml_new_tensor_1d(ctx, GGML_TYPE_I32, n_tokens);
+        if (custom_tokens) {
+            g.token_embeds = ggml_new_tensor_2d(ctx, GGML_TYPE_F32, cond_stage_model.text_model.hidden_size, n_tokens);
+        }
+        if (cond_stage_model.model_type == SDXL) {
+            g.input_ids2 = ggml_new_tensor_1d(ctx, GGML_TYPE_I32, n_tokens);
+            if (custom_tokens) {
+                g.token_embeds2 = ggml_new_tensor_2d(ctx, GGML_TYPE_F32, cond_stage_model.text_model2.hidden_size, n_tokens);
+            }
+        }
+        ggml_set_dynamic(ctx, dynamic);
+
+        g.hidden_states = cond_stage_model.text_model.forward(ctx, g.input_ids, g.token_embeds, clip_skip);
+        if (cond_stage_model.model_type == SDXL) {
+            g.hidden_states2 = cond_stage_model.text_model2.forward(ctx, g.input_ids2, g.token_embeds2, clip_skip,
+                                                                    with_pooled ? &g.pooled : NULL, eos_pos);
+            ggml_hold_dynamic_tensor(g.hidden_states2);  // also input of layers computing pooled output
+        }
+        return g;
+    }
+
+    void expand_condition_graph(ggml_cgraph* graph, const ConditionGraph& g) {
+        if (g.hidden_states2 != NULL) {
+            ggml_build_forward_expand(graph, g.hidden_states2);
+        }
+        if (g.pooled != NULL) {
+            ggml_build_forward_expand(graph, g.pooled);
+        }
+    }
+
+    // encodes one chunk of tokens to its place in result, SDXL pooled output is set when pooled is given
+    bool compute_condition_chunk(ggml_tensor* result,
+                                 ggml_tensor* pooled,
+                                 int chunk,
+                                 const std::vector<int>& tokens,
+                                 const std::vector<float>& weights,
+                                 int n_threads,
+                                 int clip_skip) {
+        bool custom_tokens = cond_stage_model.has_custom_tokens(tokens);
+
+        // SDXL: open_clip pads with 0 after first EOS, pooled output is taken at EOS
+        std::vector<int> tokens2;
+        int eos_pos = (int)tokens.size() - 1;
+        if (cond_stage_model.model_type == SDXL) {
+            auto eos = std::find(tokens.begin(), tokens.end(), EOS_TOKEN_ID);
+            if (eos != tokens.end()) {
+                eos_pos = (int)(eos - tokens.begin());
+            }
+            tokens2 = tokens;
+            std::fill(tokens2.begin() + eos_pos + 1, tokens2.end(), 0);
+        }
+
         size_t ctx_size = 10 * 1024 * 1024;  // 10MB
         // calculate the amount of memory required
         {
@@ -3269,17 +4809,15 @@ class StableDiffusionGGML {
             struct ggml_context* ctx = ggml_init(params);
             if (!ctx) {
                 LOG_ERROR("ggml_init() failed");
-                return NULL;
+                return false;
             }
 
-            ggml_set_dynamic(ctx, false);
-            struct ggml_tensor* input_ids = ggml_new_tensor_1d(ctx, GGML_TYPE_I32, tokens.size());
-            ggml_set_dynamic(ctx, params.dynamic);
-
-            struct ggml_tensor* hidden_states = cond_stage_model.text_model.forward(ctx, input_ids);
+            ConditionGraph g = build_condition_graph(ctx, tokens.size(), custom_tokens, pooled != NULL, eos_pos, clip_skip);
 
-            struct ggml_cgraph cond_graph = ggml_build_forward(hidden_states);
-            struct ggml_cplan cplan = ggml_graph_plan(&cond_graph, n_threads);
+            // graph is allocated in context, used memory below includes it
+            struct ggml_cgraph* cond_graph = ggml_build_forward_ctx(ctx, g.hidden_states);
+            expand_condition_graph(cond_graph, g);
+            struct ggml_cplan cplan = ggml_graph_plan(cond_graph, n_threads);
             ctx_size += cplan.work_size;
 
             ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx);
@@ -3299,47 +4837,64 @@ class StableDiffusionGGML {
         struct ggml_context* ctx = ggml_init(params);
         if (!ctx) {
             LOG_ERROR("ggml_init() failed");
-            return NULL;
+            return false;
         }
 
-        ggml_set_dynamic(ctx, false);
-        struct ggml_tensor* input_ids = ggml_new_tensor_1d(ctx, GGML_TYPE_I32, tokens.size());
-        ggml_set_dynamic(ctx, params.dynamic);
-
-        struct ggml_tensor* hidden_states = cond_stage_model.text_model.forward(ctx, input_ids);
-        struct ggml_cgraph* cond_graph = ggml_build_forward_ctx(ctx, hidden_states);
+        ConditionGraph g = build_condition_graph(ctx, tokens.size(), custom_tokens, pooled != NULL, eos_pos, clip_skip);
+        struct ggml_cgraph* cond_graph = ggml_build_forward_ctx(ctx, g.hidden_states);
+        expand_condition_graph(cond_graph, g);
         LOG_DEBUG("building condition graph completed: %d nodes, %d leafs",
                   cond_graph->n_nodes, cond_graph->n_leafs);
 
-        memcpy(input_ids->data, tokens.data(), tokens.size() * ggml_element_size(input_ids));
+        memcpy(g.input_ids->data, tokens.data(), tokens.size() * ggml_element_size(g.input_ids));
+        if (custom_tokens) {
+            cond_stage_model.text_model.get_token_embeddings(tokens, cond_stage_model.custom_vectors, (float*)g.token_embeds->data);
+        }
+        if (g.input_ids2 != NULL) {
+            memcpy(g.input_ids2->data, tokens2.data(), tokens2.size() * ggml_element_size(g.input_ids2));
+            if (custom_tokens) {
+                cond_stage_model.text_model2.get_token_embeddings(tokens2, cond_stage_model.custom_vectors2, (float*)g.token_embeds2->data);
+            }
+        }
 
         int64_t t0 = ggml_time_ms();
         ggml_graph_compute_with_ctx(ctx, cond_graph, n_threads);
         int64_t t1 = ggml_time_ms();
         LOG_DEBUG("computing condition graph completed, taking %.2fs", (t1 - t0) * 1.0f / 1000);
 
-        ggml_tensor* result = ggml_dup_tensor(res_ctx, hidden_states);  // [N, n_token, hidden_size]
-
         {
-            int64_t nelements = ggml_nelements(hidden_states);
+            // SDXL context is hidden states of both text models side by side
+            std::vector<ggml_tensor*> parts = {g.hidden_states};
+            if (g.hidden_states2 != NULL) {
+                parts.push_back(g.hidden_states2);
+            }
+            int64_t n_positions = g.hidden_states->ne[1];
+            int64_t nelements = result->ne[0] * n_positions;
             float original_mean = 0.f;
             float new_mean = 0.f;
-            float* vec = (float*)hidden_states->data;
-            for (int i = 0; i < nelements; i++) {
-                original_mean += vec[i] / nelements * 1.0f;
+            for (ggml_tensor* hidden_states : parts) {
+                float* vec = (float*)hidden_states->data;
+                for (int i = 0; i < ggml_nelements(hidden_states); i++) {
+                    original_mean += vec[i] / nelements * 1.0f;
+                }
             }
 
-            for (int i2 = 0; i2 < hidden_states->ne[2]; i2++) {
-                for (int i1 = 0; i1 < hidden_states->ne[1]; i1++) {
-                    for (int i0 = 0; i0 < hidden_states->ne[0]; i0++) {
-                        float value = ggml_tensor_get_f32(hidden_states, i0, i1, i2);
-                        value *= weights[i1];
-                        ggml_tensor_set_f32(result, value, i0, i1, i2);
+            int64_t offset = chunk * n_positions;  // [1, 77, hidden_size] chunk follows previous one
+            int64_t col = 0;
+            for (ggml_tensor* hidden_states : parts) {
+                for (int i2 = 0; i2 < hidden_states->ne[2]; i2++) {
+                    for (int i1 = 0; i1 < hidden_states->ne[1]; i1++) {
+                        for (int i0 = 0; i0 < hidden_states->ne[0]; i0++) {
+                            float value = ggml_tensor_get_f32(hidden_states, i0, i1, i2);
+                            value *= weights[i1];
+                            ggml_tensor_set_f32(result, value, col + i0, offset + i1, i2);
+                        }
                     }
                 }
+                col += hidden_states->ne[0];
             }
 
-            vec = (float*)result->data;
+            float* vec = (float*)result->data + offset * result->ne[0];
             for (int i = 0; i < nelements; i++) {
                 new_mean += vec[i] / nelements * 1.0f;
             }
@@ -3349,6 +4904,10 @@ class StableDiffusionGGML {
             }
         }
 
+        if (pooled != NULL && g.pooled != NULL) {
+            memcpy(pooled->data, g.pooled->data, ggml_nbytes(pooled));
+        }
+
         // print_ggml_tensor(result);
 
         size_t rt_mem_size = ctx_size + ggml_curr_max_dynamic_size();
@@ -3375,17 +4934,27 @@ class StableDiffusionGGML {
 
         ggml_free(ctx);
 
-        return result;  // [1, 77, 768]
+        return true;
     }
 
+    // noise NULL: x_t is noise (txt2img), otherwise x_t is latent to be noised (img2img)
+    // c and uc have conditioning of each step, prompt editing changes it during sampling. uc is empty without cfg.
+    // With AND sub-prompts UNet is evaluated for each and guidance terms are added with sub-prompt weights
     ggml_tensor* sample(ggml_context* res_ctx,
                         ggml_tensor* x_t,
-                        ggml_tensor* c,
-                        ggml_tensor* uc,
-                        float cfg_scale,
+                        ggml_tensor* noise,
+                        const Conditioning& c,
+                        const std::vector<Condition>& uc,
+                        const SDParams& sd_params,
                         SampleMethod method,
-                        const std::vector<float>& sigmas) {
+                        const std::vector<float>& sigmas,
+                        std::shared_ptr<RNG> rng,
+                        int n_threads) {
+        if (!load_params(UNET_PARAMS)) {
+            return NULL;
+        }
         size_t steps = sigmas.size() - 1;
+        std::vector<float> cfg_scales = cfg_scale_schedule(sd_params, std::max((int)steps, 1));
         // x_t = load_tensor_from_file(res_ctx, "./rand0.bin");
         // print_ggml_tensor(x_t);
         struct ggml_tensor* x = ggml_dup_tensor(res_ctx, x_t);
@@ -3408,13 +4977,17 @@ class StableDiffusionGGML {
 
             ggml_set_dynamic(ctx, false);
             struct ggml_tensor* noised_input = ggml_dup_tensor(ctx, x_t);
-            struct ggml_tensor* context = ggml_dup_tensor(ctx, c);
+            struct ggml_tensor* context = ggml_dup_tensor(ctx, c.at(0, 0).context);
             struct ggml_tensor* timesteps = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, 1);                           // [N, ]
             struct ggml_tensor* t_emb = new_timestep_embedding(ctx, timesteps, diffusion_model.model_channels);  // [N, model_channels]
+            struct ggml_tensor* y = NULL;
+            if (diffusion_model.adm_in_channels > 0) {
+                y = ggml_new_tensor_2d(ctx, GGML_TYPE_F32, diffusion_model.adm_in_channels, 1);  // [N, adm_in_channels]
+            }
             ggml_set_dynamic(ctx, params.dynamic);
 
-            struct ggml_tensor* out = diffusion_model.forward(ctx, noised_input, NULL, context, t_emb);
-            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx);
+            struct ggml_tensor* out = diffusion_model.forward(ctx, noised_input, NULL, context, t_emb, y);
+            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx) + ggml_graph_overhead();
 
             struct ggml_cgraph* diffusion_graph = ggml_build_forward_ctx(ctx, out);
             struct ggml_cplan cplan = ggml_graph_plan(diffusion_graph, n_threads);
@@ -3441,12 +5014,16 @@ class StableDiffusionGGML {
 
         ggml_set_dynamic(ctx, false);
         struct ggml_tensor* noised_input = ggml_dup_tensor(ctx, x_t);
-        struct ggml_tensor* context = ggml_dup_tensor(ctx, c);
+        struct ggml_tensor* context = ggml_dup_tensor(ctx, c.at(0, 0).context);
         struct ggml_tensor* timesteps = ggml_new_tensor_1d(ctx, GGML_TYPE_F32, 1);                           // [N, ]
         struct ggml_tensor* t_emb = new_timestep_embedding(ctx, timesteps, diffusion_model.model_channels);  // [N, model_channels]
+        struct ggml_tensor* y = NULL;
+        if (diffusion_model.adm_in_channels > 0) {
+            y = ggml_new_tensor_2d(ctx, GGML_TYPE_F32, diffusion_model.adm_in_channels, 1);  // [N, adm_in_channels]
+        }
         ggml_set_dynamic(ctx, params.dynamic);
 
-        struct ggml_tensor* out = diffusion_model.forward(ctx, noised_input, NULL, context, t_emb);
+        struct ggml_tensor* out = diffusion_model.forward(ctx, noised_input, NULL, context, t_emb, y);
         ggml_hold_dynamic_tensor(out);
 
         struct ggml_cgraph* diffusion_graph = ggml_build_forward_ctx(ctx, out);
@@ -3458,11 +5035,18 @@ class StableDiffusionGGML {
 
         cplan.work_data = (uint8_t*)buf->data;
 
-        // x = x * sigmas[0]
+        // x = x * sigmas[0] or x = x + noise * sigmas[0]
         {
             float* vec = (float*)x->data;
-            for (int i = 0; i < ggml_nelements(x); i++) {
-                vec[i] = vec[i] * sigmas[0];
+            if (noise == NULL) {
+                for (int i = 0; i < ggml_nelements(x); i++) {
+                    vec[i] = vec[i] * sigmas[0];
+                }
+            } else {
+                float* vec_noise = (float*)noise->data;
+                for (int i = 0; i < ggml_nelements(x); i++) {
+                    vec[i] = vec[i] + vec_noise[i] * sigmas[0];
+                }
             }
         }
 
@@ -3470,14 +5054,46 @@ class StableDiffusionGGML {
         ggml_set_dynamic(ctx, false);
         struct ggml_tensor* out_cond = NULL;
         struct ggml_tensor* out_uncond = NULL;
-        if (cfg_scale != 1.0f && uc != NULL) {
+        if (has_guidance(cfg_scales) && !uc.empty()) {
             out_uncond = ggml_dup_tensor(ctx, x);
         }
+        bool composed = c.steps.size() > 1 || c.weights[0] != 1.0f;
+        struct ggml_tensor* out_sum = NULL;
+        if (composed) {
+            out_sum = ggml_dup_tensor(ctx, x);
+            LOG_INFO("composable diffusion with %zu sub-prompts", c.steps.size());
+        }
         struct ggml_tensor* denoised = ggml_dup_tensor(ctx, x);
         ggml_set_dynamic(ctx, params.dynamic);
 
+        // SDXL y is pooled text embedding followed by size and crop conditioning of this pass
+        std::vector<float> size_embed;
+        if (y != NULL) {
+            int width = (int)x_t->ne[0] * 8;
+            int height = (int)x_t->ne[1] * 8;
+            int original_width = sd_params.original_width > 0 ? sd_params.original_width : width;
+            int original_height = sd_params.original_height > 0 ? sd_params.original_height : height;
+            int target_width = sd_params.target_width > 0 ? sd_params.target_width : width;
+            int target_height = sd_params.target_height > 0 ? sd_params.target_height : height;
+            size_embed = size_embedding({(float)original_height, (float)original_width,
+                                         (float)sd_params.crop_top, (float)sd_params.crop_left,
+                                         (float)target_height, (float)target_width},
+                                        256);
+        }
+        auto set_condition = [&](const Condition& cond) {
+            copy_ggml_tensor(context, cond.context);
+            if (y != NULL) {
+                float* vec = (float*)y->data;
+                int64_t n_pooled = ggml_nelements(cond.pooled);
+                memcpy(vec, cond.pooled->data, n_pooled * sizeof(float));
+                memcpy(vec + n_pooled, size_embed.data(), size_embed.size() * sizeof(float));
+            }
+        };
+
         auto denoise = [&](ggml_tensor* input, float sigma, int step) {
             int64_t t0 = ggml_time_ms();
+            size_t step_index = std::max(std::abs(step), 1) - 1;
+            const Condition* step_uc = uc.empty() ? NULL : &uc[std::min(step_index, uc.size() - 1)];
 
             float c_skip = 1.0f;
             float c_out = 1.0f;
@@ -3505,32 +5121,84 @@ class StableDiffusionGGML {
                 }
             }
 
-            if (cfg_scale != 1.0 && uc != NULL) {
+            float cfg_scale = cfg_scales[std::min(step_index, cfg_scales.size() - 1)];
+            bool guided = cfg_scale != 1.0f && step_uc != NULL;
+            if (guided) {
                 // uncond
-                copy_ggml_tensor(context, uc);
+                set_condition(*step_uc);
                 ggml_graph_compute(diffusion_graph, &cplan);
                 copy_ggml_tensor(out_uncond, out);
+            }
 
-                // cond
-                copy_ggml_tensor(context, c);
+            // cond of each sub-prompt
+            float weight_sum = 0.f;
+            for (size_t k = 0; k < c.steps.size(); k++) {
+                set_condition(c.at(k, step_index));
                 ggml_graph_compute(diffusion_graph, &cplan);
+                if (!composed) {
+                    break;
+                }
+                // out_sum += weight * (out_cond - out_uncond) or weight * out_cond
+                float weight = c.weights[k];
+                float* vec_out = (float*)out->data;
+                float* vec_sum = (float*)out_sum->data;
+                float* vec_out_uncond = guided ? (float*)out_uncond->data : NULL;
+                for (int i = 0; i < ggml_nelements(out); i++) {
+                    float term = guided ? vec_out[i] - vec_out_uncond[i] : vec_out[i];
+                    vec_sum[i] = (k == 0 ? 0.f : vec_sum[i]) + weight * term;
+                }
+                weight_sum += weight;
+            }
+            out_cond = composed ? out_sum : out;
+
+            if (guided) {
+                // out_uncond + cfg_scale * (out_cond - out_uncond), sum of weighted differences when composed
+                float* vec_out = (float*)out->data;
+                float* vec_out_uncond = (float*)out_uncond->data;
+                float* vec_out_cond = (float*)out_cond->data;
+                int64_t n = ggml_nelements(out);
 
-                out_cond = out;
+                std::vector<float> diff(n);
+                for (int i = 0; i < n; i++) {
+                    diff[i] = composed ? vec_out_cond[i] : vec_out_cond[i] - vec_out_uncond[i];
+                }
+                for (int i = 0; i < n; i++) {
+                    vec_out[i] = vec_out_uncond[i] + cfg_scale * diff[i];
+                }
 
-                // out_uncond + cfg_scale * (out_cond - out_uncond)
-                {
-                    float* vec_out = (float*)out->data;
-                    float* vec_out_uncond = (float*)out_uncond->data;
-                    float* vec_out_cond = (float*)out_cond->data;
+                // thresholding is done on denoised values, out is converted there and back
+                if (sd_params.dynthres_mimic_scale > 0.f && c_out != 0.f) {
+                    float* vec_input = (float*)input->data;
+                    std::vector<float> uncond_x0(n);
+                    std::vector<float> diff_x0(n);
+                    std::vector<float> result_x0(n);
+                    for (int i = 0; i < n; i++) {
+                        uncond_x0[i] = vec_out_uncond[i] * c_out + vec_input[i] * c_skip;
+                        diff_x0[i] = diff[i] * c_out;
+                    }
+                    dynamic_thresholding(result_x0.data(), uncond_x0.data(), diff_x0.data(),
+                                         out->ne[0] * out->ne[1], out->ne[2] * out->ne[3],
+                                         cfg_scale, sd_params.dynthres_mimic_scale, sd_params.dynthres_percentile);
+                    for (int i = 0; i < n; i++) {
+                        vec_out[i] = (result_x0[i] - vec_input[i] * c_skip) / c_out;
+                    }
+                }
 
-                    for (int i = 0; i < ggml_nelements(out); i++) {
-                        vec_out[i] = vec_out_uncond[i] + cfg_scale * (vec_out_cond[i] - vec_out_uncond[i]);
+                if (sd_params.cfg_rescale > 0.f) {
+                    std::vector<float> cond(n);
+                    for (int i = 0; i < n; i++) {
+                        cond[i] = vec_out_uncond[i] + diff[i];
                     }
+                    rescale_cfg(vec_out, cond.data(), n, sd_params.cfg_rescale);
+                }
+            } else if (composed) {
+                // weighted average of sub-prompts
+                float* vec_out = (float*)out->data;
+                float* vec_sum = (float*)out_sum->data;
+                float scale = weight_sum != 0.f ? 1.0f / weight_sum : 1.0f;
+                for (int i = 0; i < ggml_nelements(out); i++) {
+                    vec_out[i] = vec_sum[i] * scale;
                 }
-            } else {
-                // cond
-                copy_ggml_tensor(context, c);
-                ggml_graph_compute(diffusion_graph, &cplan);
             }
 
             // v = out, eps = out
@@ -3931,36 +5599,225 @@ class StableDiffusionGGML {
                 abort();
         }
 
-        size_t rt_mem_size = ctx_size + ggml_curr_max_dynamic_size();
-        if (rt_mem_size > max_rt_mem_size) {
-            max_rt_mem_size = rt_mem_size;
+        size_t rt_mem_size = ctx_size + ggml_curr_max_dynamic_size();
+        if (rt_mem_size > max_rt_mem_size) {
+            max_rt_mem_size = rt_mem_size;
+        }
+        size_t graph_mem_size = ggml_used_mem(unet_params_ctx) + rt_mem_size;
+
+        size_t curr_mem_size = curr_params_mem_size + rt_mem_size;
+        if (curr_mem_size > max_mem_size) {
+            max_mem_size = curr_mem_size;
+        }
+
+        LOG_INFO(
+            "diffusion graph use %.2fMB of memory: params %.2fMB, "
+            "runtime %.2fMB (static %.2fMB, dynamic %.2fMB)",
+            graph_mem_size * 1.0f / 1024 / 1024,
+            ggml_used_mem(unet_params_ctx) * 1.0f / 1024 / 1024,
+            rt_mem_size * 1.0f / 1024 / 1024,
+            ctx_size * 1.0f / 1024 / 1024,
+            ggml_curr_max_dynamic_size() * 1.0f / 1024 / 1024);
+        LOG_DEBUG("%zu bytes of dynamic memory has not been released yet", ggml_dynamic_size());
+
+        ggml_free(ctx);
+
+        return x;
+    }
+
+    // weight += scale * up x down. up is [out, rank], down is [rank, inner] where inner covers rest of weight
+    // dimensions. Original weight is saved for restore_weights
+    bool add_weight_delta(const std::string& name,
+                          const float* up,
+                          const float* down,
+                          int out,
+                          int rank,
+                          int inner,
+                          float scale) {
+        auto it = tensors.find(name);
+        if (it == tensors.end()) {
+            LOG_WARN("lora weight '%s' not in model", name.c_str());
+            return false;
+        }
+        // delta goes to weights in memory, released weights are read first
+        ParamsComponent component = has_prefix(name, params_prefix(CLIP_PARAMS))   ? CLIP_PARAMS
+                                     : has_prefix(name, params_prefix(UNET_PARAMS)) ? UNET_PARAMS
+                                                                                    : VAE_PARAMS;
+        if (!load_params(component)) {
+            return false;
+        }
+        struct ggml_tensor* tensor = tensors[name];
+        int64_t n = ggml_nelements(tensor);
+        if ((int64_t)out * inner != n) {
+            LOG_ERROR("lora weight '%s' size %d x %d does not match %lld elements", name.c_str(), out, inner, (long long)n);
+            return false;
+        }
+        if (tensor->type != GGML_TYPE_F32 && tensor->type != GGML_TYPE_F16 && ggml_internal_get_type_traits(tensor->type).to_float == NULL) {
+            LOG_ERROR("lora weight '%s' has unsupported type %s", name.c_str(), ggml_type_name(tensor->type));
+            return false;
+        }
+
+        if (weight_backups.find(name) == weight_backups.end()) {
+            uint8_t* data = (uint8_t*)tensor->data;
+            weight_backups[name] = std::vector<uint8_t>(data, data + ggml_nbytes(tensor));
+        }
+
+        std::vector<float> w(n);
+        if (tensor->type == GGML_TYPE_F32) {
+            memcpy(w.data(), tensor->data, n * sizeof(float));
+        } else if (tensor->type == GGML_TYPE_F16) {
+            ggml_fp16_to_fp32_row((ggml_fp16_t*)tensor->data, w.data(), (int)n);
+        } else {
+            ggml_internal_get_type_traits(tensor->type).to_float(tensor->data, w.data(), (int)n);
+        }
+
+        std::vector<float> row(inner);
+        for (int o = 0; o < out; o++) {
+            std::fill(row.begin(), row.end(), 0.0f);
+            for (int r = 0; r < rank; r++) {
+                float u = up[o * rank + r] * scale;
+                const float* d = down + (size_t)r * inner;
+                for (int i = 0; i < inner; i++) {
+                    row[i] += u * d[i];
+                }
+            }
+            float* dst = w.data() + (size_t)o * inner;
+            for (int i = 0; i < inner; i++) {
+                dst[i] += row[i];
+            }
+        }
+
+        if (tensor->type == GGML_TYPE_F32) {
+            memcpy(tensor->data, w.data(), n * sizeof(float));
+        } else if (tensor->type == GGML_TYPE_F16) {
+            ggml_fp32_to_fp16_row(w.data(), (ggml_fp16_t*)tensor->data, (int)n);
+        } else {
+            std::vector<int64_t> hist(1 << 4, 0);
+            ggml_quantize_chunk(tensor->type, w.data(), tensor->data, 0, (int)n, hist.data());
+        }
+        return true;
+    }
+
+    // shape of vae weight in ggml order, false if name is not vae weight of model
+    bool vae_tensor_shape(const std::string& name, int64_t* ne) {
+        if (!has_prefix(name, params_prefix(VAE_PARAMS)) || tensors.find(name) == tensors.end()) {
+            return false;
+        }
+        if (!load_params(VAE_PARAMS)) {
+            return false;
+        }
+        struct ggml_tensor* tensor = tensors[name];
+        for (int i = 0; i < 4; i++) {
+            ne[i] = tensor->ne[i];
+        }
+        return true;
+    }
+
+    // replaces vae weight with weight of external vae file
+    bool set_vae_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+        if (!has_prefix(name, params_prefix(VAE_PARAMS)) || tensors.find(name) == tensors.end()) {
+            LOG_ERROR("'%s' is not vae weight of model", name.c_str());
+            return false;
         }
-        size_t graph_mem_size = ggml_used_mem(unet_params_ctx) + rt_mem_size;
+        if (!load_params(VAE_PARAMS)) {
+            return false;
+        }
+        vae_replaced = true;
+        weight_backups.erase(name);
+        return set_tensor_data(name, tensors[name], ne, data);
+    }
 
-        size_t curr_mem_size = curr_params_mem_size + rt_mem_size;
-        if (curr_mem_size > max_mem_size) {
-            max_mem_size = curr_mem_size;
+    // prepares TAESD weights for set_taesd_tensor, weights are created on first load
+    bool begin_taesd() {
+        if (taesd_params_ctx == NULL) {
+            struct ggml_init_params params;
+            params.mem_size = 1 * 1024 * 1024 + taesd.compute_params_mem_size();  // 1 MB, for padding
+            params.mem_buffer = NULL;
+            params.no_alloc = false;
+            params.dynamic = false;
+            taesd_params_ctx = ggml_init(params);
+            if (!taesd_params_ctx) {
+                LOG_ERROR("ggml_init() failed");
+                return false;
+            }
+            taesd.init_params(taesd_params_ctx);
+            taesd.map_by_name(taesd_tensors, "");
+            for (auto& pair : taesd_tensors) {
+                ggml_set_name(pair.second, ("taesd." + pair.first).c_str());
+            }
+            LOG_DEBUG("taesd params ctx size = % 6.2f MB", ggml_used_mem(taesd_params_ctx) / (1024.0 * 1024.0));
         }
+        taesd_loaded_names.clear();
+        return true;
+    }
 
-        LOG_INFO(
-            "diffusion graph use %.2fMB of memory: params %.2fMB, "
-            "runtime %.2fMB (static %.2fMB, dynamic %.2fMB)",
-            graph_mem_size * 1.0f / 1024 / 1024,
-            ggml_used_mem(unet_params_ctx) * 1.0f / 1024 / 1024,
-            rt_mem_size * 1.0f / 1024 / 1024,
-            ctx_size * 1.0f / 1024 / 1024,
-            ggml_curr_max_dynamic_size() * 1.0f / 1024 / 1024);
-        LOG_DEBUG("%zu bytes of dynamic memory has not been released yet", ggml_dynamic_size());
+    // sets TAESD weight, name is "decoder." or "encoder." and index in torch Sequential
+    bool set_taesd_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+        auto it = taesd_tensors.find(name);
+        if (taesd_params_ctx == NULL || it == taesd_tensors.end()) {
+            LOG_ERROR("unknown TAESD tensor '%s'", name.c_str());
+            return false;
+        }
+        if (has_prefix(name, "decoder.")) {
+            taesd_has_decoder = false;
+        } else {
+            taesd_has_encoder = false;
+        }
+        taesd_loaded_names.insert(name);
+        return set_tensor_data(name, it->second, ne, data);
+    }
 
-        ggml_free(ctx);
+    // checks that decoder and encoder got all weights. Part without any weights keeps earlier state
+    bool end_taesd() {
+        if (taesd_loaded_names.empty()) {
+            LOG_ERROR("no TAESD weights loaded");
+            return false;
+        }
+        const char* parts[] = {"decoder.", "encoder."};
+        for (const char* part : parts) {
+            int n_given = 0;
+            std::string missing;
+            for (auto& pair : taesd_tensors) {
+                if (!has_prefix(pair.first, part)) {
+                    continue;
+                }
+                if (taesd_loaded_names.find(pair.first) != taesd_loaded_names.end()) {
+                    n_given++;
+                } else if (missing.empty()) {
+                    missing = pair.first;
+                }
+            }
+            if (n_given == 0) {
+                continue;
+            }
+            if (!missing.empty()) {
+                LOG_ERROR("TAESD tensor '%s' not in file", missing.c_str());
+                return false;
+            }
+            if (part[0] == 'd') {
+                taesd_has_decoder = true;
+            } else {
+                taesd_has_encoder = true;
+            }
+        }
+        LOG_INFO("TAESD loaded, decoder %s, encoder %s", taesd_has_decoder ? "yes" : "no", taesd_has_encoder ? "yes" : "no");
+        return true;
+    }
 
-        return x;
+    // puts back weights changed by add_weight_delta
+    void restore_weights() {
+        for (auto& pair : weight_backups) {
+            struct ggml_tensor* tensor = tensors[pair.first];
+            memcpy(tensor->data, pair.second.data(), pair.second.size());
+        }
+        weight_backups.clear();
     }
 
-    ggml_tensor* encode_first_stage(ggml_context* res_ctx, ggml_tensor* x) {
-        int64_t W = x->ne[0];
-        int64_t H = x->ne[1];
+    // runs whole vae encoder (moments) or decoder (image) graph for x
+    // tiny: TAESD instead of full vae, encoder gives latent instead of moments
+    ggml_tensor* compute_first_stage(ggml_context* res_ctx, ggml_tensor* x, bool decode, int n_threads, bool tiny = false) {
         struct ggml_tensor* result = NULL;
+        ggml_context* weights_ctx = tiny ? taesd_params_ctx : vae_params_ctx;
 
         // calculate the amount of memory required
         size_t ctx_size = 10 * 1024 * 1024;  // 10MB
@@ -3977,10 +5834,11 @@ class StableDiffusionGGML {
                 return NULL;
             }
 
-            struct ggml_tensor* moments = first_stage_model.encode(ctx, x);
-            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx);
+            struct ggml_tensor* out = tiny ? (decode ? taesd.decode(ctx, x) : taesd.encode(ctx, x))
+                                           : (decode ? first_stage_model.decode(ctx, x) : first_stage_model.encode(ctx, x));
+            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx) + ggml_graph_overhead();
 
-            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, moments);
+            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, out);
             struct ggml_cplan cplan = ggml_graph_plan(vae_graph, n_threads);
 
             ctx_size += cplan.work_size;
@@ -4004,8 +5862,9 @@ class StableDiffusionGGML {
                 return NULL;
             }
 
-            struct ggml_tensor* moments = first_stage_model.encode(ctx, x);
-            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, moments);
+            struct ggml_tensor* out = tiny ? (decode ? taesd.decode(ctx, x) : taesd.encode(ctx, x))
+                                           : (decode ? first_stage_model.decode(ctx, x) : first_stage_model.encode(ctx, x));
+            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, out);
 
             int64_t t0 = ggml_time_ms();
             ggml_graph_compute_with_ctx(ctx, vae_graph, n_threads);
@@ -4016,14 +5875,14 @@ class StableDiffusionGGML {
 #endif
             LOG_DEBUG("computing vae graph completed, taking %.2fs", (t1 - t0) * 1.0f / 1000);
 
-            result = ggml_dup_tensor(res_ctx, moments);
-            copy_ggml_tensor(result, moments);
+            result = ggml_dup_tensor(res_ctx, out);
+            copy_ggml_tensor(result, out);
 
             size_t rt_mem_size = ctx_size + ggml_curr_max_dynamic_size();
             if (rt_mem_size > max_rt_mem_size) {
                 max_rt_mem_size = rt_mem_size;
             }
-            size_t graph_mem_size = ggml_used_mem(vae_params_ctx) + rt_mem_size;
+            size_t graph_mem_size = ggml_used_mem(weights_ctx) + rt_mem_size;
 
             size_t curr_mem_size = curr_params_mem_size + rt_mem_size;
             if (curr_mem_size > max_mem_size) {
@@ -4034,7 +5893,7 @@ class StableDiffusionGGML {
                 "vae graph use %.2fMB of memory: params %.2fMB, "
                 "runtime %.2fMB (static %.2fMB, dynamic %.2fMB)",
                 graph_mem_size * 1.0f / 1024 / 1024,
-                ggml_used_mem(vae_params_ctx) * 1.0f / 1024 / 1024,
+                ggml_used_mem(weights_ctx) * 1.0f / 1024 / 1024,
                 rt_mem_size * 1.0f / 1024 / 1024,
                 ctx_size * 1.0f / 1024 / 1024,
                 ggml_curr_max_dynamic_size() * 1.0f / 1024 / 1024);
@@ -4046,8 +5905,129 @@ class StableDiffusionGGML {
         return result;
     }
 
+    // tile start positions (in latent units) covering length, neighbour tiles overlap at least by overlap
+    static std::vector<int> vae_tile_positions(int length, int tile, int overlap) {
+        std::vector<int> positions;
+        if (length <= tile) {
+            positions.push_back(0);
+            return positions;
+        }
+        int n = std::max(2, (int)std::ceil((float)(length - overlap) / (tile - overlap)));
+        for (int i = 0; i < n; i++) {
+            positions.push_back((int)std::round((float)i * (length - tile) / (n - 1)));
+        }
+        return positions;
+    }
+
+    // linear weight ramp over overlap on edges that have neighbour tile
+    static float vae_tile_weight(int pos, int length, int overlap, bool ramp_start, bool ramp_end) {
+        float w = 1.0f;
+        if (ramp_start) {
+            w = std::min(w, (pos + 0.5f) / overlap);
+        }
+        if (ramp_end) {
+            w = std::min(w, (length - pos - 0.5f) / overlap);
+        }
+        return w;
+    }
+
+    // same as compute_first_stage but in overlapping tiles, runtime memory stays same as with one tile
+    ggml_tensor* compute_first_stage_tiled(ggml_context* res_ctx, ggml_tensor* x, bool decode, int n_threads, bool tiny = false) {
+        const int tile = VAE_TILE_SIZE;        // in latent units, 64 = 512px
+        const int overlap = VAE_TILE_OVERLAP;  // in latent units
+        const int in_scale = decode ? 1 : 8;
+        const int out_scale = decode ? 8 : 1;
+
+        int lw = (int)x->ne[0] / in_scale;
+        int lh = (int)x->ne[1] / in_scale;
+        int in_c = (int)x->ne[2];
+        int out_c = decode ? 3 : (tiny ? TinyAutoEncoder::latent_channels : 8);
+
+        int tile_w = std::min(tile, lw);
+        int tile_h = std::min(tile, lh);
+        std::vector<int> xs = vae_tile_positions(lw, tile_w, overlap);
+        std::vector<int> ys = vae_tile_positions(lh, tile_h, overlap);
+        LOG_INFO("vae %s with %zu tiles of %dx%d", decode ? "decode" : "encode", xs.size() * ys.size(), tile_w * 8, tile_h * 8);
+
+        int out_w = lw * out_scale;
+        int out_h = lh * out_scale;
+        struct ggml_tensor* result = ggml_new_tensor_4d(res_ctx, GGML_TYPE_F32, out_w, out_h, out_c, 1);
+        std::vector<float> weights((size_t)out_w * out_h, 0.0f);
+        std::vector<float> sums((size_t)out_w * out_h * out_c, 0.0f);
+
+        int tile_in_w = tile_w * in_scale;
+        int tile_in_h = tile_h * in_scale;
+        int tile_out_w = tile_w * out_scale;
+        int tile_out_h = tile_h * out_scale;
+        for (int ty : ys) {
+            for (int tx : xs) {
+                struct ggml_init_params params;
+                params.mem_size = static_cast<size_t>(1024 * 1024);  // 1M
+                params.mem_size += (size_t)tile_in_w * tile_in_h * in_c * sizeof(float);
+                params.mem_size += (size_t)tile_out_w * tile_out_h * out_c * sizeof(float);
+                params.mem_buffer = NULL;
+                params.no_alloc = false;
+                params.dynamic = false;
+                struct ggml_context* tile_ctx = ggml_init(params);
+                if (!tile_ctx) {
+                    LOG_ERROR("ggml_init() failed");
+                    return NULL;
+                }
+
+                struct ggml_tensor* tile_in = ggml_new_tensor_4d(tile_ctx, GGML_TYPE_F32, tile_in_w, tile_in_h, in_c, 1);
+                for (int c = 0; c < in_c; c++) {
+                    for (int y = 0; y < tile_in_h; y++) {
+                        for (int x_ = 0; x_ < tile_in_w; x_++) {
+                            float value = ggml_tensor_get_f32(x, tx * in_scale + x_, ty * in_scale + y, c);
+                            ggml_tensor_set_f32(tile_in, value, x_, y, c);
+                        }
+                    }
+                }
+
+                struct ggml_tensor* tile_out = compute_first_stage(tile_ctx, tile_in, decode, n_threads, tiny);
+                if (tile_out == NULL) {
+                    ggml_free(tile_ctx);
+                    return NULL;
+                }
+
+                int ox = tx * out_scale;
+                int oy = ty * out_scale;
+                for (int y = 0; y < tile_out_h; y++) {
+                    float wy = vae_tile_weight(y, tile_out_h, overlap * out_scale, ty > 0, ty + tile_h < lh);
+                    for (int x_ = 0; x_ < tile_out_w; x_++) {
+                        float wx = vae_tile_weight(x_, tile_out_w, overlap * out_scale, tx > 0, tx + tile_w < lw);
+                        size_t pos = (size_t)(oy + y) * out_w + ox + x_;
+                        weights[pos] += wx * wy;
+                        for (int c = 0; c < out_c; c++) {
+                            sums[pos + (size_t)c * out_w * out_h] += wx * wy * ggml_tensor_get_f32(tile_out, x_, y, c);
+                        }
+                    }
+                }
+                ggml_free(tile_ctx);
+            }
+        }
+
+        float* vec = (float*)result->data;
+        for (int c = 0; c < out_c; c++) {
+            for (size_t pos = 0; pos < weights.size(); pos++) {
+                vec[pos + (size_t)c * out_w * out_h] = sums[pos + (size_t)c * out_w * out_h] / weights[pos];
+            }
+        }
+        return result;
+    }
+
+    ggml_tensor* encode_first_stage(ggml_context* res_ctx, ggml_tensor* x, bool tiled, int n_threads) {
+        if (!load_params(VAE_PARAMS)) {
+            return NULL;
+        }
+        if (tiled) {
+            return compute_first_stage_tiled(res_ctx, x, false, n_threads);
+        }
+        return compute_first_stage(res_ctx, x, false, n_threads);
+    }
+
     // ldm.models.diffusion.ddpm.LatentDiffusion.get_first_stage_encoding
-    ggml_tensor* get_first_stage_encoding(ggml_context* res_ctx, ggml_tensor* moments) {
+    ggml_tensor* get_first_stage_encoding(ggml_context* res_ctx, ggml_tensor* moments, std::shared_ptr<RNG> rng) {
         // ldm.modules.distributions.distributions.DiagonalGaussianDistribution.sample
         ggml_tensor* latent = ggml_new_tensor_4d(res_ctx, moments->type, moments->ne[0],
                                                  moments->ne[1], moments->ne[2] / 2, moments->ne[3]);
@@ -4079,11 +6059,10 @@ class StableDiffusionGGML {
         return latent;
     }
 
-    ggml_tensor* decode_first_stage(ggml_context* res_ctx, ggml_tensor* z) {
-        int64_t W = z->ne[0];
-        int64_t H = z->ne[1];
-        struct ggml_tensor* result_img = NULL;
-
+    ggml_tensor* decode_first_stage(ggml_context* res_ctx, ggml_tensor* z, bool tiled, int n_threads) {
+        if (!load_params(VAE_PARAMS)) {
+            return NULL;
+        }
         {
             float* vec = (float*)z->data;
             for (int i = 0; i < ggml_nelements(z); i++) {
@@ -4091,88 +6070,146 @@ class StableDiffusionGGML {
             }
         }
 
-        // calculate the amount of memory required
-        size_t ctx_size = 10 * 1024 * 1024;  // 10MB
-        {
-            struct ggml_init_params params;
-            params.mem_size = ctx_size;
-            params.mem_buffer = NULL;
-            params.no_alloc = true;
-            params.dynamic = dynamic;
+        if (tiled) {
+            return compute_first_stage_tiled(res_ctx, z, true, n_threads);
+        }
+        return compute_first_stage(res_ctx, z, true, n_threads);
+    }
 
-            struct ggml_context* ctx = ggml_init(params);
-            if (!ctx) {
-                LOG_ERROR("ggml_init() failed");
-                return NULL;
+    // decodes latent with TAESD when sd_params asks, otherwise with full vae
+    ggml_tensor* decode_latent(ggml_context* res_ctx, ggml_tensor* z, const SDParams& sd_params, int n_threads) {
+        if (!sd_params.taesd) {
+            return decode_first_stage(res_ctx, z, sd_params.vae_tiling, n_threads);
+        }
+        if (!taesd_has_decoder) {
+            LOG_ERROR("TAESD decoder not loaded");
+            return NULL;
+        }
+        ggml_tensor* img = sd_params.vae_tiling ? compute_first_stage_tiled(res_ctx, z, true, n_threads, true)
+                                                : compute_first_stage(res_ctx, z, true, n_threads, true);
+        if (img != NULL) {
+            // [0, 1] to range of vae output
+            float* vec = (float*)img->data;
+            for (int i = 0; i < ggml_nelements(img); i++) {
+                vec[i] = 2 * vec[i] - 1;
             }
-
-            struct ggml_tensor* img = first_stage_model.decoder.forward(ctx, z);
-            ctx_size += ggml_used_mem(ctx) + ggml_used_mem_of_data(ctx);
-
-            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, img);
-            struct ggml_cplan cplan = ggml_graph_plan(vae_graph, n_threads);
-
-            ctx_size += cplan.work_size;
-            LOG_DEBUG("vae context need %.2fMB static memory, with work_size needing %.2fMB",
-                      ctx_size * 1.0f / 1024 / 1024,
-                      cplan.work_size * 1.0f / 1024 / 1024);
-
-            ggml_free(ctx);
         }
+        return img;
+    }
 
-        {
-            struct ggml_init_params params;
-            params.mem_size = ctx_size;
-            params.mem_buffer = NULL;
-            params.no_alloc = false;
-            params.dynamic = dynamic;
+    // encodes image to latent with TAESD when sd_params asks and encoder is loaded, otherwise with full vae
+    ggml_tensor* encode_image(ggml_context* res_ctx, ggml_tensor* x, const SDParams& sd_params, std::shared_ptr<RNG> rng, int n_threads) {
+        if (sd_params.taesd && taesd_has_encoder) {
+            ggml_tensor* img = ggml_dup_tensor(res_ctx, x);
+            float* src = (float*)x->data;
+            float* vec = (float*)img->data;
+            for (int i = 0; i < ggml_nelements(img); i++) {
+                vec[i] = (src[i] + 1) * 0.5f;
+            }
+            if (sd_params.vae_tiling) {
+                return compute_first_stage_tiled(res_ctx, img, false, n_threads, true);
+            }
+            return compute_first_stage(res_ctx, img, false, n_threads, true);
+        }
+        if (sd_params.taesd) {
+            LOG_INFO("TAESD encoder not loaded, encoding with vae");
+        }
+        ggml_tensor* moments = encode_first_stage(res_ctx, x, sd_params.vae_tiling, n_threads);
+        if (moments == NULL) {
+            return NULL;
+        }
+        return get_first_stage_encoding(res_ctx, moments, rng);
+    }
 
-            struct ggml_context* ctx = ggml_init(params);
-            if (!ctx) {
-                LOG_ERROR("ggml_init() failed");
-                return NULL;
+    // latent fill of img2img: latent outside content area gets noise, so diffusion invents content there
+    // instead of repeating what encoder made of padding. Latent pixels touching content are kept
+    void fill_latent_noise(ggml_tensor* latent, const SDParams& sd_params, std::shared_ptr<RNG> rng) {
+        int64_t W = latent->ne[0];
+        int64_t H = latent->ne[1];
+        int64_t C = latent->ne[2] * latent->ne[3];
+        int64_t x0 = sd_params.content_x / 8;
+        int64_t y0 = sd_params.content_y / 8;
+        int64_t x1 = (sd_params.content_x + sd_params.content_width + 7) / 8;
+        int64_t y1 = (sd_params.content_y + sd_params.content_height + 7) / 8;
+        std::vector<float> noise = rng->randn(W * H * C);
+        float* vec = (float*)latent->data;
+        for (int64_t c = 0; c < C; c++) {
+            for (int64_t y = 0; y < H; y++) {
+                for (int64_t x = 0; x < W; x++) {
+                    if (x < x0 || x1 <= x || y < y0 || y1 <= y) {
+                        int64_t i = (c * H + y) * W + x;
+                        vec[i] = noise[i];
+                    }
+                }
             }
+        }
+    }
 
-            struct ggml_tensor* img = first_stage_model.decode(ctx, z);
-            struct ggml_cgraph* vae_graph = ggml_build_forward_ctx(ctx, img);
+    // partial denoise of img2img and hires fix. Like A1111, t_enc = steps * strength and last t_enc + 1 sigmas of full
+    // schedule are sampled. t_enc is clamped so that strength 1.0 samples whole schedule. Returns number of steps
+    static int partial_sample_steps(int steps, float strength) {
+        int t_enc = std::max(0, std::min(static_cast<int>(steps * strength), steps - 1));
+        return t_enc + 1;
+    }
 
-            int64_t t0 = ggml_time_ms();
-            ggml_graph_compute_with_ctx(ctx, vae_graph, n_threads);
-            int64_t t1 = ggml_time_ms();
+    // sigmas of partial denoise, see partial_sample_steps
+    std::vector<float> partial_sigmas(int steps, float strength) {
+        std::vector<float> sigmas = denoiser->schedule->get_sigmas(steps);
+        return std::vector<float>(sigmas.end() - partial_sample_steps(steps, strength) - 1, sigmas.end());
+    }
 
-#ifdef GGML_PERF
-            ggml_graph_print(&vae_graph);
-#endif
-            LOG_DEBUG("computing vae graph completed, taking %.2fs", (t1 - t0) * 1.0f / 1000);
+    // number of steps hires fix samples
+    int hires_sample_steps(const SDParams& sd_params) {
+        int steps = sd_params.hires_steps > 0 ? sd_params.hires_steps : sd_params.sample_steps;
+        return partial_sample_steps(steps, sd_params.hires_denoise);
+    }
 
-            result_img = ggml_dup_tensor(res_ctx, img);
-            copy_ggml_tensor(result_img, img);
+    // hires fix second pass: upscale latent x_0 (or decoded image) and run partial img2img on larger size
+
+    ggml_tensor* hires_fix(ggml_context* res_ctx,
+                           ggml_tensor* x_0,
+                           const Conditioning& c,
+                           const std::vector<Condition>& uc,
+                           const SDParams& sd_params,
+                           std::shared_ptr<RNG> rng,
+                           int n_threads) {
+        int W = sd_params.hires_width / 8;
+        int H = sd_params.hires_height / 8;
+        int C = (int)x_0->ne[2];
+        int steps = sd_params.hires_steps > 0 ? sd_params.hires_steps : sd_params.sample_steps;
+        bool latent_mode = sd_params.hires_latent;
+        if (!latent_mode && first_stage_model.decode_only) {
+            LOG_WARN("vae encoder not loaded, hires fix upscales in latent space");
+            latent_mode = true;
+        }
 
-            size_t rt_mem_size = ctx_size + ggml_curr_max_dynamic_size();
-            if (rt_mem_size > max_rt_mem_size) {
-                max_rt_mem_size = rt_mem_size;
+        ggml_tensor* latent = NULL;
+        if (latent_mode) {
+            latent = ggml_new_tensor_4d(res_ctx, GGML_TYPE_F32, W, H, C, 1);
+            ggml_tensor_resize_bilinear(x_0, latent);
+        } else {
+            ggml_tensor* img = decode_latent(res_ctx, x_0, sd_params, n_threads);
+            if (img == NULL) {
+                return NULL;
             }
-            size_t graph_mem_size = ggml_used_mem(vae_params_ctx) + rt_mem_size;
-
-            size_t curr_mem_size = curr_params_mem_size + rt_mem_size;
-            if (curr_mem_size > max_mem_size) {
-                max_mem_size = curr_mem_size;
+            ggml_tensor* big_img = ggml_new_tensor_4d(res_ctx, GGML_TYPE_F32, W * 8, H * 8, img->ne[2], 1);
+            ggml_tensor_resize_bilinear(img, big_img);
+            float* vec = (float*)big_img->data;
+            for (int i = 0; i < ggml_nelements(big_img); i++) {
+                vec[i] = std::max(-1.0f, std::min(vec[i], 1.0f));
+            }
+            latent = encode_image(res_ctx, big_img, sd_params, rng, n_threads);
+            if (latent == NULL) {
+                return NULL;
             }
-
-            LOG_INFO(
-                "vae graph use %.2fMB of memory: params %.2fMB, "
-                "runtime %.2fMB (static %.2fMB, dynamic %.2fMB)",
-                graph_mem_size * 1.0f / 1024 / 1024,
-                ggml_used_mem(vae_params_ctx) * 1.0f / 1024 / 1024,
-                rt_mem_size * 1.0f / 1024 / 1024,
-                ctx_size * 1.0f / 1024 / 1024,
-                ggml_curr_max_dynamic_size() * 1.0f / 1024 / 1024);
-            LOG_DEBUG("%zu bytes of dynamic memory has not been released yet", ggml_dynamic_size());
-
-            ggml_free(ctx);
         }
 
-        return result_img;
+        std::vector<float> sigma_sched = partial_sigmas(steps, sd_params.hires_denoise);
+        LOG_INFO("hires fix %dx%d, %d steps in %s space", W * 8, H * 8, (int)sigma_sched.size() - 1, latent_mode ? "latent" : "pixel");
+
+        struct ggml_tensor* noise = ggml_dup_tensor(res_ctx, latent);
+        ggml_tensor_set_f32_randn(noise, rng);
+        return sample(res_ctx, latent, noise, c, uc, sd_params, sd_params.sample_method, sigma_sched, rng, n_threads);
     }
 };
 
@@ -4188,22 +6225,88 @@ StableDiffusion::StableDiffusion(int n_threads,
                                                rng_type);
 }
 
-bool StableDiffusion::load_from_file(const std::string& file_path, Schedule s) {
-    return sd->load_from_file(file_path, s);
+bool StableDiffusion::load_from_file(const std::string& file_path, Schedule s, bool use_mmap) {
+    return sd->load_from_file(file_path, s, use_mmap);
+}
+
+bool StableDiffusion::load_begin(const std::string& file_path, int model_type, int ftype) {
+    LOG_INFO("loading model from checkpoint '%s'", file_path.c_str());
+    if (model_type < 0 || model_type >= MODEL_TYPE_COUNT) {
+        LOG_ERROR("invalid model type %d", model_type);
+        return false;
+    }
+    ggml_type wtype = ggml_ftype_to_ggml_type((ggml_ftype)ftype);
+    if (wtype == GGML_TYPE_COUNT) {
+        LOG_ERROR("invalid ftype %d", ftype);
+        return false;
+    }
+    sd->ftype = (model_type << 16) | ftype;
+    return sd->init_params((ModelType)model_type, wtype);
+}
+
+void StableDiffusion::add_vocab_token(const std::string& token, int id) {
+    sd->cond_stage_model.tokenizer.add_token(token, id);
+}
+
+bool StableDiffusion::load_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+    return sd->load_tensor(name, ne, data);
+}
+
+bool StableDiffusion::load_end(const float* alphas_cumprod, Schedule s) {
+    return sd->finish_loading(alphas_cumprod, s);
 }
 
-std::vector<uint8_t> StableDiffusion::txt2img(const std::string& prompt,
-                                              const std::string& negative_prompt,
-                                              float cfg_scale,
-                                              int width,
-                                              int height,
-                                              SampleMethod sample_method,
-                                              int sample_steps,
-                                              int64_t seed) {
+int StableDiffusion::model_type() {
+    return sd->cond_stage_model.model_type;
+}
+
+// marks generation running on weights while in scope, see release_params
+struct GenerationScope {
+    std::shared_ptr<StableDiffusionGGML> sd;
+
+    GenerationScope(std::shared_ptr<StableDiffusionGGML> sd)
+        : sd(sd) {
+        sd->begin_generation();
+    }
+    ~GenerationScope() {
+        sd->end_generation();
+    }
+};
+
+// low memory mode releases weights of each phase after use when no other generation runs
+static std::vector<uint8_t> generate_txt2img(std::shared_ptr<StableDiffusionGGML> sd,
+                                             int n_threads,
+                                             const SDParams& sd_params) {
+    GenerationScope scope(sd);
+    bool free_params = sd->free_params_immediately;
+    const std::string& prompt = sd_params.prompt;
+    const std::string& negative_prompt = sd_params.negative_prompt;
+    int width = sd_params.width;
+    int height = sd_params.height;
+    SampleMethod sample_method = sd_params.sample_method;
+    int sample_steps = sd_params.sample_steps;
+    int64_t seed = sd_params.seed;
+    bool hires = sd_params.hires_width > 0 && sd_params.hires_height > 0;
+
     std::vector<uint8_t> result;
     struct ggml_init_params params;
     params.mem_size = static_cast<size_t>(10 * 1024) * 1024;  // 10M
     params.mem_size += width * height * 3 * sizeof(float) * 2;
+    if (hires) {
+        params.mem_size += sd_params.hires_width * sd_params.hires_height * 3 * sizeof(float) * 3;
+    }
+
+    // schedules of sampling and hires fix
+    auto sub_prompts = parse_prompt_and(prompt);
+    bool uncond = has_guidance(cfg_scale_schedule(sd_params, sample_steps));
+    std::vector<std::pair<std::string, int>> prompts_and_steps;
+    sd->plan_conditioning(prompts_and_steps, sub_prompts, negative_prompt, uncond, sample_steps);
+    bool hires_uncond = hires && has_guidance(cfg_scale_schedule(sd_params, sd->hires_sample_steps(sd_params)));
+    if (hires) {
+        sd->plan_conditioning(prompts_and_steps, sub_prompts, negative_prompt, hires_uncond, sd->hires_sample_steps(sd_params));
+    }
+    auto schedules = sd->plan_prompt_schedules(prompts_and_steps, sd_params.clip_skip);
+    params.mem_size += sd->prompt_schedules_mem_size(schedules);
     params.mem_buffer = NULL;
     params.no_alloc = false;
     params.dynamic = false;
@@ -4216,55 +6319,68 @@ std::vector<uint8_t> StableDiffusion::txt2img(const std::string& prompt,
     if (seed < 0) {
         seed = (int)time(NULL);
     }
-    sd->rng->manual_seed(seed);
+    std::shared_ptr<RNG> rng = sd->create_rng(seed, sd_params);
 
     int64_t t0 = ggml_time_ms();
-    ggml_tensor* c = sd->get_learned_condition(ctx, prompt);
-    struct ggml_tensor* uc = NULL;
-    if (cfg_scale != 1.0) {
-        uc = sd->get_learned_condition(ctx, negative_prompt);
+    if (!sd->encode_prompt_schedules(ctx, schedules, n_threads)) {
+        ggml_free(ctx);
+        return result;
     }
+    size_t schedule_index = 0;
+    StableDiffusionGGML::Conditioning c;
+    std::vector<StableDiffusionGGML::Condition> uc;
+    sd->take_conditioning(schedules, schedule_index, sub_prompts, uncond, c, uc);
     int64_t t1 = ggml_time_ms();
     LOG_INFO("get_learned_condition completed, taking %.2fs", (t1 - t0) * 1.0f / 1000);
 
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->clip_params_ctx);
-        ggml_free(sd->clip_params_ctx);
-        sd->clip_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::CLIP_PARAMS);
     }
 
     int C = 4;
     int W = width / 8;
     int H = height / 8;
     struct ggml_tensor* x_t = ggml_new_tensor_4d(ctx, GGML_TYPE_F32, W, H, C, 1);
-    ggml_tensor_set_f32_randn(x_t, sd->rng);
+    int seed_w = W;
+    int seed_h = H;
+    if (sd_params.seed_resize_width > 0 && sd_params.seed_resize_height > 0) {
+        seed_w = sd_params.seed_resize_width / 8;
+        seed_h = sd_params.seed_resize_height / 8;
+    }
+    sd->set_initial_noise(x_t, sd_params, seed, rng, seed_w, seed_h);
 
     std::vector<float> sigmas = sd->denoiser->schedule->get_sigmas(sample_steps);
 
     LOG_INFO("start sampling");
-    struct ggml_tensor* x_0 = sd->sample(ctx, x_t, c, uc, cfg_scale, sample_method, sigmas);
+    struct ggml_tensor* x_0 = sd->sample(ctx, x_t, NULL, c, uc, sd_params, sample_method, sigmas, rng, n_threads);
     // struct ggml_tensor* x_0 = load_tensor_from_file(ctx, "samples_ddim.bin");
     // print_ggml_tensor(x_0);
+    if (x_0 != NULL && hires) {
+        StableDiffusionGGML::Conditioning hires_c;
+        std::vector<StableDiffusionGGML::Condition> hires_uc;
+        sd->take_conditioning(schedules, schedule_index, sub_prompts, hires_uncond, hires_c, hires_uc);
+        x_0 = sd->hires_fix(ctx, x_0, hires_c, hires_uc, sd_params, rng, n_threads);
+    }
+    if (x_0 == NULL) {
+        ggml_free(ctx);
+        return result;
+    }
     int64_t t2 = ggml_time_ms();
     LOG_INFO("sampling completed, taking %.2fs", (t2 - t1) * 1.0f / 1000);
 
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->unet_params_ctx);
-        ggml_free(sd->unet_params_ctx);
-        sd->unet_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::UNET_PARAMS);
     }
 
-    struct ggml_tensor* img = sd->decode_first_stage(ctx, x_0);
+    struct ggml_tensor* img = sd->decode_latent(ctx, x_0, sd_params, n_threads);
     if (img != NULL) {
         result = ggml_to_image_vec(img);
     }
     int64_t t3 = ggml_time_ms();
     LOG_INFO("decode_first_stage completed, taking %.2fs", (t3 - t2) * 1.0f / 1000);
 
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->vae_params_ctx);
-        ggml_free(sd->vae_params_ctx);
-        sd->vae_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::VAE_PARAMS);
     }
 
     LOG_INFO(
@@ -4279,31 +6395,40 @@ std::vector<uint8_t> StableDiffusion::txt2img(const std::string& prompt,
     return result;
 }
 
-std::vector<uint8_t> StableDiffusion::img2img(const std::vector<uint8_t>& init_img_vec,
-                                              const std::string& prompt,
-                                              const std::string& negative_prompt,
-                                              float cfg_scale,
-                                              int width,
-                                              int height,
-                                              SampleMethod sample_method,
-                                              int sample_steps,
-                                              float strength,
-                                              int64_t seed) {
+static std::vector<uint8_t> generate_img2img(std::shared_ptr<StableDiffusionGGML> sd,
+                                             int n_threads,
+                                             const std::vector<uint8_t>& init_img_vec,
+                                             const SDParams& sd_params) {
+    GenerationScope scope(sd);
+    bool free_params = sd->free_params_immediately;
+    const std::string& prompt = sd_params.prompt;
+    const std::string& negative_prompt = sd_params.negative_prompt;
+    int width = sd_params.width;
+    int height = sd_params.height;
+    SampleMethod sample_method = sd_params.sample_method;
+    int sample_steps = sd_params.sample_steps;
+    float strength = sd_params.strength;
+    int64_t seed = sd_params.seed;
+
     std::vector<uint8_t> result;
     if (init_img_vec.size() != width * height * 3) {
         return result;
     }
     LOG_INFO("img2img %dx%d", width, height);
 
-    std::vector<float> sigmas = sd->denoiser->schedule->get_sigmas(sample_steps);
-    size_t t_enc = static_cast<size_t>(sample_steps * strength);
-    LOG_INFO("target t_enc is %zu steps", t_enc);
-    std::vector<float> sigma_sched;
-    sigma_sched.assign(sigmas.begin() + sample_steps - t_enc - 1, sigmas.end());
+    std::vector<float> sigma_sched = sd->partial_sigmas(sample_steps, strength);
+    LOG_INFO("target t_enc is %d steps", (int)sigma_sched.size() - 2);
+
+    auto sub_prompts = parse_prompt_and(prompt);
+    bool uncond = has_guidance(cfg_scale_schedule(sd_params, std::max((int)sigma_sched.size() - 1, 1)));
+    std::vector<std::pair<std::string, int>> prompts_and_steps;
+    sd->plan_conditioning(prompts_and_steps, sub_prompts, negative_prompt, uncond, (int)sigma_sched.size() - 1);
+    auto schedules = sd->plan_prompt_schedules(prompts_and_steps, sd_params.clip_skip);
 
     struct ggml_init_params params;
     params.mem_size = static_cast<size_t>(10 * 1024) * 1024;  // 10M
     params.mem_size += width * height * 3 * sizeof(float) * 2;
+    params.mem_size += sd->prompt_schedules_mem_size(schedules);
     params.mem_buffer = NULL;
     params.no_alloc = false;
     params.dynamic = false;
@@ -4316,56 +6441,63 @@ std::vector<uint8_t> StableDiffusion::img2img(const std::vector<uint8_t>& init_i
     if (seed < 0) {
         seed = (int)time(NULL);
     }
-    sd->rng->manual_seed(seed);
+    std::shared_ptr<RNG> rng = sd->create_rng(seed, sd_params);
 
     ggml_tensor* init_img = ggml_new_tensor_4d(ctx, GGML_TYPE_F32, width, height, 3, 1);
     image_vec_to_ggml(init_img_vec, init_img);
 
     int64_t t0 = ggml_time_ms();
-    ggml_tensor* moments = sd->encode_first_stage(ctx, init_img);
-    ggml_tensor* init_latent = sd->get_first_stage_encoding(ctx, moments);
+    ggml_tensor* init_latent = sd->encode_image(ctx, init_img, sd_params, rng, n_threads);
+    if (init_latent == NULL) {
+        ggml_free(ctx);
+        return result;
+    }
+    if (sd_params.latent_fill) {
+        sd->fill_latent_noise(init_latent, sd_params, rng);
+    }
     // print_ggml_tensor(init_latent);
     int64_t t1 = ggml_time_ms();
     LOG_INFO("encode_first_stage completed, taking %.2fs", (t1 - t0) * 1.0f / 1000);
 
     ggml_reset_curr_max_dynamic_size();  // reset counter
 
-    ggml_tensor* c = sd->get_learned_condition(ctx, prompt);
-    struct ggml_tensor* uc = NULL;
-    if (cfg_scale != 1.0) {
-        uc = sd->get_learned_condition(ctx, negative_prompt);
+    if (!sd->encode_prompt_schedules(ctx, schedules, n_threads)) {
+        ggml_free(ctx);
+        return result;
     }
+    size_t schedule_index = 0;
+    StableDiffusionGGML::Conditioning c;
+    std::vector<StableDiffusionGGML::Condition> uc;
+    sd->take_conditioning(schedules, schedule_index, sub_prompts, uncond, c, uc);
     int64_t t2 = ggml_time_ms();
     LOG_INFO("get_learned_condition completed, taking %.2fs", (t2 - t1) * 1.0f / 1000);
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->clip_params_ctx);
-        ggml_free(sd->clip_params_ctx);
-        sd->clip_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::CLIP_PARAMS);
     }
 
     LOG_INFO("start sampling");
-    struct ggml_tensor* x_0 = sd->sample(ctx, init_latent, c, uc, cfg_scale, sample_method, sigma_sched);
+    struct ggml_tensor* x_0 = sd->sample(ctx, init_latent, NULL, c, uc, sd_params, sample_method, sigma_sched, rng, n_threads);
     // struct ggml_tensor *x_0 = load_tensor_from_file(ctx, "samples_ddim.bin");
     // print_ggml_tensor(x_0);
     int64_t t3 = ggml_time_ms();
+    if (x_0 == NULL) {
+        ggml_free(ctx);
+        return result;
+    }
     LOG_INFO("sampling completed, taking %.2fs", (t3 - t2) * 1.0f / 1000);
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->unet_params_ctx);
-        ggml_free(sd->unet_params_ctx);
-        sd->unet_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::UNET_PARAMS);
     }
 
-    struct ggml_tensor* img = sd->decode_first_stage(ctx, x_0);
+    struct ggml_tensor* img = sd->decode_latent(ctx, x_0, sd_params, n_threads);
     if (img != NULL) {
         result = ggml_to_image_vec(img);
     }
     int64_t t4 = ggml_time_ms();
     LOG_INFO("decode_first_stage completed, taking %.2fs", (t4 - t3) * 1.0f / 1000);
 
-    if (sd->free_params_immediately) {
-        sd->curr_params_mem_size -= ggml_used_mem(sd->vae_params_ctx);
-        ggml_free(sd->vae_params_ctx);
-        sd->vae_params_ctx = NULL;
+    if (free_params) {
+        sd->release_params(StableDiffusionGGML::VAE_PARAMS);
     }
 
     LOG_INFO(
@@ -4380,3 +6512,88 @@ std::vector<uint8_t> StableDiffusion::img2img(const std::vector<uint8_t>& init_i
 
     return result;
 }
+
+std::vector<uint8_t> StableDiffusion::txt2img(const SDParams& params) {
+    return generate_txt2img(sd, sd->n_threads, params);
+}
+
+std::vector<uint8_t> StableDiffusion::img2img(const std::vector<uint8_t>& init_img, const SDParams& params) {
+    return generate_img2img(sd, sd->n_threads, init_img, params);
+}
+
+/*============================================== StableDiffusionSession ==============================================*/
+
+StableDiffusionSession::StableDiffusionSession(const StableDiffusion& model, int n_threads)
+    : sd(model.sd), n_threads(n_threads) {
+    if (this->n_threads <= 0) {
+        this->n_threads = sd->n_threads;
+    }
+}
+
+std::vector<uint8_t> StableDiffusionSession::txt2img(const SDParams& params) {
+    return generate_txt2img(sd, n_threads, params);
+}
+
+std::vector<uint8_t> StableDiffusionSession::img2img(const std::vector<uint8_t>& init_img, const SDParams& params) {
+    return generate_img2img(sd, n_threads, init_img, params);
+}
+
+std::vector<std::string> StableDiffusion::tensor_names() {
+    std::vector<std::string> names;
+    for (auto& pair : sd->tensors) {
+        names.push_back(pair.first);
+    }
+    return names;
+}
+
+bool StableDiffusion::add_weight_delta(const std::string& name,
+                                       const float* up,
+                                       const float* down,
+                                       int out,
+                                       int rank,
+                                       int inner,
+                                       float scale) {
+    return sd->add_weight_delta(name, up, down, out, rank, inner, scale);
+}
+
+bool StableDiffusion::begin_taesd() {
+    return sd->begin_taesd();
+}
+
+bool StableDiffusion::set_taesd_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+    return sd->set_taesd_tensor(name, ne, data);
+}
+
+bool StableDiffusion::end_taesd() {
+    return sd->end_taesd();
+}
+
+bool StableDiffusion::vae_tensor_shape(const std::string& name, int64_t* ne) {
+    return sd->vae_tensor_shape(name, ne);
+}
+
+bool StableDiffusion::set_vae_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data) {
+    return sd->set_vae_tensor(name, ne, data);
+}
+
+void StableDiffusion::restore_weights() {
+    sd->restore_weights();
+}
+
+void StableDiffusion::tokenize(const std::string& text,
+                               std::vector<int>& tokens,
+                               std::vector<float>& weights,
+                               std::vector<std::string>& pieces) {
+    auto tokens_and_weights = sd->cond_stage_model.tokenize(text, 0, false);
+    // without BOS
+    tokens.assign(tokens_and_weights.first.begin() + 1, tokens_and_weights.first.end());
+    weights.assign(tokens_and_weights.second.begin() + 1, tokens_and_weights.second.end());
+    pieces.clear();
+    for (int id : tokens) {
+        pieces.push_back(sd->cond_stage_model.decode(id));
+    }
+}
+
+bool StableDiffusion::add_embedding(const std::string& name, const float* vectors, int n_vectors, int dim) {
+    return sd->cond_stage_model.add_custom_word(name, vectors, n_vectors, dim);
+}
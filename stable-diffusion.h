@@ -1,7 +1,9 @@
 #ifndef __STABLE_DIFFUSION_H__
 #define __STABLE_DIFFUSION_H__
 
+#include <cstdint>
 #include <memory>
+#include <string>
 #include <vector>
 
 enum SDLogLevel {
@@ -34,9 +36,85 @@ enum Schedule {
     N_SCHEDULES
 };
 
+// gaussian noise from caller. Fills n values of stream seed starting from position offset, so values depend
+// only on seed and position and do not change with compiler or standard library
+typedef void (*NoiseCallback)(uintptr_t user_data, int64_t seed, uint64_t offset, float* out, uint32_t n);
+
+// how cfg scale changes from cfg_scale to cfg_scale_end during sampling
+enum CFGSchedule {
+    CFG_CONSTANT,
+    CFG_LINEAR,
+    CFG_COSINE,
+    N_CFG_SCHEDULES
+};
+
+// generation settings for txt2img and img2img
+struct SDParams {
+    std::string prompt;
+    std::string negative_prompt;
+    float cfg_scale = 7.0f;
+    int width = 512;
+    int height = 512;
+    SampleMethod sample_method = EULER_A;
+    int sample_steps = 20;
+    float strength = 0.75f;  // img2img only
+    // img2img latent fill, latent outside content area (pixels) is replaced with noise after encode
+    bool latent_fill = false;
+    int content_x = 0;
+    int content_y = 0;
+    int content_width = 0;
+    int content_height = 0;
+    int64_t seed = 42;
+    int64_t variation_seed = 0;     // noise of variation_seed is slerped to noise of seed
+    float variation_strength = 0.f;  // 0 = seed only, 1 = variation_seed only
+    int seed_resize_width = 0;      // txt2img noise is made on this size and centered, keeps composition. 0 = disabled
+    int seed_resize_height = 0;
+    bool vae_tiling = false;  // encode and decode in tiles, keeps memory usage down on large images
+    bool taesd = false;       // decode (and encode if loaded) with TAESD tiny autoencoder, fast drafts and previews
+    int clip_skip = 0;        // 1 = last CLIP layer, 2 = penultimate. 0 = model default (1 on SD1, 2 on SD2 and SDXL)
+
+    // SDXL size and crop conditioning. Size 0 = size of generated image
+    int original_width = 0;
+    int original_height = 0;
+    int crop_top = 0;
+    int crop_left = 0;
+    int target_width = 0;
+    int target_height = 0;
+
+    // txt2img hires fix, second pass on larger size. Disabled when size is 0
+    int hires_width = 0;
+    int hires_height = 0;
+    int hires_steps = 0;  // 0 = sample_steps
+    float hires_denoise = 0.5f;
+    bool hires_latent = true;  // upscale latent, false = decode, upscale image and encode
+
+    // against burned colours on high cfg_scale. 0 = disabled
+    float cfg_rescale = 0.0f;           // phi from "Common Diffusion Noise Schedules are Flawed", 0.7 is typical
+    float dynthres_mimic_scale = 0.0f;  // dynamic thresholding, clamp result to range of this cfg scale
+    float dynthres_percentile = 1.0f;   // percentile of values used as range before clamping
+
+    // cfg scale of each step. Steps with scale 1 skip uncond UNet pass
+    CFGSchedule cfg_schedule = CFG_CONSTANT;
+    float cfg_scale_end = 1.0f;    // scale on last step of linear and cosine schedule
+    std::vector<float> cfg_scales;  // explicit scale of each step, overrides cfg_schedule. Last value repeats
+    float cfg_stop_at = 1.0f;      // fraction of steps after which guidance is disabled
+
+    // noise of initial latent and ancestral samplers, NULL = rng_type of model
+    NoiseCallback noise_callback = NULL;
+    uintptr_t noise_user_data = 0;
+};
+
+// cfg scale of each sampling step
+std::vector<float> cfg_scale_schedule(const SDParams& params, int steps);
+
 class StableDiffusionGGML;
+class StableDiffusionSession;
 
+// Holds weights. Each txt2img/img2img call has own rng and compute contexts, but caller must serialize calls
+// on one instance. Use StableDiffusionSession for running in parallel on shared weights.
 class StableDiffusion {
+    friend class StableDiffusionSession;
+
    private:
     std::shared_ptr<StableDiffusionGGML> sd;
 
@@ -45,29 +123,67 @@ class StableDiffusion {
                     bool vae_decode_only = false,
                     bool free_params_immediately = false,
                     RNGType rng_type = STD_DEFAULT_RNG);
-    bool load_from_file(const std::string& file_path, Schedule d = DEFAULT);
-    std::vector<uint8_t> txt2img(
-        const std::string& prompt,
-        const std::string& negative_prompt,
-        float cfg_scale,
-        int width,
-        int height,
-        SampleMethod sample_method,
-        int sample_steps,
-        int64_t seed);
-    std::vector<uint8_t> img2img(
-        const std::vector<uint8_t>& init_img,
-        const std::string& prompt,
-        const std::string& negative_prompt,
-        float cfg_scale,
-        int width,
-        int height,
-        SampleMethod sample_method,
-        int sample_steps,
-        float strength,
-        int64_t seed);
+    // use_mmap: weights are used in place from page cache, processes loading same file share memory
+    bool load_from_file(const std::string& file_path, Schedule d = DEFAULT, bool use_mmap = false);
+
+    // Loading from tensors of caller, like safetensors checkpoint. file_path is only logged, model_type and ftype are as
+    // in ggml file header. Tensor data is f32 and ne in ggml order, weights are cast or quantized to type of model tensor
+    bool load_begin(const std::string& file_path, int model_type, int ftype);
+    void add_vocab_token(const std::string& token, int id);
+    bool load_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data);
+    bool load_end(const float* alphas_cumprod, Schedule s = DEFAULT);
+    // 0 = SD1, 1 = SD2, 2 = SDXL as in ggml file header
+    int model_type();
+    std::vector<uint8_t> txt2img(const SDParams& params);
+    std::vector<uint8_t> img2img(const std::vector<uint8_t>& init_img, const SDParams& params);
+
+    // Weight modification (lora). Not allowed while any session is generating
+    std::vector<std::string> tensor_names();
+    bool add_weight_delta(const std::string& name,
+                          const float* up,
+                          const float* down,
+                          int out,
+                          int rank,
+                          int inner,
+                          float scale);
+    void restore_weights();
+
+    // External vae. Weights of first_stage_model are replaced one by one, ne in ggml order. Shape is checked
+    bool vae_tensor_shape(const std::string& name, int64_t* ne);  // ne has 4 dims
+    bool set_vae_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data);
+
+    // TAESD tiny autoencoder. Names are "decoder." or "encoder." and index in torch Sequential of taesd.py, ne in
+    // ggml order. end_taesd checks that decoder and encoder are complete
+    bool begin_taesd();
+    bool set_taesd_tensor(const std::string& name, const std::vector<int64_t>& ne, const float* data);
+    bool end_taesd();
+
+    // Prompt tokens as text encoder sees them, without BOS and EOS. weights are from attention syntax
+    void tokenize(const std::string& text,
+                  std::vector<int>& tokens,
+                  std::vector<float>& weights,
+                  std::vector<std::string>& pieces);
+
+    // Textual inversion embedding, n_vectors x dim floats. Prompts mentioning name get these vectors as tokens.
+    // SDXL vectors are CLIP-L (768) and OpenCLIP bigG (1280) parts concatenated
+    bool add_embedding(const std::string& name, const float* vectors, int n_vectors, int dim);
+};
+
+// Generation context sharing read-only weights of model. Sessions can run in parallel, each with own thread
+// count. Calls on one session must be serialized. Weights stay loaded as long as any session exists.
+class StableDiffusionSession {
+   private:
+    std::shared_ptr<StableDiffusionGGML> sd;
+    int n_threads;
+
+   public:
+    StableDiffusionSession(const StableDiffusion& model, int n_threads = -1);
+    std::vector<uint8_t> txt2img(const SDParams& params);
+    std::vector<uint8_t> img2img(const std::vector<uint8_t>& init_img, const SDParams& params);
 };
 
+std::string extract_lora_tags(const std::string& text, std::vector<std::pair<std::string, float>>& loras);
+
 void set_sd_log_level(SDLogLevel level);
 std::string sd_get_system_info();
 
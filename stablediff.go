@@ -16,13 +16,25 @@ import (
 	"image/draw"
 	"image/png"
 	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/cgo"
+	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
+/*
+StableDiffusionModel holds weights and is safe for concurrent use. Generation calls on one model are serialized,
+each call gets full thread count and own random generator so result depends only on parameters. Create
+sessions with NewSession for generating in parallel on same weights
+*/
 type StableDiffusionModel struct {
 	sdModel C.StableDiffusionModel
+	lock    *sync.Mutex   //Pointer, model is passed by value
+	weights *sync.RWMutex //Shared with sessions, LoRA changes weights
+	loras   *loraRegistry //Shared with sessions
 }
 
 type EnumSDLogLevel int
@@ -96,6 +108,97 @@ func ParseSchedule(s string) (EnumSchedule, error) {
 	return result, nil
 }
 
+type EnumHiresMode int
+
+const (
+	HIRES_LATENT EnumHiresMode = 0 // Upscale latent directly, fast
+	HIRES_PIXEL  EnumHiresMode = 1 // Decode, upscale picture and encode back. Sharper, needs vae encoder
+)
+
+func ParseHiresMode(s string) (EnumHiresMode, error) {
+	m := map[string]EnumHiresMode{
+		"HIRES_LATENT": HIRES_LATENT,
+		"HIRES_PIXEL":  HIRES_PIXEL,
+	}
+	result, haz := m[strings.ToUpper(s)]
+	if !haz {
+		return HIRES_LATENT, fmt.Errorf("invalid hires mode name %s", s)
+	}
+	return result, nil
+}
+
+type EnumCfgSchedule int
+
+const (
+	CFG_CONSTANT    EnumCfgSchedule = 0
+	CFG_LINEAR      EnumCfgSchedule = 1
+	CFG_COSINE      EnumCfgSchedule = 2
+	N_CFG_SCHEDULES EnumCfgSchedule = 3
+)
+
+func ParseCfgSchedule(s string) (EnumCfgSchedule, error) {
+	m := map[string]EnumCfgSchedule{
+		"CFG_CONSTANT": CFG_CONSTANT,
+		"CFG_LINEAR":   CFG_LINEAR,
+		"CFG_COSINE":   CFG_COSINE,
+	}
+	result, haz := m[strings.ToUpper(s)]
+	if !haz {
+		return CFG_CONSTANT, fmt.Errorf("invalid cfg schedule name %s", s)
+	}
+	return result, nil
+}
+
+// EnumFType is weight type of model, values are ggml file types
+type EnumFType int
+
+const (
+	FTYPE_AUTO EnumFType = -1 // Type of checkpoint weights, f16 or f32
+	FTYPE_F32  EnumFType = 0
+	FTYPE_F16  EnumFType = 1
+	FTYPE_Q4_0 EnumFType = 2
+	FTYPE_Q4_1 EnumFType = 3
+	FTYPE_Q8_0 EnumFType = 7
+	FTYPE_Q5_0 EnumFType = 8
+	FTYPE_Q5_1 EnumFType = 9
+)
+
+func ParseFType(s string) (EnumFType, error) {
+	m := map[string]EnumFType{
+		"AUTO": FTYPE_AUTO,
+		"F32":  FTYPE_F32,
+		"F16":  FTYPE_F16,
+		"Q4_0": FTYPE_Q4_0,
+		"Q4_1": FTYPE_Q4_1,
+		"Q8_0": FTYPE_Q8_0,
+		"Q5_0": FTYPE_Q5_0,
+		"Q5_1": FTYPE_Q5_1,
+	}
+	result, haz := m[strings.TrimPrefix(strings.ToUpper(s), "FTYPE_")]
+	if !haz {
+		return FTYPE_AUTO, fmt.Errorf("invalid ftype name %s", s)
+	}
+	return result, nil
+}
+
+// EnumModelType is architecture of model, values are model types of ggml file header
+type EnumModelType int
+
+const (
+	MODEL_UNKNOWN EnumModelType = -1 // Model is closed
+	MODEL_SD1     EnumModelType = 0
+	MODEL_SD2     EnumModelType = 1
+	MODEL_SDXL    EnumModelType = 2
+)
+
+// NativeSize is picture width and height models of type are trained on. 768-v SD2 models are exception
+func (t EnumModelType) NativeSize() int {
+	if t == MODEL_SDXL {
+		return 1024
+	}
+	return 512
+}
+
 func exists(name string) (bool, error) {
 	_, err := os.Stat(name)
 	if err == nil {
@@ -107,7 +210,64 @@ func exists(name string) (bool, error) {
 	return false, err
 }
 
-func InitStableDiffusion(fname string, nThreads int, schedule EnumSchedule) (StableDiffusionModel, error) {
+type initSettings struct {
+	ftype     EnumFType
+	mmap      bool
+	lowMemory bool
+	vae       string
+	taesd     []string
+}
+
+// InitOption changes how model is loaded
+type InitOption func(*initSettings)
+
+// WithFType sets weight type of model loaded from .safetensors checkpoint. Ggml files keep their own type
+func WithFType(ftype EnumFType) InitOption {
+	return func(s *initSettings) {
+		s.ftype = ftype
+	}
+}
+
+/*
+WithMmap uses weights of ggml model file in place from page cache instead of reading them to memory. Startup is
+faster and processes loading same file share physical memory. LoRA changes only touched pages to private copies
+*/
+func WithMmap(enabled bool) InitOption {
+	return func(s *initSettings) {
+		s.mmap = enabled
+	}
+}
+
+/*
+WithLowMemory keeps only weights of running phase (CLIP, UNet or VAE) in memory. Weights are read from ggml model file
+before each phase and released after it, so peak memory is about size of largest component. Every generation reads
+model file again. Works only with ggml files loaded without mmap
+*/
+func WithLowMemory(enabled bool) InitOption {
+	return func(s *initSettings) {
+		s.lowMemory = enabled
+	}
+}
+
+// WithVAE replaces vae of model with vae from ggml or .safetensors file after loading, see SetVAE
+func WithVAE(fname string) InitOption {
+	return func(s *initSettings) {
+		s.vae = fname
+	}
+}
+
+// WithTAESD loads TAESD tiny autoencoder after model, see LoadTAESD
+func WithTAESD(fnames ...string) InitOption {
+	return func(s *initSettings) {
+		s.taesd = fnames
+	}
+}
+
+/*
+InitStableDiffusion loads model from ggml file made by convert/convert.py, or directly from .safetensors checkpoint.
+Checkpoint weights are cast or quantized on load, see WithFType
+*/
+func InitStableDiffusion(fname string, nThreads int, schedule EnumSchedule, options ...InitOption) (StableDiffusionModel, error) {
 	if len(fname) == 0 {
 		return StableDiffusionModel{}, fmt.Errorf("no model file given")
 	}
@@ -120,18 +280,60 @@ func InitStableDiffusion(fname string, nThreads int, schedule EnumSchedule) (Sta
 		nThreads = runtime.NumCPU()
 	}
 
-	var result StableDiffusionModel
+	settings := initSettings{ftype: FTYPE_AUTO}
+	for _, option := range options {
+		option(&settings)
+	}
+
+	result := StableDiffusionModel{lock: &sync.Mutex{}, weights: &sync.RWMutex{}, loras: newLoRARegistry()}
+
+	isCheckpoint := strings.EqualFold(filepath.Ext(fname), ".safetensors")
+	if settings.lowMemory && (isCheckpoint || settings.mmap) {
+		return result, fmt.Errorf("low memory mode needs ggml model file loaded without mmap, convert checkpoint with sdconvert")
+	}
+
+	if isCheckpoint {
+		errLoad := loadCheckpoint(&result.sdModel, fname, nThreads, schedule, settings.ftype)
+		if errLoad != nil {
+			if result.sdModel.sd != nil {
+				C.freeStableDiffusionModel(&result.sdModel)
+				result.sdModel.sd = nil
+			}
+			return result, fmt.Errorf("loading checkpoint failed err=%v", errLoad)
+		}
+		return result, result.initAutoencoders(settings)
+	}
 
 	ret := C.loadStableDiffusion(
-		C.CString(fname), //char *sdfilename,
-		C.int(nThreads),  //int n_threads,
-		C.int(schedule),  //int enumSchedule,
+		C.CString(fname),           //char *sdfilename,
+		C.int(nThreads),            //int n_threads,
+		C.int(schedule),            //int enumSchedule,
+		C.bool(settings.mmap),      //bool useMmap,
+		C.bool(settings.lowMemory), //bool lowMemory,
 		&result.sdModel)
 
 	if ret != 0 {
+		C.freeStableDiffusionModel(&result.sdModel)
+		result.sdModel.sd = nil
 		return result, fmt.Errorf("init fail with code %v", ret)
 	}
-	return result, nil
+	return result, result.initAutoencoders(settings)
+}
+
+// initAutoencoders sets vae given with WithVAE and loads TAESD of WithTAESD, model is freed on error
+func (p *StableDiffusionModel) initAutoencoders(settings initSettings) error {
+	var err error
+	if len(settings.vae) != 0 {
+		err = setVAE(p.sdModel, settings.vae)
+	}
+	if err == nil && len(settings.taesd) != 0 {
+		err = loadTAESD(p.sdModel, settings.taesd)
+	}
+	if err != nil {
+		C.freeStableDiffusionModel(&p.sdModel)
+		p.sdModel.sd = nil
+	}
+	return err
 }
 
 // Lets have parameters as struct.. so it is easier to store to exif etc...
@@ -145,11 +347,174 @@ type TextGenPars struct {
 	SampleSteps    int
 	Strength       float32 //needed for img2img
 	Seed           int64
+	ResizeMode     EnumResizeMode //How img2img start image is fitted to Width x Height
+	RestoreSize    bool           //Scale img2img result back to size and aspect ratio of start image
+	VAETiling      bool           //Encode and decode image in tiles. Slower but memory usage does not grow with image size
+	ClipSkip       int            //1 = last CLIP layer, 2 = penultimate like many anime models expect. 0 = model default
+	TAESD          bool           //Decode (and encode if loaded) with TAESD tiny autoencoder. Fast drafts, needs LoadTAESD
+
+	//SDXL size and crop conditioning, ignored on SD1 and SD2. Size 0 = size of generated picture
+	OriginalWidth  int //Size of training picture model is told, small size gives blurry upscaled look
+	OriginalHeight int
+	CropTop        int //Crop of training picture, 0 keeps subject whole and centered
+	CropLeft       int
+	TargetWidth    int
+	TargetHeight   int
+
+	//Variation seed for "same picture, slightly different". Noise of VariationSeed is slerped to noise of Seed
+	VariationSeed     int64
+	VariationStrength float32 //0 = disabled, 1 = VariationSeed only
+	SeedResizeWidth   int     //Txt2img noise is generated on this size and centered, keeps composition of seed on other size. 0 = disabled
+	SeedResizeHeight  int
+
+	//Hires fix for txt2img. Picture is generated on Width x Height, upscaled by HiresScale and refined with partial img2img
+	HiresScale   float32       //1 or less = disabled
+	HiresSteps   int           //0 = SampleSteps
+	HiresDenoise float32       //Strength of second pass, 0 = default 0.5
+	HiresMode    EnumHiresMode //Upscale latent or picture
+
+	LoRAs []LoRAWeight //Loaded with LoadLoRA of model. Prompt can also have <lora:name:weight> tags
+
+	//Against burned colours on high CfgScale
+	CfgRescale         float32 //0 = disabled, 0.7 typical. Mostly for v-prediction SD2 models
+	DynThresMimicScale float32 //Dynamic thresholding, clamps result to range of this cfg scale. 0 = disabled, 7 typical
+	DynThresPercentile float32 //Percentile of values clamped to mimic range, 0 = default 1.0
+
+	//Guidance scale schedule, CfgScale is scale of first step. Steps with scale 1 skip uncond UNet pass
+	CfgSchedule EnumCfgSchedule //Ramp from CfgScale to CfgScaleEnd
+	CfgScaleEnd float32         //Scale of last step on CFG_LINEAR and CFG_COSINE, 0 = 1
+	CfgScales   []float32       //Explicit scale of each step, overrides CfgSchedule. Last value repeats
+	CfgStopAt   float32         //Fraction of steps after which guidance is disabled, 0 = never
+
+	Noise NoiseSource //Initial and ancestral noise, like PortableNoise{} for same result on every machine. nil = rng of model
+
+	Prompts []WeightedPrompt //Sub-prompts combined to Prompt with AND, like "a cat :1.2 AND a dog :0.6"
+}
+
+// WeightedPrompt is sub-prompt of composable diffusion. UNet is run for each sub-prompt and guidance is weighted
+type WeightedPrompt struct {
+	Prompt string  `json:"prompt"`
+	Weight float32 `json:"weight,omitempty"` //0 = 1, negative pushes away from sub-prompt
+}
+
+// composePrompt adds Prompts to Prompt with AND syntax
+func (p *TextGenPars) composePrompt() {
+	if len(p.Prompts) == 0 {
+		return
+	}
+	parts := []string{}
+	if len(strings.TrimSpace(p.Prompt)) != 0 {
+		parts = append(parts, p.Prompt)
+	}
+	for _, wp := range p.Prompts {
+		weight := wp.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		parts = append(parts, wp.Prompt+" :"+strconv.FormatFloat(float64(weight), 'f', -1, 32))
+	}
+	p.Prompt = strings.Join(parts, " AND ")
+	p.Prompts = nil
+}
+
+const hiresDefaultDenoise = 0.5
+
+func (p *TextGenPars) hiresEnabled() bool {
+	return 1 < p.HiresScale
+}
+
+// OutputSize tells size of Txt2Img result, hires fix is rounded to multiple of 64
+func (p *TextGenPars) OutputSize() (int, int) {
+	if !p.hiresEnabled() {
+		return p.Width, p.Height
+	}
+	return RoundToModelSize(int(float32(p.Width) * p.HiresScale)), RoundToModelSize(int(float32(p.Height) * p.HiresScale))
+}
+
+// toC creates C parameters. Call free after use
+func (p *TextGenPars) toC() (C.GenerationParams, func()) {
+	result := C.GenerationParams{
+		prompt:         C.CString(p.Prompt),
+		negativePrompt: C.CString(p.NegativePrompt),
+		cfg_scale:      C.float(p.CfgScale),
+		width:          C.int(p.Width),
+		height:         C.int(p.Height),
+		sampleMethod:   C.int(p.SampleMethod),
+		sampleSteps:    C.int(p.SampleSteps),
+		strength:       C.float(p.Strength),
+		seed:           C.int64_t(p.Seed),
+		variationSeed:  C.int64_t(p.VariationSeed),
+		vaeTiling:      C.bool(p.VAETiling),
+		taesd:          C.bool(p.TAESD),
+		clipSkip:       C.int(p.ClipSkip),
+		originalWidth:  C.int(p.OriginalWidth),
+		originalHeight: C.int(p.OriginalHeight),
+		cropTop:        C.int(p.CropTop),
+		cropLeft:       C.int(p.CropLeft),
+		targetWidth:    C.int(p.TargetWidth),
+		targetHeight:   C.int(p.TargetHeight),
+
+		cfgRescale:         C.float(p.CfgRescale),
+		dynThresMimicScale: C.float(p.DynThresMimicScale),
+		dynThresPercentile: 1,
+	}
+	if 0 < p.VariationStrength {
+		result.variationStrength = C.float(min(p.VariationStrength, 1))
+	}
+	if 0 < p.SeedResizeWidth && 0 < p.SeedResizeHeight {
+		result.seedResizeWidth = C.int(RoundToModelSize(p.SeedResizeWidth))
+		result.seedResizeHeight = C.int(RoundToModelSize(p.SeedResizeHeight))
+	}
+	if 0 < p.DynThresPercentile && p.DynThresPercentile < 1 {
+		result.dynThresPercentile = C.float(p.DynThresPercentile)
+	}
+
+	result.cfgSchedule = C.int(p.CfgSchedule)
+	result.cfgScaleEnd = 1
+	if p.CfgScaleEnd != 0 {
+		result.cfgScaleEnd = C.float(p.CfgScaleEnd)
+	}
+	result.cfgStopAt = 1
+	if 0 < p.CfgStopAt && p.CfgStopAt < 1 {
+		result.cfgStopAt = C.float(p.CfgStopAt)
+	}
+	var noiseHandle cgo.Handle
+	if p.Noise != nil {
+		noiseHandle = cgo.NewHandle(p.Noise)
+		result.noiseSource = C.uintptr_t(noiseHandle)
+	}
+	if len(p.CfgScales) != 0 {
+		//C side keeps no pointers to Go memory
+		result.cfgScales = (*C.float)(C.malloc(C.size_t(len(p.CfgScales)) * C.sizeof_float))
+		copy(unsafe.Slice((*float32)(unsafe.Pointer(result.cfgScales)), len(p.CfgScales)), p.CfgScales)
+		result.nCfgScales = C.int(len(p.CfgScales))
+	}
+	if p.hiresEnabled() {
+		w, h := p.OutputSize()
+		result.hiresWidth = C.int(w)
+		result.hiresHeight = C.int(h)
+		result.hiresSteps = C.int(p.HiresSteps)
+		result.hiresDenoise = C.float(hiresDefaultDenoise)
+		if 0 < p.HiresDenoise {
+			result.hiresDenoise = C.float(p.HiresDenoise)
+		}
+		result.hiresLatent = C.bool(p.HiresMode == HIRES_LATENT)
+	}
+	return result, func() {
+		C.free(unsafe.Pointer(result.prompt))
+		C.free(unsafe.Pointer(result.negativePrompt))
+		if result.cfgScales != nil {
+			C.free(unsafe.Pointer(result.cfgScales))
+		}
+		if noiseHandle != 0 {
+			noiseHandle.Delete()
+		}
+	}
 }
 
 func rgb2img(rgb []byte, width int, height int) (image.Image, error) {
 	if len(rgb) != width*height*3 {
-		return nil, fmt.Errorf("RGB data length %d does not match %d x %d x 3 = %d", len(rgb), width*height*3)
+		return nil, fmt.Errorf("RGB data length %d does not match %d x %d x 3 = %d", len(rgb), width, height, width*height*3)
 	}
 	resultImage := image.NewRGBA(image.Rect(0, 0, width, height))
 	pos := 0
@@ -178,21 +543,69 @@ func img2rgb(img image.Image) []byte {
 	return result
 }
 
+// ModelType tells architecture of loaded model, MODEL_UNKNOWN after Close
+func (p *StableDiffusionModel) ModelType() EnumModelType {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed() {
+		return MODEL_UNKNOWN
+	}
+	return EnumModelType(C.modelType(&p.sdModel))
+}
+
 func (p *StableDiffusionModel) Txt2Img(parameters TextGenPars) (image.Image, error) {
-	rawResult := C.txt2img(&p.sdModel,
-		C.CString(parameters.Prompt),
-		C.CString(parameters.NegativePrompt),
-		C.float(parameters.CfgScale),
-		C.int(parameters.Width), C.int(parameters.Height),
-		C.int(parameters.SampleMethod),
-		C.int(parameters.SampleSteps),
-		C.long(parameters.Seed))
+	return runTxt2Img(p.lock, p.closed, p.weightsTarget, parameters, func(cPars *C.GenerationParams) *C.uint8_t {
+		return C.txt2img(&p.sdModel, cPars)
+	})
+}
+
+/*
+Img2Img fits start image to Width x Height by ResizeMode. Width and Height are rounded to multiple of 64 and
+zero uses size of start image. Parameters actually used can be checked with FitInitImage
+*/
+func (p *StableDiffusionModel) Img2Img(startImage image.Image, parameters TextGenPars) (image.Image, error) {
+	return runImg2Img(p.lock, p.closed, p.weightsTarget, startImage, parameters, func(initImage *C.uchar, cPars *C.GenerationParams) *C.uint8_t {
+		return C.img2img(&p.sdModel, initImage, cPars)
+	})
+}
+
+// closed is called with lock held
+func (p *StableDiffusionModel) closed() bool {
+	return p.sdModel.sd == nil
+}
+
+// weightsTarget is called with lock held
+func (p *StableDiffusionModel) weightsTarget() weightsTarget {
+	return weightsTarget{sdModel: p.sdModel, lock: p.weights, loras: p.loras}
+}
+
+var errClosed = errors.New("model or session closed")
+
+// runTxt2Img does conversions around C txt2img call, lock serializes calls. closed and weights are called under lock
+func runTxt2Img(lock *sync.Mutex, closed func() bool, weights func() weightsTarget, parameters TextGenPars, generate func(cPars *C.GenerationParams) *C.uint8_t) (image.Image, error) {
+	parameters.composePrompt()
+	loras := parameters.takeLoRAs()
+	cPars, freePars := parameters.toC()
+	defer freePars()
+	var rawResult *C.uint8_t
+	lock.Lock()
+	if closed() {
+		lock.Unlock()
+		return nil, errClosed
+	}
+	errLoRA := weights().run(loras, func() { rawResult = generate(&cPars) })
+	lock.Unlock()
+
+	if errLoRA != nil {
+		return nil, errLoRA
+	}
 
 	if rawResult == nil {
 		return nil, fmt.Errorf("txt2img failed with nil image")
 	}
-	imagedata := C.GoBytes(unsafe.Pointer(rawResult), C.int(parameters.Width*parameters.Height*3))
-	result, convErr := rgb2img(imagedata, parameters.Width, parameters.Height)
+	w, h := parameters.OutputSize()
+	imagedata := C.GoBytes(unsafe.Pointer(rawResult), C.int(w*h*3))
+	result, convErr := rgb2img(imagedata, w, h)
 	C.free(unsafe.Pointer(rawResult))
 
 	if convErr != nil {
@@ -202,37 +615,64 @@ func (p *StableDiffusionModel) Txt2Img(parameters TextGenPars) (image.Image, err
 	return result, nil
 }
 
-// Img2Img, not yet ready
-func (p *StableDiffusionModel) Img2Img(startImage image.Image, parameters TextGenPars) (image.Image, error) {
-	if startImage.Bounds().Dx() != parameters.Width || startImage.Bounds().Dy() != parameters.Height {
-		return nil, fmt.Errorf("start image dimensions %d x %d do not match image dimensions %d x %d",
-			startImage.Bounds().Dx(), startImage.Bounds().Dy(),
-			parameters.Width, parameters.Width)
-	}
-
-	startImgBytes := img2rgb(startImage)
-
-	/*
-		FAILS: TODO FIX
-		stable-diffusion.cpp:1407: static void DownSample::asymmetric_pad(ggml_tensor*, const ggml_tensor*, const ggml_tensor*, int, int, void*): Assertion `sizeof(dst->nb[0]) == sizeof(float)' failed.
-	*/
-
-	rawResult := C.img2img(&p.sdModel,
-		(*C.uchar)(C.CBytes(startImgBytes)),
-		C.CString(parameters.Prompt),
-		C.CString(parameters.NegativePrompt),
-		C.float(parameters.CfgScale),                      //float cfg_scale,
-		C.int(parameters.Width), C.int(parameters.Height), //int width,int height,
-		C.int(parameters.SampleMethod), //int sampleMethod, //TODO ENUM
-		C.int(parameters.SampleSteps),  //int sampleSteps,
-		C.float(parameters.Strength),
-		C.long(parameters.Seed)) //int64_t seed)
+// runImg2Img does conversions and resizing around C img2img call, lock serializes calls. closed and weights are called under lock
+func runImg2Img(lock *sync.Mutex, closed func() bool, weights func() weightsTarget, startImage image.Image, parameters TextGenPars, generate func(initImage *C.uchar, cPars *C.GenerationParams) *C.uint8_t) (image.Image, error) {
+	initImage, layout, errPrepare := prepareInitImage(startImage, &parameters)
+	if errPrepare != nil {
+		return nil, errPrepare
+	}
+
+	startImgBytes := C.CBytes(img2rgb(initImage))
+	defer C.free(startImgBytes)
+	parameters.composePrompt()
+	loras := parameters.takeLoRAs()
+	cPars, freePars := parameters.toC()
+	defer freePars()
+	layout.setLatentFill(&cPars)
+	var rawResult *C.uint8_t
+	lock.Lock()
+	if closed() {
+		lock.Unlock()
+		return nil, errClosed
+	}
+	errLoRA := weights().run(loras, func() { rawResult = generate((*C.uchar)(startImgBytes), &cPars) })
+	lock.Unlock()
+
+	if errLoRA != nil {
+		return nil, errLoRA
+	}
 
 	if rawResult == nil {
-		return nil, fmt.Errorf("txt2img failed with nil image")
+		return nil, fmt.Errorf("img2img failed with nil image")
 	}
 	imagedata := C.GoBytes(unsafe.Pointer(rawResult), C.int(parameters.Width*parameters.Height*3))
-	return rgb2img(imagedata, parameters.Width, parameters.Height)
+	C.free(unsafe.Pointer(rawResult))
+	result, convErr := rgb2img(imagedata, parameters.Width, parameters.Height)
+	if convErr != nil {
+		return nil, convErr
+	}
+	if parameters.RestoreSize {
+		return layout.restore(result, startImage), nil
+	}
+	return result, nil
+}
+
+// FitInitImage returns start image as Img2Img feeds it to model, and parameters with final Width and Height
+func FitInitImage(startImage image.Image, parameters TextGenPars) (image.Image, TextGenPars, error) {
+	result, _, err := prepareInitImage(startImage, &parameters)
+	return result, parameters, err
+}
+
+// Close releases model. Weights stay in memory until all sessions are closed too
+func (p *StableDiffusionModel) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.sdModel.sd == nil {
+		return fmt.Errorf("model already closed")
+	}
+	C.freeStableDiffusionModel(&p.sdModel)
+	p.sdModel.sd = nil
+	return nil
 }
 
 func SavePng(fname string, img image.Image) error {
@@ -0,0 +1,169 @@
+package bindstablediff
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"sync"
+	"testing"
+)
+
+// testModel loads ggml model file given in STABLEDIFF_TEST_MODEL, test is skipped without it
+func testModel(t *testing.T) StableDiffusionModel {
+	fname := os.Getenv("STABLEDIFF_TEST_MODEL")
+	if len(fname) == 0 {
+		t.Skip("STABLEDIFF_TEST_MODEL not set")
+	}
+	model, err := InitStableDiffusion(fname, 2, DEFAULT)
+	if err != nil {
+		t.Fatalf("loading %s failed err=%v", fname, err)
+	}
+	t.Cleanup(func() { model.Close() })
+	return model
+}
+
+func rgbaPix(t *testing.T, img image.Image) []byte {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		t.Fatalf("result is %T, not *image.RGBA", img)
+	}
+	return rgba.Pix
+}
+
+// Run with go test -race. Model and sessions generate at same time, same seed must give same picture on every call
+func TestConcurrentGeneration(t *testing.T) {
+	model := testModel(t)
+	pars := TextGenPars{
+		Prompt:       "a red apple on a table",
+		CfgScale:     7,
+		Width:        64,
+		Height:       64,
+		SampleMethod: EULER_A,
+		SampleSteps:  2,
+		Seed:         42,
+	}
+
+	sessions := make([]*Session, 2)
+	for i := range sessions {
+		session, err := model.NewSession(2)
+		if err != nil {
+			t.Fatalf("new session failed err=%v", err)
+		}
+		defer session.Close()
+		sessions[i] = session
+	}
+
+	generators := []func(TextGenPars) (image.Image, error){model.Txt2Img, model.Txt2Img}
+	for _, session := range sessions {
+		generators = append(generators, session.Txt2Img, session.Txt2Img)
+	}
+
+	results := make([]image.Image, len(generators))
+	errs := make([]error, len(generators))
+	var wg sync.WaitGroup
+	for i, generate := range generators {
+		wg.Add(1)
+		go func(i int, generate func(TextGenPars) (image.Image, error)) {
+			defer wg.Done()
+			results[i], errs[i] = generate(pars)
+		}(i, generate)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("generation %d failed err=%v", i, err)
+		}
+	}
+	want := rgbaPix(t, results[0])
+	for i, result := range results[1:] {
+		if !bytes.Equal(want, rgbaPix(t, result)) {
+			t.Errorf("generation %d differs from first with same seed", i+1)
+		}
+	}
+}
+
+// Run with go test -race. Calls racing with Close either complete or fail with errClosed
+func TestCloseWhileGenerating(t *testing.T) {
+	model := testModel(t)
+	pars := TextGenPars{Prompt: "a red apple", CfgScale: 7, Width: 64, Height: 64, SampleSteps: 1, Seed: 42}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := model.Txt2Img(pars)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			session, err := model.NewSession(1)
+			if err == nil {
+				_, err = session.Txt2Img(pars)
+				session.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := model.Tokenize(pars.Prompt)
+		errs <- err
+	}()
+	go func() {
+		defer wg.Done()
+		errs <- model.Close()
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil && err != errClosed {
+			t.Errorf("unexpected err=%v", err)
+		}
+	}
+	if _, err := model.NewSession(1); err != errClosed {
+		t.Errorf("NewSession after Close err=%v, want %v", err, errClosed)
+	}
+}
+
+func TestGenerateAfterClose(t *testing.T) {
+	model := StableDiffusionModel{lock: &sync.Mutex{}, weights: &sync.RWMutex{}}
+	session := Session{lock: &sync.Mutex{}, weights: model.weightsTarget()}
+	pars := TextGenPars{Prompt: "a red apple", Width: 64, Height: 64, SampleSteps: 1}
+	start := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	if _, err := model.Txt2Img(pars); err != errClosed {
+		t.Errorf("model Txt2Img err=%v, want %v", err, errClosed)
+	}
+	if _, err := model.Img2Img(start, pars); err != errClosed {
+		t.Errorf("model Img2Img err=%v, want %v", err, errClosed)
+	}
+	if _, err := session.Txt2Img(pars); err != errClosed {
+		t.Errorf("session Txt2Img err=%v, want %v", err, errClosed)
+	}
+	if _, err := session.Img2Img(start, pars); err != errClosed {
+		t.Errorf("session Img2Img err=%v, want %v", err, errClosed)
+	}
+	if modelType := model.ModelType(); modelType != MODEL_UNKNOWN {
+		t.Errorf("model ModelType %v, want %v", modelType, MODEL_UNKNOWN)
+	}
+	if _, err := model.Upscale(start, 2, pars); err != errClosed {
+		t.Errorf("model Upscale err=%v, want %v", err, errClosed)
+	}
+	if err := model.LoadEmbedding("testdata/embedding.pt", ""); err != errClosed {
+		t.Errorf("model LoadEmbedding err=%v, want %v", err, errClosed)
+	}
+}
+
+func TestComposePrompt(t *testing.T) {
+	pars := TextGenPars{Prompt: "a garden", Prompts: []WeightedPrompt{{Prompt: "a cat", Weight: 1.2}, {Prompt: "a dog"}}}
+	pars.composePrompt()
+	want := "a garden AND a cat :1.2 AND a dog :1"
+	if pars.Prompt != want {
+		t.Errorf("composed %#v, want %#v", pars.Prompt, want)
+	}
+}
@@ -0,0 +1,109 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+/*
+TAESD tiny autoencoder (https://github.com/madebyollin/taesd) decodes latents in fraction of time of full VAE. Quality
+is good enough for drafts, thumbnails and previews. Used by generations with TextGenPars.TAESD
+*/
+
+// taesdTensorName gives name of TAESD weight. Files of taesd repo have only Sequential index, decoder file starts
+// from 1 as 0 is clamp. Diffusers AutoencoderTiny has encoder.layers. and decoder.layers. without clamp
+func taesdTensorName(name string, isEncoder bool) (string, error) {
+	for _, part := range []string{"encoder", "decoder"} {
+		prefix := part + ".layers."
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		idx, rest, _ := strings.Cut(strings.TrimPrefix(name, prefix), ".")
+		n, errIdx := strconv.Atoi(idx)
+		if errIdx != nil {
+			return "", fmt.Errorf("invalid TAESD tensor name %s", name)
+		}
+		if part == "decoder" {
+			n++
+		}
+		return part + "." + strconv.Itoa(n) + "." + rest, nil
+	}
+	if isEncoder {
+		return "encoder." + name, nil
+	}
+	return "decoder." + name, nil
+}
+
+// loadTAESD loads decoder and encoder weights from .safetensors files
+func loadTAESD(sdModel C.StableDiffusionModel, fnames []string) error {
+	if len(fnames) == 0 {
+		return fmt.Errorf("no TAESD files given")
+	}
+	if C.beginTaesd(&sdModel) != 0 {
+		return fmt.Errorf("TAESD init failed")
+	}
+	for _, fname := range fnames {
+		st, errOpen := openSafetensors(fname)
+		if errOpen != nil {
+			return errOpen
+		}
+		_, isEncoder := st.entries["0.weight"] //decoder starts with clamp
+		for _, stName := range st.Names() {
+			if !isFloatDType(st.entries[stName].DType) {
+				continue
+			}
+			name, errName := taesdTensorName(stName, isEncoder)
+			if errName != nil {
+				st.Close()
+				return errName
+			}
+			data, shape, errRead := st.ReadFloat32(stName)
+			if errRead != nil {
+				st.Close()
+				return errRead
+			}
+			ne := make([]C.int64_t, len(shape))
+			for i, n := range shape { //ggml order is reversed
+				ne[len(shape)-1-i] = C.int64_t(n)
+			}
+			if len(data) == 0 || len(ne) == 0 {
+				continue
+			}
+			cName := C.CString(name)
+			ret := C.setTaesdTensor(&sdModel, cName, C.int(len(ne)), &ne[0], (*C.float)(unsafe.Pointer(&data[0])))
+			C.free(unsafe.Pointer(cName))
+			if ret != 0 {
+				st.Close()
+				return fmt.Errorf("TAESD file %s tensor %s %v does not fit", fname, stName, shape)
+			}
+		}
+		st.Close()
+	}
+	if C.endTaesd(&sdModel) != 0 {
+		return fmt.Errorf("TAESD weights missing from %s", strings.Join(fnames, ","))
+	}
+	return nil
+}
+
+/*
+LoadTAESD loads TAESD tiny autoencoder from .safetensors files, like taesd_decoder.safetensors and
+taesd_encoder.safetensors, or diffusers AutoencoderTiny file with both. Encoder is optional, without it img2img
+encodes with full VAE. Waits running generations
+*/
+func (p *StableDiffusionModel) LoadTAESD(fnames ...string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed() {
+		return errClosed
+	}
+	p.weights.Lock()
+	defer p.weights.Unlock()
+	return loadTAESD(p.sdModel, fnames)
+}
@@ -0,0 +1,68 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+/*
+PromptTokenLimit is chunk size of prompt encoding, tokens that fit in text encoder window of 77 with start and end
+tokens. It is not hard limit: longer prompts are encoded in chunks of this size, BREAK keyword in prompt starts new chunk
+*/
+const PromptTokenLimit = 75
+
+// Token is one text encoder token of prompt
+type Token struct {
+	ID     int
+	Text   string  //Vocabulary entry or embedding name
+	Weight float32 //Attention weight from (emphasis:1.2) syntax
+}
+
+/*
+Tokenize splits prompt like generation does: lora tags are removed, emphasis syntax is parsed and embedding
+names become embedding tokens. Start and end tokens and BREAK keywords are not included
+*/
+func (p *StableDiffusionModel) Tokenize(prompt string) ([]Token, error) {
+	prompt, _ = extractLoRATags(prompt)
+	cPrompt := C.CString(prompt)
+	defer C.free(unsafe.Pointer(cPrompt))
+
+	var cIds *C.int
+	var cWeights *C.float
+	var cPieces *C.char
+	p.lock.Lock() //Embeddings are added under same lock
+	if p.closed() {
+		p.lock.Unlock()
+		return nil, errClosed
+	}
+	n := int(C.tokenizePrompt(&p.sdModel, cPrompt, &cIds, &cWeights, &cPieces))
+	p.lock.Unlock()
+	defer C.free(unsafe.Pointer(cIds))
+	defer C.free(unsafe.Pointer(cWeights))
+	defer C.free(unsafe.Pointer(cPieces))
+
+	ids := unsafe.Slice((*C.int)(cIds), n)
+	weights := unsafe.Slice((*C.float)(cWeights), n)
+	pieces := strings.Split(C.GoString(cPieces), "\n")
+	if len(pieces) < n {
+		return nil, fmt.Errorf("tokenizer returned %v pieces for %v tokens", len(pieces), n)
+	}
+	result := make([]Token, n)
+	for i := range result {
+		result[i] = Token{ID: int(ids[i]), Text: pieces[i], Weight: float32(weights[i])}
+	}
+	return result, nil
+}
+
+// CountTokens returns number of prompt tokens. Each started PromptTokenLimit tokens is one text encoder chunk,
+// BREAK and splitting at comma can add chunks
+func (p *StableDiffusionModel) CountTokens(prompt string) (int, error) {
+	tokens, err := p.Tokenize(prompt)
+	return len(tokens), err
+}
@@ -0,0 +1,495 @@
+package bindstablediff
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+Minimal reader of PyTorch files saved with torch.save (zip format, torch 1.6 and newer). data.pkl is run on small
+pickle machine that knows dicts, lists, tuples and tensors, other objects are kept as placeholders. Nothing from
+file is executed. Tensor data is in data/<key> entries of zip and converted to float32 when read
+*/
+
+type torchFile struct {
+	zr     *zip.ReadCloser
+	prefix string //Directory of data.pkl inside zip, like "archive/"
+	root   any    //Unpickled data.pkl
+}
+
+// torchTensor is result of torch._utils._rebuild_tensor_v2, offset and strides are in elements
+type torchTensor struct {
+	dtype  string //Like in safetensors, F32, F16...
+	key    string //Storage data is in data/<key>
+	offset int
+	shape  []int
+	stride []int
+}
+
+type pickleGlobal struct {
+	module string
+	name   string
+}
+
+// pickleObject is placeholder of object pickle machine does not know
+type pickleObject struct {
+	class pickleGlobal
+	args  []any
+}
+
+type pickleList struct {
+	items []any
+}
+
+type pickleMark struct{}
+
+// Storage classes of torch to dtypes of safetensors
+var torchStorageDTypes = map[string]string{
+	"DoubleStorage":   "F64",
+	"FloatStorage":    "F32",
+	"HalfStorage":     "F16",
+	"BFloat16Storage": "BF16",
+}
+
+func openTorchFile(fname string) (*torchFile, error) {
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not torch zip file, legacy format must be saved again with torch 1.6 or newer err=%v", fname, err)
+	}
+	result := torchFile{zr: zr}
+	var pkl *zip.File
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "data.pkl") && strings.Count(f.Name, "/") <= 1 {
+			pkl = f
+			result.prefix = strings.TrimSuffix(f.Name, "data.pkl")
+			break
+		}
+	}
+	if pkl == nil {
+		zr.Close()
+		return nil, fmt.Errorf("no data.pkl in %s", fname)
+	}
+	r, errOpen := pkl.Open()
+	if errOpen != nil {
+		zr.Close()
+		return nil, fmt.Errorf("opening data.pkl of %s failed err=%v", fname, errOpen)
+	}
+	defer r.Close()
+	result.root, err = unpickle(bufio.NewReader(r), persistentTorchStorage)
+	if err != nil {
+		zr.Close()
+		return nil, fmt.Errorf("invalid data.pkl in %s err=%v", fname, err)
+	}
+	return &result, nil
+}
+
+func (p *torchFile) Close() error {
+	return p.zr.Close()
+}
+
+// ReadFloat32 reads contiguous tensor as float32
+func (p *torchFile) ReadFloat32(t torchTensor) ([]float32, error) {
+	n := 1
+	for i := len(t.shape) - 1; 0 <= i; i-- {
+		if 1 < t.shape[i] && t.stride[i] != n {
+			return nil, fmt.Errorf("tensor of storage %s is not contiguous", t.key)
+		}
+		n *= t.shape[i]
+	}
+	f, errOpen := p.zr.Open(p.prefix + "data/" + t.key)
+	if errOpen != nil {
+		return nil, fmt.Errorf("storage %s not found err=%v", t.key, errOpen)
+	}
+	defer f.Close()
+	raw, errRead := io.ReadAll(f)
+	if errRead != nil {
+		return nil, fmt.Errorf("reading storage %s failed err=%v", t.key, errRead)
+	}
+	data, errConv := toFloat32(raw, t.dtype)
+	if errConv != nil {
+		return nil, fmt.Errorf("storage %s: %s", t.key, errConv.Error())
+	}
+	if len(data) < t.offset+n {
+		return nil, fmt.Errorf("storage %s has %v values, tensor needs %v", t.key, len(data), t.offset+n)
+	}
+	return data[t.offset : t.offset+n], nil
+}
+
+// persistentTorchStorage loads persistent id ('storage', storage class, key, location, numel) of torch.save
+func persistentTorchStorage(pid any) (any, error) {
+	tuple, ok := pid.([]any)
+	if !ok || len(tuple) < 3 || tuple[0] != "storage" {
+		return nil, fmt.Errorf("unknown persistent id %v", pid)
+	}
+	class, okClass := tuple[1].(pickleGlobal)
+	key, okKey := tuple[2].(string)
+	if !okClass || !okKey {
+		return nil, fmt.Errorf("invalid storage id %v", pid)
+	}
+	dtype, haz := torchStorageDTypes[class.name]
+	if !haz {
+		return nil, fmt.Errorf("unsupported storage %s", class.name)
+	}
+	return torchTensor{dtype: dtype, key: key}, nil
+}
+
+// reduce calls known torch functions, other calls give placeholder
+func reduce(callable any, args []any) (any, error) {
+	class, ok := callable.(pickleGlobal)
+	if !ok {
+		return nil, fmt.Errorf("calling %v", callable)
+	}
+	switch class.module + "." + class.name {
+	case "torch._utils._rebuild_tensor_v2", "torch._utils._rebuild_tensor":
+		if len(args) < 4 {
+			return nil, fmt.Errorf("%s with %v arguments", class.name, len(args))
+		}
+		storage, okStorage := args[0].(torchTensor)
+		offset, okOffset := args[1].(int64)
+		shape, errShape := pickleInts(args[2])
+		stride, errStride := pickleInts(args[3])
+		if !okStorage || !okOffset || errShape != nil || errStride != nil || len(shape) != len(stride) {
+			return nil, fmt.Errorf("invalid arguments of %s", class.name)
+		}
+		storage.offset = int(offset)
+		storage.shape = shape
+		storage.stride = stride
+		return storage, nil
+	case "torch._utils._rebuild_parameter":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s without arguments", class.name)
+		}
+		return args[0], nil
+	case "collections.OrderedDict":
+		return map[any]any{}, nil
+	}
+	return pickleObject{class: class, args: args}, nil
+}
+
+func pickleInts(v any) ([]int, error) {
+	tuple, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%v is not tuple", v)
+	}
+	result := make([]int, len(tuple))
+	for i, item := range tuple {
+		n, okInt := item.(int64)
+		if !okInt {
+			return nil, fmt.Errorf("%v is not int", item)
+		}
+		result[i] = int(n)
+	}
+	return result, nil
+}
+
+// setItem sets dict item, keys that are not comparable like tuples are dropped
+func setItem(dict any, key any, value any) error {
+	m, ok := dict.(map[any]any)
+	if !ok {
+		return fmt.Errorf("setting item of %T", dict)
+	}
+	switch key.(type) {
+	case nil, bool, int64, float64, string:
+		m[key] = value
+	}
+	return nil
+}
+
+// unpickle runs pickle protocols 2 to 5 without buffers, what torch.save writes
+func unpickle(r *bufio.Reader, persistentLoad func(pid any) (any, error)) (any, error) {
+	stack := []any{}
+	memo := map[int64]any{}
+	pop := func() (any, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]any, error) {
+		for i := len(stack) - 1; 0 <= i; i-- {
+			if _, isMark := stack[i].(pickleMark); isMark {
+				items := append([]any{}, stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, fmt.Errorf("mark not found")
+	}
+	readN := func(n uint64) ([]byte, error) {
+		if math.MaxInt32 < n {
+			return nil, fmt.Errorf("too large item %v", n)
+		}
+		b := make([]byte, n)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	readUint := func(size int) (uint64, error) {
+		b, err := readN(uint64(size))
+		if err != nil {
+			return 0, err
+		}
+		var buf [8]byte
+		copy(buf[:], b)
+		return binary.LittleEndian.Uint64(buf[:]), nil
+	}
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimSuffix(line, "\n"), err
+	}
+
+	for {
+		op, errOp := r.ReadByte()
+		if errOp != nil {
+			return nil, fmt.Errorf("unexpected end of pickle err=%v", errOp)
+		}
+		var err error
+		switch op {
+		case 0x80: //PROTO
+			_, err = r.ReadByte()
+		case 0x95: //FRAME
+			_, err = readUint(8)
+		case '.': //STOP
+			return pop()
+
+		case '(': //MARK
+			stack = append(stack, pickleMark{})
+		case '0': //POP
+			_, err = pop()
+		case '1': //POP_MARK
+			_, err = popMark()
+		case '2': //DUP
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("stack underflow")
+			}
+			stack = append(stack, stack[len(stack)-1])
+
+		case 'N': //NONE
+			stack = append(stack, nil)
+		case 0x88: //NEWTRUE
+			stack = append(stack, true)
+		case 0x89: //NEWFALSE
+			stack = append(stack, false)
+		case 'K': //BININT1
+			var v uint64
+			v, err = readUint(1)
+			stack = append(stack, int64(v))
+		case 'M': //BININT2
+			var v uint64
+			v, err = readUint(2)
+			stack = append(stack, int64(v))
+		case 'J': //BININT
+			var v uint64
+			v, err = readUint(4)
+			stack = append(stack, int64(int32(v)))
+		case 0x8a, 0x8b: //LONG1, LONG4
+			var n uint64
+			var b []byte
+			if n, err = readUint(map[byte]int{0x8a: 1, 0x8b: 4}[op]); err == nil {
+				b, err = readN(n)
+			}
+			if err == nil {
+				stack = append(stack, pickleLong(b))
+			}
+		case 'I', 'L': //INT, LONG
+			var line string
+			line, err = readLine()
+			if err == nil {
+				var v int64
+				v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+				stack = append(stack, v)
+			}
+		case 'G': //BINFLOAT
+			var v uint64
+			var b []byte
+			b, err = readN(8)
+			if err == nil {
+				v = binary.BigEndian.Uint64(b)
+			}
+			stack = append(stack, math.Float64frombits(v))
+
+		case 'X', 0x8c, 0x8d: //BINUNICODE, SHORT_BINUNICODE, BINUNICODE8
+			var n uint64
+			var b []byte
+			if n, err = readUint(map[byte]int{'X': 4, 0x8c: 1, 0x8d: 8}[op]); err == nil {
+				b, err = readN(n)
+			}
+			stack = append(stack, string(b))
+		case 'T', 'U', 'B', 'C', 0x8e: //BINSTRING, SHORT_BINSTRING, BINBYTES, SHORT_BINBYTES, BINBYTES8
+			var n uint64
+			var b []byte
+			if n, err = readUint(map[byte]int{'T': 4, 'U': 1, 'B': 4, 'C': 1, 0x8e: 8}[op]); err == nil {
+				b, err = readN(n)
+			}
+			stack = append(stack, string(b))
+
+		case '}': //EMPTY_DICT
+			stack = append(stack, map[any]any{})
+		case ']': //EMPTY_LIST
+			stack = append(stack, &pickleList{})
+		case ')': //EMPTY_TUPLE
+			stack = append(stack, []any{})
+		case 0x8f: //EMPTY_SET, items are not needed
+			stack = append(stack, &pickleList{})
+		case 't': //TUPLE
+			var items []any
+			items, err = popMark()
+			stack = append(stack, items)
+		case 0x85, 0x86, 0x87: //TUPLE1, TUPLE2, TUPLE3
+			n := int(op-0x85) + 1
+			if len(stack) < n {
+				return nil, fmt.Errorf("stack underflow")
+			}
+			items := append([]any{}, stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case 'l': //LIST
+			var items []any
+			items, err = popMark()
+			stack = append(stack, &pickleList{items: items})
+		case 'd': //DICT
+			var items []any
+			items, err = popMark()
+			dict := map[any]any{}
+			for i := 0; err == nil && i+1 < len(items); i += 2 {
+				err = setItem(dict, items[i], items[i+1])
+			}
+			stack = append(stack, dict)
+		case 'a': //APPEND
+			var item any
+			if item, err = pop(); err == nil && 0 < len(stack) {
+				if list, ok := stack[len(stack)-1].(*pickleList); ok {
+					list.items = append(list.items, item)
+				}
+			}
+		case 'e', 0x90: //APPENDS, ADDITEMS
+			var items []any
+			if items, err = popMark(); err == nil && 0 < len(stack) {
+				if list, ok := stack[len(stack)-1].(*pickleList); ok {
+					list.items = append(list.items, items...)
+				}
+			}
+		case 's': //SETITEM
+			var key, value any
+			if value, err = pop(); err == nil {
+				key, err = pop()
+			}
+			if err == nil && 0 < len(stack) {
+				err = setItem(stack[len(stack)-1], key, value)
+			}
+		case 'u': //SETITEMS
+			var items []any
+			if items, err = popMark(); err == nil && 0 < len(stack) {
+				for i := 0; err == nil && i+1 < len(items); i += 2 {
+					err = setItem(stack[len(stack)-1], items[i], items[i+1])
+				}
+			}
+
+		case 'q', 'r': //BINPUT, LONG_BINPUT
+			var index uint64
+			index, err = readUint(map[byte]int{'q': 1, 'r': 4}[op])
+			if err == nil && 0 < len(stack) {
+				memo[int64(index)] = stack[len(stack)-1]
+			}
+		case 0x94: //MEMOIZE
+			if 0 < len(stack) {
+				memo[int64(len(memo))] = stack[len(stack)-1]
+			}
+		case 'h', 'j': //BINGET, LONG_BINGET
+			var index uint64
+			index, err = readUint(map[byte]int{'h': 1, 'j': 4}[op])
+			v, haz := memo[int64(index)]
+			if err == nil && !haz {
+				err = fmt.Errorf("memo %v not found", index)
+			}
+			stack = append(stack, v)
+
+		case 'c': //GLOBAL
+			var module, name string
+			if module, err = readLine(); err == nil {
+				name, err = readLine()
+			}
+			stack = append(stack, pickleGlobal{module: module, name: name})
+		case 0x93: //STACK_GLOBAL
+			var module, name any
+			if name, err = pop(); err == nil {
+				module, err = pop()
+			}
+			moduleStr, okModule := module.(string)
+			nameStr, okName := name.(string)
+			if err == nil && (!okModule || !okName) {
+				err = fmt.Errorf("invalid global %v %v", module, name)
+			}
+			stack = append(stack, pickleGlobal{module: moduleStr, name: nameStr})
+		case 'R', 0x81: //REDUCE, NEWOBJ
+			var callable, args any
+			if args, err = pop(); err == nil {
+				callable, err = pop()
+			}
+			argTuple, ok := args.([]any)
+			if err == nil && !ok {
+				err = fmt.Errorf("arguments %v are not tuple", args)
+			}
+			var result any
+			if err == nil {
+				result, err = reduce(callable, argTuple)
+			}
+			stack = append(stack, result)
+		case 'b': //BUILD, state of dict subclasses is merged
+			var state any
+			if state, err = pop(); err == nil && 0 < len(stack) {
+				if dict, ok := stack[len(stack)-1].(map[any]any); ok {
+					if stateDict, okState := state.(map[any]any); okState {
+						for k, v := range stateDict {
+							dict[k] = v
+						}
+					}
+				}
+			}
+		case 'Q': //BINPERSID
+			var pid, loaded any
+			if pid, err = pop(); err == nil {
+				loaded, err = persistentLoad(pid)
+			}
+			stack = append(stack, loaded)
+
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pickleLong decodes little endian two's complement integer, values outside int64 become float64
+func pickleLong(b []byte) any {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	if len(b) <= 8 {
+		var buf [8]byte
+		if b[len(b)-1]&0x80 != 0 {
+			buf = [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		}
+		copy(buf[:], b)
+		return int64(binary.LittleEndian.Uint64(buf[:]))
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	f, _ := new(big.Float).SetInt(v).Float64()
+	return f
+}
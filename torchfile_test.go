@@ -0,0 +1,28 @@
+package bindstablediff
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testdata/embedding.pt is A1111 textual inversion file of 2 vectors, pickled like torch.save does
+func TestTorchEmbedding(t *testing.T) {
+	tf, err := openTorchFile("testdata/embedding.pt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close()
+
+	tensors := torchEmbedding(tf)
+	if _, haz := tensors["emb_params"]; !haz || len(tensors) != 1 {
+		t.Fatalf("string_to_param not found, tensors %v", tensors)
+	}
+	vectors, errRead := readEmbeddingVectors(tensors, "embedding.pt", "emb_params")
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	want := [][]float32{{0.5, -1, 2, 0.25}, {1.5, -0.5, 3, -2}}
+	if !reflect.DeepEqual(vectors, want) {
+		t.Errorf("vectors %v, want %v", vectors, want)
+	}
+}
@@ -0,0 +1,156 @@
+package bindstablediff
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+const (
+	upscaleTileOverlap     = 64
+	upscaleDefaultStrength = 0.3
+)
+
+/*
+Upscale enlarges image by factor and adds details with img2img, tile by tile. Memory use stays same as with
+one Width x Height picture. Width and Height in pars are tile size (default native size of model, 1024 on SDXL and
+512 on others) and Strength defaults to 0.3.
+*/
+func (p *StableDiffusionModel) Upscale(img image.Image, factor float64, pars TextGenPars) (image.Image, error) {
+	return p.UpscaleWithProgress(img, factor, pars, nil)
+}
+
+// UpscaleWithProgress is Upscale that calls progress after each completed tile
+func (p *StableDiffusionModel) UpscaleWithProgress(img image.Image, factor float64, pars TextGenPars, progress func(done int, total int)) (image.Image, error) {
+	modelType := p.ModelType()
+	if modelType == MODEL_UNKNOWN {
+		return nil, errClosed
+	}
+	return upscale(p.Img2Img, modelType.NativeSize(), img, factor, pars, progress)
+}
+
+func upscale(img2img func(image.Image, TextGenPars) (image.Image, error), tileSize int, img image.Image, factor float64, pars TextGenPars, progress func(done int, total int)) (image.Image, error) {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+	if factor <= 0 {
+		return nil, fmt.Errorf("invalid upscale factor %v", factor)
+	}
+	w := max(1, int(math.Round(float64(b.Dx())*factor)))
+	h := max(1, int(math.Round(float64(b.Dy())*factor)))
+
+	tileW := tileSize
+	if 0 < pars.Width {
+		tileW = RoundToModelSize(pars.Width)
+	}
+	tileH := tileSize
+	if 0 < pars.Height {
+		tileH = RoundToModelSize(pars.Height)
+	}
+	//Small output do not need full tile
+	tileW = min(tileW, RoundToModelSize(w))
+	tileH = min(tileH, RoundToModelSize(h))
+	if pars.Strength <= 0 {
+		pars.Strength = upscaleDefaultStrength
+	}
+
+	//Canvas can not be smaller than one tile
+	canvasW := max(w, tileW)
+	canvasH := max(h, tileH)
+	canvas := resizeLanczos(img, canvasW, canvasH)
+
+	xPositions := tilePositions(canvasW, tileW, upscaleTileOverlap)
+	yPositions := tilePositions(canvasH, tileH, upscaleTileOverlap)
+	total := len(xPositions) * len(yPositions)
+
+	sums := make([]float64, canvasW*canvasH*3)
+	weights := make([]float64, canvasW*canvasH)
+
+	tilePars := pars
+	tilePars.Width = tileW
+	tilePars.Height = tileH
+	tilePars.ResizeMode = JUST_RESIZE
+	tilePars.RestoreSize = false
+
+	done := 0
+	for _, y0 := range yPositions {
+		for _, x0 := range xPositions {
+			tileRect := image.Rect(x0, y0, x0+tileW, y0+tileH)
+			tileImg := canvas.SubImage(tileRect)
+			if 0 <= pars.Seed {
+				tilePars.Seed = pars.Seed + int64(done) //Same noise on every tile would show as pattern
+			}
+			generated, errGen := img2img(tileImg, tilePars)
+			if errGen != nil {
+				return nil, fmt.Errorf("upscale tile %v/%v failed %s", done+1, total, errGen.Error())
+			}
+			gen := image.NewRGBA(image.Rect(0, 0, tileW, tileH))
+			draw.Draw(gen, gen.Bounds(), generated, generated.Bounds().Min, draw.Src)
+
+			//Feather only edges that overlap with other tiles
+			for ty := 0; ty < tileH; ty++ {
+				wy := featherWeight(ty, tileH, upscaleTileOverlap, 0 < y0, y0+tileH < canvasH)
+				for tx := 0; tx < tileW; tx++ {
+					wx := featherWeight(tx, tileW, upscaleTileOverlap, 0 < x0, x0+tileW < canvasW)
+					wt := wx * wy
+					pos := (y0+ty)*canvasW + x0 + tx
+					src := gen.Pix[ty*gen.Stride+tx*4:]
+					sums[pos*3+0] += wt * float64(src[0])
+					sums[pos*3+1] += wt * float64(src[1])
+					sums[pos*3+2] += wt * float64(src[2])
+					weights[pos] += wt
+				}
+			}
+			done++
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, canvasW, canvasH))
+	for i, wt := range weights {
+		for c := 0; c < 3; c++ {
+			if 0 < wt {
+				result.Pix[i*4+c] = clampByte(sums[i*3+c] / wt)
+			} else {
+				result.Pix[i*4+c] = canvas.Pix[i*4+c]
+			}
+		}
+		result.Pix[i*4+3] = 255
+	}
+	if canvasW != w || canvasH != h {
+		return resizeLanczos(result, w, h), nil
+	}
+	return result, nil
+}
+
+// tilePositions spreads tiles evenly so that they cover length and overlap at least by overlap, at most half of tile
+func tilePositions(length int, tile int, overlap int) []int {
+	if length <= tile {
+		return []int{0}
+	}
+	overlap = min(overlap, tile/2) //Small tiles would need step 0
+	step := tile - overlap
+	n := int(math.Ceil(float64(length-overlap) / float64(step)))
+	n = max(n, 2)
+	result := make([]int, n)
+	for i := range result {
+		result[i] = int(math.Round(float64(i) * float64(length-tile) / float64(n-1)))
+	}
+	return result
+}
+
+// featherWeight ramps weight linearly over overlap area on edges that have neighbour tile
+func featherWeight(pos int, length int, overlap int, rampStart bool, rampEnd bool) float64 {
+	result := 1.0
+	if rampStart {
+		result = math.Min(result, (float64(pos)+0.5)/float64(overlap))
+	}
+	if rampEnd {
+		result = math.Min(result, (float64(length-pos)-0.5)/float64(overlap))
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package bindstablediff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTilePositions(t *testing.T) {
+	cases := []struct {
+		name                  string
+		length, tile, overlap int
+		want                  []int
+	}{
+		{"one tile", 512, 512, 64, []int{0}},
+		{"smaller than tile", 300, 512, 64, []int{0}},
+		{"exact overlap", 960, 512, 64, []int{0, 448}},
+		{"three tiles", 1024, 512, 64, []int{0, 256, 512}},
+		{"edge tiles spread", 2000, 512, 64, []int{0, 372, 744, 1116, 1488}},
+		{"overlap larger than remainder", 540, 512, 64, []int{0, 28}},
+		{"overlap as large as tile", 80, 64, 64, []int{0, 16}},
+	}
+	for _, c := range cases {
+		got := tilePositions(c.length, c.tile, c.overlap)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: positions %v, want %v", c.name, got, c.want)
+			continue
+		}
+		//Last tile ends at edge and neighbours overlap enough
+		if 1 < len(got) && got[len(got)-1]+c.tile != c.length {
+			t.Errorf("%s: last tile ends at %v", c.name, got[len(got)-1]+c.tile)
+		}
+		for i := 1; i < len(got); i++ {
+			if overlap := got[i-1] + c.tile - got[i]; overlap < min(c.overlap, c.tile/2) {
+				t.Errorf("%s: tiles %v and %v overlap only %v", c.name, i-1, i, overlap)
+			}
+		}
+	}
+}
+
+func TestFeatherWeight(t *testing.T) {
+	cases := []struct {
+		pos, length, overlap int
+		rampStart, rampEnd   bool
+		want                 float64
+	}{
+		{0, 512, 64, false, false, 1},
+		{0, 512, 64, true, false, 0.5 / 64},
+		{63, 512, 64, true, false, 63.5 / 64},
+		{64, 512, 64, true, true, 1},
+		{511, 512, 64, true, false, 1},
+		{511, 512, 64, false, true, 0.5 / 64},
+		{448, 512, 64, false, true, 63.5 / 64},
+		{10, 20, 64, true, true, 9.5 / 64},
+	}
+	for _, c := range cases {
+		got := featherWeight(c.pos, c.length, c.overlap, c.rampStart, c.rampEnd)
+		if 1e-12 < math.Abs(got-c.want) {
+			t.Errorf("featherWeight(%v, %v, %v, %v, %v) = %v, want %v", c.pos, c.length, c.overlap, c.rampStart, c.rampEnd, got, c.want)
+		}
+	}
+
+	//Ramps of neighbour tiles sum to 1 over overlap area
+	for x := 0; x < 64; x++ {
+		sum := featherWeight(448+x, 512, 64, false, true) + featherWeight(x, 512, 64, true, false)
+		if 1e-12 < math.Abs(sum-1) {
+			t.Errorf("overlap position %v weights sum to %v", x, sum)
+		}
+	}
+}
+
+func TestUpscaleFactorOne(t *testing.T) {
+	c := color.RGBA{200, 100, 50, 255}
+	img := solidImage(image.Rect(0, 0, 100, 80), c)
+
+	var tiles []TextGenPars
+	copyTile := func(tile image.Image, pars TextGenPars) (image.Image, error) {
+		tiles = append(tiles, pars)
+		return tile, nil
+	}
+	var progressTotal int
+	result, err := upscale(copyTile, 512, img, 1, TextGenPars{Seed: 7}, func(done int, total int) { progressTotal = total })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Bounds() != image.Rect(0, 0, 100, 80) {
+		t.Fatalf("result bounds %v", result.Bounds())
+	}
+	rgba := result.(*image.RGBA)
+	for y := 0; y < 80; y++ {
+		for x := 0; x < 100; x++ {
+			if got := rgba.RGBAAt(x, y); got != c {
+				t.Fatalf("pixel (%v,%v) is %v, want %v", x, y, got, c)
+			}
+		}
+	}
+
+	//Canvas 128x80 is covered by 128x64 tiles at y 0 and 16
+	if len(tiles) != 2 || progressTotal != 2 {
+		t.Fatalf("%v tiles, progress total %v", len(tiles), progressTotal)
+	}
+	for i, pars := range tiles {
+		if pars.Width != 128 || pars.Height != 64 || pars.Strength != upscaleDefaultStrength || pars.Seed != 7+int64(i) {
+			t.Errorf("tile %v pars %vx%v strength %v seed %v", i, pars.Width, pars.Height, pars.Strength, pars.Seed)
+		}
+	}
+
+	for _, factor := range []float64{0, -1} {
+		if _, err := upscale(copyTile, 512, img, factor, TextGenPars{}, nil); err == nil {
+			t.Errorf("factor %v accepted", factor)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package bindstablediff
+
+/*
+#include "bindstablediff.h"
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+/*
+External VAE replaces first_stage_model weights of model, like ft-MSE VAE on checkpoints that have poor one.
+VAE file can be ggml model file, full .safetensors checkpoint or standalone .safetensors VAE
+*/
+
+const vaePrefix = "first_stage_model."
+
+// tensor name prefixes of standalone vae files, without first_stage_model.
+var vaeStandalonePrefixes = []string{"encoder.", "decoder.", "quant_conv.", "post_quant_conv."}
+
+// vaeTensor is weight read from vae file, ne is in ggml order
+type vaeTensor struct {
+	ne   []int
+	data []float32
+}
+
+// vaeTensorName gives name in model for tensor of vae file, false if tensor is not vae weight
+func vaeTensorName(name string) (string, bool) {
+	if strings.HasPrefix(name, vaePrefix) {
+		return name, true
+	}
+	for _, prefix := range vaeStandalonePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return vaePrefix + name, true
+		}
+	}
+	return "", false
+}
+
+// readVAEFile reads vae weights as float32 from ggml or .safetensors file
+func readVAEFile(fname string) (map[string]vaeTensor, error) {
+	result := make(map[string]vaeTensor)
+	if strings.EqualFold(filepath.Ext(fname), ".safetensors") {
+		st, errOpen := openSafetensors(fname)
+		if errOpen != nil {
+			return nil, errOpen
+		}
+		defer st.Close()
+		for _, stName := range st.Names() {
+			name, isVAE := vaeTensorName(stName)
+			if !isVAE || !isFloatDType(st.entries[stName].DType) {
+				continue
+			}
+			data, shape, errRead := st.ReadFloat32(stName)
+			if errRead != nil {
+				return nil, errRead
+			}
+			for _, t := range preprocessCheckpointTensor(name, shape, data) {
+				ne := make([]int, len(t.shape))
+				for i, n := range t.shape { //ggml order is reversed
+					ne[len(t.shape)-1-i] = n
+				}
+				result[t.name] = vaeTensor{ne: ne, data: t.data}
+			}
+		}
+	} else {
+		gf, errOpen := openGGMLFile(fname)
+		if errOpen != nil {
+			return nil, errOpen
+		}
+		defer gf.Close()
+		for {
+			t, errNext := gf.Next()
+			if errNext == io.EOF {
+				break
+			}
+			if errNext != nil {
+				return nil, errNext
+			}
+			if !strings.HasPrefix(t.name, vaePrefix) {
+				continue
+			}
+			data, errDecode := decodeGGML(t.ggmlType, t.data, t.nElements())
+			if errDecode != nil {
+				return nil, fmt.Errorf("tensor %s: %s", t.name, errDecode.Error())
+			}
+			result[t.name] = vaeTensor{ne: t.ne, data: data}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no vae weights in %s", fname)
+	}
+	return result, nil
+}
+
+// sameShape compares ne of file tensor to 4 dims of model tensor
+func sameShape(ne []int, modelNe []int) bool {
+	for i, n := range modelNe {
+		fileN := 1
+		if i < len(ne) {
+			fileN = ne[i]
+		}
+		if fileN != n {
+			return false
+		}
+	}
+	return len(ne) <= len(modelNe)
+}
+
+// setVAE checks that vae file has every vae weight of model with same shape, and then replaces them
+func setVAE(sdModel C.StableDiffusionModel, fname string) error {
+	tensors, errRead := readVAEFile(fname)
+	if errRead != nil {
+		return fmt.Errorf("reading vae %s failed err=%v", fname, errRead)
+	}
+
+	cNames := C.modelTensorNames(&sdModel)
+	names := C.GoString(cNames)
+	C.free(unsafe.Pointer(cNames))
+
+	vaeNames := []string{}
+	for _, name := range strings.Split(names, "\n") {
+		if !strings.HasPrefix(name, vaePrefix) {
+			continue
+		}
+		cName := C.CString(name)
+		var cNe [4]C.int64_t
+		ret := C.vaeTensorShape(&sdModel, cName, &cNe[0])
+		C.free(unsafe.Pointer(cName))
+		if ret != 0 {
+			return fmt.Errorf("vae weight %s of model not available", name)
+		}
+		modelNe := []int{int(cNe[0]), int(cNe[1]), int(cNe[2]), int(cNe[3])}
+		t, haz := tensors[name]
+		if !haz {
+			return fmt.Errorf("vae %s does not have weight %s", fname, name)
+		}
+		if !sameShape(t.ne, modelNe) {
+			return fmt.Errorf("vae %s weight %s has shape %v, model needs %v", fname, name, t.ne, modelNe)
+		}
+		vaeNames = append(vaeNames, name)
+	}
+	if len(vaeNames) == 0 {
+		return fmt.Errorf("model has no vae weights")
+	}
+
+	for _, name := range vaeNames {
+		t := tensors[name]
+		ne := make([]C.int64_t, len(t.ne))
+		for i, n := range t.ne {
+			ne[i] = C.int64_t(n)
+		}
+		if len(ne) == 0 { //scalar
+			ne = []C.int64_t{1}
+		}
+		cName := C.CString(name)
+		ret := C.setVaeTensor(&sdModel, cName, C.int(len(ne)), &ne[0], (*C.float)(unsafe.Pointer(&t.data[0])))
+		C.free(unsafe.Pointer(cName))
+		if ret != 0 {
+			return fmt.Errorf("setting vae weight %s failed", name)
+		}
+	}
+	return nil
+}
+
+/*
+SetVAE replaces vae of model with vae from ggml or .safetensors file. Waits running generations, sessions get new
+vae too. File is checked before any weight is changed. Original vae is back with SetVAE of ggml model file itself
+*/
+func (p *StableDiffusionModel) SetVAE(fname string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed() {
+		return errClosed
+	}
+	p.weights.Lock()
+	defer p.weights.Unlock()
+	return setVAE(p.sdModel, fname)
+}